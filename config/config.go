@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -51,6 +52,28 @@ type S3 struct {
 
 var S3Config = &S3{}
 
+type Exchange struct {
+	SelfTradePrevention string // default self-trade prevention mode (CN, CO, CB or DC) of orders that do not request one
+
+	BreakerMove     float64       // relative price move within BreakerWindow that halts matching, zero (the default) disables the breaker
+	BreakerWindow   time.Duration // how far back price moves are measured
+	BreakerCooldown time.Duration // how long matching stays halted after the breaker trips
+
+	JournalDir string // directory of the order book journals
+
+	SnapshotStore     string // where order book snapshots are kept, "s3" or "local"
+	SnapshotDir       string // directory of the local snapshot store
+	SnapshotRetention int    // timestamped snapshots kept per book, zero keeps all of them
+	SnapshotMismatch  string // what a snapshot failing verification does, "report" (the default) loads it with the recomputed values, "cancel-only" only accepts cancellations and "halt" refuses to start
+
+	SnapshotInterval time.Duration // longest a change waits before the book is saved
+	SnapshotCommands int           // unsaved commands that save the book before SnapshotInterval has passed
+
+	ReconcilePolicy string // what startup reconciliation does about discrepancies, "report" (the default), "reinsert", "cancel" or "halt"
+}
+
+var ExchangeConfig = &Exchange{}
+
 func Setup() {
 
 	log.Println("config setup")
@@ -85,6 +108,33 @@ func Setup() {
 	S3Config.Bucket = envMap["BUCKET"]
 	UtilConfig.ETHERSCAN_KEY = envMap["ETHERSCAN_KEY"]
 	Wallet.HashKey = envMap["WALLET_HASHKEY"]
+	ExchangeConfig.SelfTradePrevention = envMap["STP_MODE"]
+	ExchangeConfig.BreakerMove = envFloat(envMap["BREAKER_MOVE"], 0)
+	ExchangeConfig.BreakerWindow = time.Duration(envFloat(envMap["BREAKER_WINDOW"], 60)) * time.Second
+	ExchangeConfig.BreakerCooldown = time.Duration(envFloat(envMap["BREAKER_COOLDOWN"], 300)) * time.Second
+	ExchangeConfig.JournalDir = envMap["JOURNAL_DIR"]
+	if ExchangeConfig.JournalDir == "" {
+		ExchangeConfig.JournalDir = "journal"
+	}
+	ExchangeConfig.SnapshotStore = strings.ToLower(envMap["SNAPSHOT_STORE"])
+	if ExchangeConfig.SnapshotStore == "" {
+		ExchangeConfig.SnapshotStore = "s3"
+	}
+	ExchangeConfig.SnapshotDir = envMap["SNAPSHOT_DIR"]
+	if ExchangeConfig.SnapshotDir == "" {
+		ExchangeConfig.SnapshotDir = "snapshots"
+	}
+	ExchangeConfig.SnapshotRetention = int(envFloat(envMap["SNAPSHOT_RETENTION"], 500))
+	ExchangeConfig.SnapshotMismatch = strings.ToLower(envMap["SNAPSHOT_MISMATCH"])
+	if ExchangeConfig.SnapshotMismatch == "" {
+		ExchangeConfig.SnapshotMismatch = "report"
+	}
+	ExchangeConfig.SnapshotInterval = time.Duration(envFloat(envMap["SNAPSHOT_INTERVAL"], 5) * float64(time.Second))
+	ExchangeConfig.SnapshotCommands = int(envFloat(envMap["SNAPSHOT_COMMANDS"], 100))
+	ExchangeConfig.ReconcilePolicy = envMap["RECONCILE_POLICY"]
+	if ExchangeConfig.ReconcilePolicy == "" {
+		ExchangeConfig.ReconcilePolicy = "report"
+	}
 
 	if IsTest {
 		Wallet.InitBcltTolerance = -68.9582676
@@ -97,6 +147,15 @@ func Setup() {
 	log.Println("config setup complete")
 }
 
+// envFloat parses an optional numeric setting, falling back to `fallback` when it is unset or invalid
+func envFloat(value string, fallback float64) float64 {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
 func getEnvMap(data []string, getkeyval func(item string) (key, val string)) map[string]string {
 	items := make(map[string]string)
 	for _, item := range data {
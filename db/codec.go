@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// decimal128Digits is the number of significant digits a Decimal128 holds, enough for any wei amount
+const decimal128Digits = 34
+
+var tDecimal = reflect.TypeOf(decimal.Decimal{})
+
+// registry is the BSON registry of the client: the default one, with decimal.Decimal stored as Decimal128
+func registry() *bsoncodec.Registry {
+	return bson.NewRegistryBuilder().
+		RegisterTypeEncoder(tDecimal, bsoncodec.ValueEncoderFunc(encodeDecimal)).
+		RegisterTypeDecoder(tDecimal, bsoncodec.ValueDecoderFunc(decodeDecimal)).
+		Build()
+}
+
+// toDecimal128 converts `d` to a Decimal128. Amounts are integers and always fit, a price with more
+// significant digits than a Decimal128 holds (an average, say) is rounded to fit.
+func toDecimal128(d decimal.Decimal) (primitive.Decimal128, error) {
+	if digits := len(d.Coefficient().Text(10)); d.Sign() != 0 && digits > decimal128Digits {
+		d = d.Round(-d.Exponent() - int32(digits-decimal128Digits))
+	}
+	d128, ok := primitive.ParseDecimal128FromBigInt(d.Coefficient(), int(d.Exponent()))
+	if !ok {
+		return primitive.Decimal128{}, fmt.Errorf("cannot store %s as a decimal128", d)
+	}
+	return d128, nil
+}
+
+func encodeDecimal(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tDecimal {
+		return bsoncodec.ValueEncoderError{Name: "encodeDecimal", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+	d128, err := toDecimal128(val.Interface().(decimal.Decimal))
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(d128)
+}
+
+// decodeDecimal reads a Decimal128, and the doubles, integers and strings documents stored amounts as before them
+func decodeDecimal(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDecimal {
+		return bsoncodec.ValueDecoderError{Name: "decodeDecimal", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+	var d decimal.Decimal
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		d128, err := vr.ReadDecimal128()
+		if err != nil {
+			return err
+		}
+		coefficient, exponent, err := d128.BigInt()
+		if err != nil {
+			return err
+		}
+		d = decimal.NewFromBigInt(coefficient, int32(exponent))
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		if err != nil {
+			return err
+		}
+		d = decimal.NewFromFloat(f)
+	case bsontype.Int32:
+		i, err := vr.ReadInt32()
+		if err != nil {
+			return err
+		}
+		d = decimal.NewFromInt32(i)
+	case bsontype.Int64:
+		i, err := vr.ReadInt64()
+		if err != nil {
+			return err
+		}
+		d = decimal.NewFromInt(i)
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		if d, err = decimal.NewFromString(s); err != nil {
+			return err
+		}
+	case bsontype.Null:
+		if err := vr.ReadNull(); err != nil {
+			return err
+		}
+	case bsontype.Undefined:
+		if err := vr.ReadUndefined(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot decode %v into a decimal", vr.Type())
+	}
+	val.Set(reflect.ValueOf(d))
+	return nil
+}
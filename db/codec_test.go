@@ -0,0 +1,73 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type decimalDoc struct {
+	Amount decimal.Decimal `bson:"amount"`
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	for _, amount := range []string{"0", "1234567890123456789012345678", "-62043868187056025", "2417.67"} {
+		data, err := bson.MarshalWithRegistry(registry(), decimalDoc{Amount: decimal.RequireFromString(amount)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind := bson.Raw(data).Lookup("amount").Type; kind != bson.TypeDecimal128 {
+			t.Fatalf("%v was stored as %v", amount, kind)
+		}
+		var doc decimalDoc
+		if err := bson.UnmarshalWithRegistry(registry(), data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if !doc.Amount.Equal(decimal.RequireFromString(amount)) {
+			t.Fatalf("%v came back as %v", amount, doc.Amount)
+		}
+	}
+}
+
+func TestDecimalRounded(t *testing.T) {
+	// an average price with more digits than a Decimal128 holds is rounded to fit
+	price := decimal.RequireFromString("1").Div(decimal.RequireFromString("3")).Add(decimal.NewFromInt(1e18))
+	data, err := bson.MarshalWithRegistry(registry(), decimalDoc{Amount: price})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc decimalDoc
+	if err := bson.UnmarshalWithRegistry(registry(), data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.Amount.Equal(price.Round(15)) {
+		t.Fatalf("%v came back as %v, expected %v", price, doc.Amount, price.Round(15))
+	}
+}
+
+func TestDecodeNumbers(t *testing.T) {
+	// documents written before amounts were Decimal128 hold doubles and integers
+	for _, value := range []interface{}{2.5e9, int32(7), int64(5e9), nil} {
+		data, err := bson.Marshal(bson.M{"amount": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc decimalDoc
+		if err := bson.UnmarshalWithRegistry(registry(), data, &doc); err != nil {
+			t.Fatalf("%v: %v", value, err)
+		}
+		expected := decimal.Zero
+		switch v := value.(type) {
+		case float64:
+			expected = decimal.NewFromFloat(v)
+		case int32:
+			expected = decimal.NewFromInt32(v)
+		case int64:
+			expected = decimal.NewFromInt(v)
+		}
+		if !doc.Amount.Equal(expected) {
+			t.Fatalf("%v was decoded as %v", value, doc.Amount)
+		}
+	}
+}
@@ -25,6 +25,9 @@ type CollectionRef struct {
 	Pools        string
 	Wallets      string
 	Transactions string
+	Trades       string
+	Ledger       string
+	Migrations   string
 }
 
 const (
@@ -42,6 +45,9 @@ func getCollections() *CollectionRef {
 		Pools:        "pools",
 		Wallets:      "wallets",
 		Transactions: "transactions",
+		Trades:       "trades",
+		Ledger:       "ledger",
+		Migrations:   "migrations",
 	}
 }
 func GetDB() *mongo.Database {
@@ -71,6 +77,18 @@ func TransactionCollection() *mongo.Collection {
 	return GetDB().Collection(DB.Collections.Transactions)
 }
 
+func TradeCollection() *mongo.Collection {
+	return GetDB().Collection(DB.Collections.Trades)
+}
+
+func LedgerCollection() *mongo.Collection {
+	return GetDB().Collection(DB.Collections.Ledger)
+}
+
+func MigrationCollection() *mongo.Collection {
+	return GetDB().Collection(DB.Collections.Migrations)
+}
+
 func Close(ctx context.Context) error {
 	return DB.Client.Disconnect(ctx)
 }
@@ -85,6 +103,7 @@ func Setup() {
 
 	clientOpts.ApplyURI(connectionURI)
 	clientOpts.SetConnectTimeout(connectTimeout)
+	clientOpts.SetRegistry(registry())
 
 	DB.Client, err = mongo.NewClient(clientOpts)
 	if err != nil {
@@ -106,6 +125,21 @@ func Setup() {
 	fmt.Println("Connected to MongoDB!")
 	DB.Collections = *getCollections()
 	DB.IsTest = config.IsTest
+	if err = EnsureTradeIndexes(ctx); err != nil {
+		log.Panicf("Failed to create trade indexes: %v", err)
+	}
+	if err = EnsureOrderIndexes(ctx); err != nil {
+		log.Panicf("Failed to create order indexes: %v", err)
+	}
+	if err = EnsureLedgerIndexes(ctx); err != nil {
+		log.Panicf("Failed to create ledger indexes: %v", err)
+	}
+	if err = MigrateBaseUnits(ctx); err != nil {
+		log.Panicf("Failed to migrate amounts to base units: %v", err)
+	}
+	if err = OpenLedger(ctx); err != nil {
+		log.Panicf("Failed to open ledger accounts: %v", err)
+	}
 	defer cancel()
 	log.Println("db setup complete")
 
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Assets, named after their fields in UserBalance and HeldBalance
+const (
+	assetBitclout = "bitclout"
+	assetEther    = "ether"
+	assetUSDC     = "usdc"
+)
+
+// ErrInsufficientFunds is returned when the available balance of a user does not cover an order
+var ErrInsufficientFunds = errors.New("Insufficient funds.")
+
+// quoteAsset returns the settlement asset of `market`
+func quoteAsset(market *global.Market) string {
+	if market.Quote == "USDC" {
+		return assetUSDC
+	}
+	return assetEther
+}
+
+// heldAsset returns the asset an order holds: the settlement asset of `market` for buys, BitClout for sells
+func heldAsset(market *global.Market, orderSide string) string {
+	if orderSide != "buy" {
+		return assetBitclout
+	}
+	return quoteAsset(market)
+}
+
+/*
+holdAmount returns the base units of `asset` an order holds
+
+Arguments:
+	quantity - The BitClout quantity of the order in nanos, held by sells
+	totalQuote - The most the order can cost in base units of the settlement asset, held by buys
+*/
+func holdAmount(asset string, quantity, totalQuote decimal.Decimal) decimal.Decimal {
+	if asset == assetBitclout {
+		return quantity
+	}
+	return totalQuote
+}
+
+/*
+heldRelease returns the part of the hold of `order` that covers `quantity` nanos of its remaining quantity.
+
+Settling the rest of the order releases everything it still holds, so rounding never leaves a hold behind.
+*/
+func heldRelease(order *models.OrderSchema, quantity decimal.Decimal) decimal.Decimal {
+	remaining := order.OrderQuantity.Sub(order.OrderQuantityProcessed)
+	if order.Held.Sign() <= 0 {
+		return decimal.Zero
+	}
+	if quantity.GreaterThanOrEqual(remaining) {
+		return order.Held
+	}
+	return order.Held.Mul(quantity).DivRound(remaining, 0)
+}
+
+/*
+fillRelease returns the part of the hold of `order` a fill of `quantity` nanos costing `quote` base units of the
+settlement asset releases, and how much more than that the fill debits from the held asset.
+
+A buy holds the settlement asset at its USD value when the order was placed but pays at its value when it fills,
+so on ETH markets a fill after ETH fell costs more than its share of the hold. The shortfall has to come from
+the available balance of the user.
+*/
+func fillRelease(order *models.OrderSchema, quantity, quote decimal.Decimal) (release, shortfall decimal.Decimal) {
+	release = heldRelease(order, quantity)
+	if order.HeldAsset == "" {
+		return release, decimal.Zero
+	}
+	debit := holdAmount(order.HeldAsset, quantity, quote)
+	return release, decimal.Max(debit.Sub(release), decimal.Zero)
+}
+
+// balanceOf returns the total and held base units of `asset` in `balance`
+func balanceOf(balance *models.UserBalance, asset string) (total, held decimal.Decimal) {
+	switch asset {
+	case assetBitclout:
+		return balance.Bitclout, balance.Held.Bitclout
+	case assetUSDC:
+		return balance.USDC, balance.Held.USDC
+	default:
+		return balance.Ether, balance.Held.Ether
+	}
+}
+
+// availableBalance returns the base units of `asset` in `balance` that no order holds
+func availableBalance(balance *models.UserBalance, asset string) decimal.Decimal {
+	total, held := balanceOf(balance, asset)
+	return decimal.Max(total.Sub(held), decimal.Zero)
+}
+
+// CoversHolds reports whether the user's balance still covers what their orders on `orderSide` of `market` hold.
+// It only fails when funds leave the account without releasing the holds on them first.
+func CoversHolds(balance *models.UserBalance, market *global.Market, orderSide string) bool {
+	total, held := balanceOf(balance, heldAsset(market, orderSide))
+	return total.GreaterThanOrEqual(held)
+}
+
+/*
+HoldOrderBalance reserves what `order` can spend from the available balance of its user and records
+the hold on the order, which must not have been created yet.
+
+Arguments:
+	quantity - The most BitClout the order can sell, in nanos
+	totalQuote - The most the order can cost in base units of the settlement asset of `market`
+Return:
+	ErrInsufficientFunds if the available balance does not cover the hold
+*/
+func HoldOrderBalance(ctx context.Context, order *models.OrderSchema, market *global.Market, quantity, totalQuote decimal.Decimal) error {
+	asset := heldAsset(market, order.OrderSide)
+	amount := holdAmount(asset, quantity, totalQuote)
+	if err := holdBalance(ctx, order.Username, asset, amount); err != nil {
+		return err
+	}
+	order.HeldAsset, order.Held = asset, amount
+	return nil
+}
+
+// ReleaseHold gives back everything an order that was never created holds
+func ReleaseHold(ctx context.Context, order *models.OrderSchema) error {
+	return releaseHold(ctx, order.Username, order.HeldAsset, order.Held)
+}
+
+// holdBalance moves `amount` base units of `asset` from the available to the held balance of a user in one update,
+// so two orders can never hold the same funds
+func holdBalance(ctx context.Context, publicKey string, asset string, amount decimal.Decimal) error {
+	if amount.Sign() <= 0 {
+		return nil
+	}
+	log.Printf("hold: %v %v %v\n", publicKey, amount, asset)
+	available := bson.M{"$subtract": bson.A{"$balance." + asset, bson.M{"$ifNull": bson.A{"$balance.held." + asset, 0}}}}
+	filter := bson.M{"bitclout.publicKey": publicKey, "$expr": bson.M{"$gte": bson.A{available, amount}}}
+	result, err := UserCollection().UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance.held." + asset: amount}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+func releaseHold(ctx context.Context, publicKey string, asset string, amount decimal.Decimal) error {
+	if amount.Sign() <= 0 || asset == "" {
+		return nil
+	}
+	log.Printf("release: %v %v %v\n", publicKey, amount, asset)
+	_, err := UserCollection().UpdateOne(ctx, bson.M{"bitclout.publicKey": publicKey}, bson.M{"$inc": bson.M{"balance.held." + asset: amount.Neg()}})
+	return err
+}
+
+/*
+changeHold sets the hold of an open order to `held` base units, holding only the increase
+so the order keeps its funds if the increase is not available.
+
+Return:
+	ErrInsufficientFunds if the available balance does not cover the increase
+*/
+func changeHold(ctx context.Context, order *models.OrderSchema, asset string, held decimal.Decimal) error {
+	if held.GreaterThan(order.Held) {
+		return holdBalance(ctx, order.Username, asset, held.Sub(order.Held))
+	}
+	return releaseHold(ctx, order.Username, asset, order.Held.Sub(held))
+}
+
+// completeUnfilled completes the order matching `filter` with the fields in `set` and releases what it still holds, in one transaction
+func completeUnfilled(ctx context.Context, filter bson.M, set bson.M) error {
+	set["held"] = decimal.Zero
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var orderDoc *models.OrderSchema
+		err := OrderCollection().FindOneAndUpdate(sessCtx, filter, bson.M{"$set": set}).Decode(&orderDoc)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return releaseHold(sessCtx, orderDoc.Username, orderDoc.HeldAsset, orderDoc.Held)
+	})
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"testing"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestHoldAmount(t *testing.T) {
+	usdc := global.Markets["BCLT-USDC"]
+	if asset := heldAsset(usdc, "buy"); asset != assetUSDC {
+		t.Fatalf("USDC buy holds %s", asset)
+	}
+	if asset := heldAsset(usdc, "sell"); asset != assetBitclout {
+		t.Fatalf("Sell holds %s", asset)
+	}
+	quantity, totalQuote := decimal.NewFromInt(2500000000), decimal.NewFromInt(150500000)
+	if amount := holdAmount(assetUSDC, quantity, totalQuote); !amount.Equal(totalQuote) {
+		t.Fatalf("USDC hold is %v, expected 150500000", amount)
+	}
+	if amount := holdAmount(assetBitclout, quantity, totalQuote); !amount.Equal(quantity) {
+		t.Fatalf("BitClout hold is %v, expected 2500000000", amount)
+	}
+}
+
+func TestHeldRelease(t *testing.T) {
+	order := &models.OrderSchema{OrderQuantity: decimal.NewFromInt(3e9), OrderQuantityProcessed: decimal.NewFromInt(1e9), Held: decimal.NewFromInt(1000)}
+	if release := heldRelease(order, decimal.NewFromInt(0.5e9)); !release.Equal(decimal.NewFromInt(250)) {
+		t.Fatalf("Partial fill released %v, expected 250", release)
+	}
+	// a share of the hold is rounded to a whole base unit
+	if release := heldRelease(order, decimal.NewFromInt(1)); !release.Equal(decimal.Zero) {
+		t.Fatalf("Fill of one nano released %v, expected 0", release)
+	}
+	// the last fill releases the rest, whatever rounding left behind
+	order.Held = decimal.NewFromInt(1001)
+	if release := heldRelease(order, decimal.NewFromInt(2e9)); !release.Equal(order.Held) {
+		t.Fatalf("Final fill released %v, expected 1001", release)
+	}
+	order.Held = decimal.Zero
+	if release := heldRelease(order, decimal.NewFromInt(1e9)); !release.IsZero() {
+		t.Fatalf("Order without a hold released %v", release)
+	}
+}
+
+func TestAvailableBalance(t *testing.T) {
+	market := global.Markets["BCLT-USDC"]
+	balance := &models.UserBalance{
+		Bitclout: decimal.NewFromInt(5e9),
+		USDC:     decimal.NewFromInt(100e6),
+		Held:     models.HeldBalance{Bitclout: decimal.NewFromInt(2e9), USDC: decimal.NewFromInt(120e6)},
+	}
+	if available := availableBalance(balance, assetBitclout); !available.Equal(decimal.NewFromInt(3e9)) {
+		t.Fatalf("Available BitClout is %v, expected 3e9", available)
+	}
+	if available := QuoteBalance(balance, market); !available.IsZero() {
+		t.Fatalf("Available USDC is %v, expected 0", available)
+	}
+	if !CoversHolds(balance, market, "sell") || CoversHolds(balance, market, "buy") {
+		t.Fatal("Holds were not compared with the balance")
+	}
+}
+
+func TestFillReleaseAfterETHUSDChange(t *testing.T) {
+	market := global.Markets["BCLT-ETH"]
+	defer func(ethusd float64) { global.Exchange.ETHUSD = ethusd }(global.Exchange.ETHUSD)
+
+	// a buy of 2 BitClout at $50 holds $100 of ether at $2000
+	global.Exchange.ETHUSD = 2000
+	held, err := market.QuoteBaseUnits(decimal.NewFromInt(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := &models.OrderSchema{OrderSide: "buy", OrderQuantity: decimal.NewFromInt(2e9), HeldAsset: assetEther, Held: held}
+
+	// half of it fills after ether fell to $1000, costing twice its share of the hold
+	global.Exchange.ETHUSD = 1000
+	quote, err := market.QuoteBaseUnits(decimal.NewFromInt(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, shortfall := fillRelease(order, decimal.NewFromInt(1e9), quote)
+	if !release.Equal(held.Div(decimal.NewFromInt(2))) || !release.Add(shortfall).Equal(quote) {
+		t.Fatalf("Fill of %v wei released %v and was short %v", quote, release, shortfall)
+	}
+
+	// after ether rose the share of the hold covers the fill
+	global.Exchange.ETHUSD = 4000
+	if quote, err = market.QuoteBaseUnits(decimal.NewFromInt(50)); err != nil {
+		t.Fatal(err)
+	}
+	if release, shortfall := fillRelease(order, decimal.NewFromInt(1e9), quote); !release.Equal(held.Div(decimal.NewFromInt(2))) || !shortfall.IsZero() {
+		t.Fatalf("Fill of %v wei released %v and was short %v", quote, release, shortfall)
+	}
+
+	// sells hold the BitClout they debit, whatever ether is worth
+	sell := &models.OrderSchema{OrderSide: "sell", OrderQuantity: decimal.NewFromInt(2e9), HeldAsset: assetBitclout, Held: decimal.NewFromInt(2e9)}
+	if release, shortfall := fillRelease(sell, decimal.NewFromInt(1e9), quote); !release.Equal(decimal.NewFromInt(1e9)) || !shortfall.IsZero() {
+		t.Fatalf("Sell fill released %v and was short %v", release, shortfall)
+	}
+}
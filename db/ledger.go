@@ -0,0 +1,346 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Ledger accounts. Every user has an account, fees are credited to the fees account and the exchange account
+stands for the outside world: deposits come from it and withdrawals go back to it, so its balance is minus
+everything the other accounts hold.
+
+UserBalance is a cache of the user accounts, updated in the same transaction as the entries posted to them
+and rebuilt from them by RebuildUserBalance.
+*/
+const (
+	feesAccount       = "fees"
+	exchangeAccount   = "exchange"
+	userAccountPrefix = "user:"
+)
+
+// openLedgerMigration marks the accounts of the users that predate the ledger as opened, see OpenLedger
+const openLedgerMigration = "open-ledger"
+
+// userLedgerAssets are the assets UserBalance caches
+var userLedgerAssets = []string{assetBitclout, assetEther, assetUSDC}
+
+var (
+	// ErrUnbalancedTransaction is returned when the entries of a ledger transaction do not add up to zero for an asset
+	ErrUnbalancedTransaction = errors.New("Ledger transaction does not balance.")
+	// ErrUnknownAccount is returned when a ledger entry is posted to the account of a user that does not exist
+	ErrUnknownAccount = errors.New("Ledger account has no user.")
+)
+
+// AccountError is returned by postTransaction when the entries of one user account cannot be applied to their balance
+type AccountError struct {
+	Account string
+	Err     error
+}
+
+func (e *AccountError) Error() string {
+	return e.Account + ": " + e.Err.Error()
+}
+
+func userAccount(publicKey string) string {
+	return userAccountPrefix + publicKey
+}
+
+// EnsureLedgerIndexes creates the indexes behind the ledger queries. Creating an existing index is a no-op.
+func EnsureLedgerIndexes(ctx context.Context) error {
+	_, err := LedgerCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "asset", Value: 1}}},
+		{Keys: bson.D{{Key: "transactionID", Value: 1}}},
+		{Keys: bson.D{{Key: "reference", Value: 1}}},
+	})
+	return err
+}
+
+// balanced reports whether the amounts of `entries` add up to zero for every asset
+func balanced(entries []*models.LedgerEntrySchema) bool {
+	sums := map[string]decimal.Decimal{}
+	for _, entry := range entries {
+		sums[entry.Asset] = sums[entry.Asset].Add(entry.Amount)
+	}
+	for _, sum := range sums {
+		if sum.Sign() != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+postTransaction posts `entries` to the ledger as one transaction and applies the entries of user accounts to their cached balances.
+It must be called inside runTransaction, so the ledger and the cache never disagree.
+
+Arguments:
+	reference - The trade ID or transaction hash recorded on every entry
+	entries - The legs of the transaction, entries with a zero amount are left out
+Return:
+	ErrUnbalancedTransaction if the entries do not add up to zero for every asset,
+	an AccountError with ErrUnknownAccount if an entry is posted to a user that does not exist,
+	or with ErrInsufficientFunds if it debits more than the user's balance, held funds included
+*/
+func postTransaction(ctx context.Context, reference string, entries []*models.LedgerEntrySchema) error {
+	posted, err := insertEntries(ctx, reference, entries)
+	if err != nil {
+		return err
+	}
+	incs := map[string]bson.M{}
+	for _, entry := range posted {
+		if !strings.HasPrefix(entry.Account, userAccountPrefix) {
+			continue
+		}
+		if incs[entry.Account] == nil {
+			incs[entry.Account] = bson.M{}
+		}
+		field := "balance." + entry.Asset
+		amount, _ := incs[entry.Account][field].(decimal.Decimal)
+		incs[entry.Account][field] = amount.Add(entry.Amount)
+	}
+	for account, inc := range incs {
+		publicKey := strings.TrimPrefix(account, userAccountPrefix)
+		result, err := UserCollection().UpdateOne(ctx, coveredFilter(publicKey, inc), bson.M{"$inc": inc})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			count, err := UserCollection().CountDocuments(ctx, bson.M{"bitclout.publicKey": publicKey})
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				log.Printf("ledger: no user for account %v\n", account)
+				return &AccountError{Account: account, Err: ErrUnknownAccount}
+			}
+			log.Printf("ledger: %v does not cover %v\n", account, inc)
+			return &AccountError{Account: account, Err: ErrInsufficientFunds}
+		}
+	}
+	return nil
+}
+
+// coveredFilter matches the user `publicKey` only while their balance covers every debit in `inc`,
+// so a balance never goes negative whatever the order that debits it held
+func coveredFilter(publicKey string, inc bson.M) bson.M {
+	filter := bson.M{"bitclout.publicKey": publicKey}
+	for field, amount := range inc {
+		if amount := amount.(decimal.Decimal); amount.Sign() < 0 {
+			filter[field] = bson.M{"$gte": amount.Neg()}
+		}
+	}
+	return filter
+}
+
+// insertEntries records `entries` as one ledger transaction without touching the cached balances, see postTransaction
+func insertEntries(ctx context.Context, reference string, entries []*models.LedgerEntrySchema) ([]*models.LedgerEntrySchema, error) {
+	if !balanced(entries) {
+		log.Printf("ledger: unbalanced transaction %v\n", reference)
+		return nil, ErrUnbalancedTransaction
+	}
+	transactionID, now := primitive.NewObjectID().Hex(), time.Now().UTC()
+	var posted []*models.LedgerEntrySchema
+	var docs []interface{}
+	for _, entry := range entries {
+		if entry.Amount.IsZero() {
+			continue
+		}
+		entry.TransactionID, entry.Reference, entry.Timestamp = transactionID, reference, now
+		posted = append(posted, entry)
+		docs = append(docs, entry)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	if _, err := LedgerCollection().InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+	return posted, nil
+}
+
+/*
+fillEntries returns the ledger entries of one side of a fill: the BitClout and settlement asset the user's account
+exchanges with the other side, and the fee it pays to the fees account. The entries of both sides of a fill balance.
+
+Arguments:
+	publicKey - The user of the order
+	side - The side of the order ("buy" or "sell")
+	quantity - The BitClout quantity of the fill in nanos
+	quote - What the fill costs in base units of the settlement asset
+	fee - The fee the order pays, in nanos for a buy and in base units of the settlement asset for a sell
+*/
+func fillEntries(publicKey string, market *global.Market, side string, quantity, quote, fee decimal.Decimal) []*models.LedgerEntrySchema {
+	account, settlement := userAccount(publicKey), quoteAsset(market)
+	if side == "buy" {
+		return []*models.LedgerEntrySchema{
+			{Kind: models.LedgerTrade, Account: account, Asset: assetBitclout, Amount: quantity},
+			{Kind: models.LedgerTrade, Account: account, Asset: settlement, Amount: quote.Neg()},
+			{Kind: models.LedgerFee, Account: account, Asset: assetBitclout, Amount: fee.Neg()},
+			{Kind: models.LedgerFee, Account: feesAccount, Asset: assetBitclout, Amount: fee},
+		}
+	}
+	return []*models.LedgerEntrySchema{
+		{Kind: models.LedgerTrade, Account: account, Asset: assetBitclout, Amount: quantity.Neg()},
+		{Kind: models.LedgerTrade, Account: account, Asset: settlement, Amount: quote},
+		{Kind: models.LedgerFee, Account: account, Asset: settlement, Amount: fee.Neg()},
+		{Kind: models.LedgerFee, Account: feesAccount, Asset: settlement, Amount: fee},
+	}
+}
+
+// ledgerBalances adds up the ledger entries matching `filter` per account and asset
+func ledgerBalances(ctx context.Context, filter bson.M) (map[string]map[string]decimal.Decimal, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"account": "$account", "asset": "$asset"}, "total": bson.M{"$sum": "$amount"}}}},
+	}
+	cursor, err := LedgerCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		ID struct {
+			Account string `bson:"account"`
+			Asset   string `bson:"asset"`
+		} `bson:"_id"`
+		Total decimal.Decimal `bson:"total"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	balances := map[string]map[string]decimal.Decimal{}
+	for _, result := range results {
+		if balances[result.ID.Account] == nil {
+			balances[result.ID.Account] = map[string]decimal.Decimal{}
+		}
+		balances[result.ID.Account][result.ID.Asset] = result.Total
+	}
+	return balances, nil
+}
+
+// BalanceMismatch is a cached user balance that differs from the sum of the user's ledger entries
+type BalanceMismatch struct {
+	PublicKey string          `json:"publicKey"`
+	Asset     string          `json:"asset"`
+	Cached    decimal.Decimal `json:"cached"`
+	Ledger    decimal.Decimal `json:"ledger"`
+}
+
+// VerifyBalances compares the cached balance of every user with their ledger account
+func VerifyBalances(ctx context.Context) ([]BalanceMismatch, error) {
+	balances, err := ledgerBalances(ctx, bson.M{"account": bson.M{"$regex": "^" + userAccountPrefix}})
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetProjection(bson.M{"bitclout.publicKey": 1, "balance": 1})
+	cursor, err := UserCollection().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []*models.UserSchema
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	mismatches := []BalanceMismatch{}
+	for _, user := range users {
+		if user.Balance == nil {
+			user.Balance = &models.UserBalance{}
+		}
+		ledger := balances[userAccount(user.Bitclout.PublicKey)]
+		for _, asset := range userLedgerAssets {
+			if cached, _ := balanceOf(user.Balance, asset); !cached.Equal(ledger[asset]) {
+				mismatches = append(mismatches, BalanceMismatch{PublicKey: user.Bitclout.PublicKey, Asset: asset, Cached: cached, Ledger: ledger[asset]})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// RebuildUserBalance replaces the cached balance of a user with the sum of their ledger entries.
+// What their open orders hold is left alone.
+func RebuildUserBalance(ctx context.Context, publicKey string) (*models.UserBalance, error) {
+	log.Printf("rebuild balance: %v\n", publicKey)
+	var balance *models.UserBalance
+	err := runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		account := userAccount(publicKey)
+		balances, err := ledgerBalances(sessCtx, bson.M{"account": account})
+		if err != nil {
+			return err
+		}
+		set := bson.M{}
+		for _, asset := range userLedgerAssets {
+			set["balance."+asset] = balances[account][asset]
+		}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		var userDoc *models.UserSchema
+		if err := UserCollection().FindOneAndUpdate(sessCtx, bson.M{"bitclout.publicKey": publicKey}, bson.M{"$set": set}, opts).Decode(&userDoc); err != nil {
+			return err
+		}
+		balance = userDoc.Balance
+		return nil
+	})
+	return balance, err
+}
+
+/*
+OpenLedger posts the cached balance of every user without ledger entries as an opening transaction from the exchange account,
+so balances that predate the ledger are accounted for. It is a one-shot migration: once every account is opened it is marked
+done and later starts skip it. An interrupted run is picked up on the next start, an account with entries is never opened twice.
+*/
+func OpenLedger(ctx context.Context) error {
+	if done, err := migrationDone(ctx, openLedgerMigration); err != nil || done {
+		return err
+	}
+	opts := options.Find().SetProjection(bson.M{"bitclout.publicKey": 1})
+	cursor, err := UserCollection().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var users []*models.UserSchema
+	if err = cursor.All(ctx, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Bitclout.PublicKey == "" {
+			continue
+		}
+		publicKey := user.Bitclout.PublicKey
+		account := userAccount(publicKey)
+		err := runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+			if count, err := LedgerCollection().CountDocuments(sessCtx, bson.M{"account": account}); err != nil || count > 0 {
+				return err
+			}
+			userDoc, err := GetUserDoc(sessCtx, publicKey)
+			if err != nil || userDoc.Balance == nil {
+				return err
+			}
+			var entries []*models.LedgerEntrySchema
+			for _, asset := range userLedgerAssets {
+				cached, _ := balanceOf(userDoc.Balance, asset)
+				entries = append(entries,
+					&models.LedgerEntrySchema{Kind: models.LedgerOpening, Account: exchangeAccount, Asset: asset, Amount: cached.Neg()},
+					&models.LedgerEntrySchema{Kind: models.LedgerOpening, Account: account, Asset: asset, Amount: cached},
+				)
+			}
+			_, err = insertEntries(sessCtx, publicKey, entries)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("ledger: accounts that predate the ledger opened, %d users checked\n", len(users))
+	return markMigrationDone(ctx, openLedgerMigration)
+}
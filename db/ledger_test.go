@@ -0,0 +1,71 @@
+package db
+
+import (
+	"testing"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBalanced(t *testing.T) {
+	entries := []*models.LedgerEntrySchema{
+		{Account: exchangeAccount, Asset: assetEther, Amount: decimal.RequireFromString("-1500000000000000000000")},
+		{Account: userAccount("a"), Asset: assetEther, Amount: decimal.RequireFromString("1000000000000000000001")},
+		{Account: userAccount("b"), Asset: assetEther, Amount: decimal.RequireFromString("499999999999999999999")},
+	}
+	if !balanced(entries) {
+		t.Fatal("Balanced wei entries were rejected")
+	}
+	entries = append(entries, &models.LedgerEntrySchema{Account: feesAccount, Asset: assetBitclout, Amount: decimal.NewFromInt(1)})
+	if balanced(entries) {
+		t.Fatal("Unbalanced entries were accepted")
+	}
+}
+
+func TestFillEntries(t *testing.T) {
+	market := global.Markets["BCLT-USDC"]
+	// 10 BCLT for 150 USDC, in nanos and USDC base units
+	quantity, quote := decimal.NewFromInt(10e9), decimal.NewFromInt(150e6)
+	buyerFee, sellerFee := decimal.NewFromInt(0.1e9), decimal.NewFromInt(1.5e6)
+	buyer := fillEntries("buyer", market, "buy", quantity, quote, buyerFee)
+	seller := fillEntries("seller", market, "sell", quantity, quote, sellerFee)
+	if !balanced(append(buyer, seller...)) {
+		t.Fatal("Both sides of a fill do not balance")
+	}
+
+	net := func(entries []*models.LedgerEntrySchema, account, asset string) (sum decimal.Decimal) {
+		for _, entry := range entries {
+			if entry.Account == account && entry.Asset == asset {
+				sum = sum.Add(entry.Amount)
+			}
+		}
+		return sum
+	}
+	if bitclout := net(buyer, userAccount("buyer"), assetBitclout); !bitclout.Equal(quantity.Sub(buyerFee)) {
+		t.Fatalf("Buyer received %v nanos", bitclout)
+	}
+	if usdc := net(buyer, userAccount("buyer"), assetUSDC); !usdc.Equal(quote.Neg()) {
+		t.Fatalf("Buyer paid %v USDC base units, expected 150e6", usdc.Neg())
+	}
+	if usdc := net(seller, userAccount("seller"), assetUSDC); !usdc.Equal(quote.Sub(sellerFee)) {
+		t.Fatalf("Seller received %v USDC base units", usdc)
+	}
+	if fees := net(append(buyer, seller...), feesAccount, assetUSDC); !fees.Equal(sellerFee) {
+		t.Fatalf("Fees account received %v USDC base units", fees)
+	}
+}
+
+func TestCoveredFilter(t *testing.T) {
+	inc := bson.M{"balance." + assetEther: decimal.New(-5, 17), "balance." + assetBitclout: decimal.New(2, 9)}
+	filter := coveredFilter("BC1YLbuyer", inc)
+	if filter["bitclout.publicKey"] != "BC1YLbuyer" || len(filter) != 2 {
+		t.Fatalf("Unexpected filter: %v", filter)
+	}
+	debit, ok := filter["balance."+assetEther].(bson.M)
+	if !ok || !debit["$gte"].(decimal.Decimal).Equal(decimal.New(5, 17)) {
+		t.Fatalf("Debit is not required to be covered: %v", filter)
+	}
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"exchange-engine/global"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// migrationDone reports whether the one-shot migration `name` has already run, see markMigrationDone
+func migrationDone(ctx context.Context, name string) (bool, error) {
+	count, err := MigrationCollection().CountDocuments(ctx, bson.M{"_id": name})
+	return count > 0, err
+}
+
+// markMigrationDone records that the one-shot migration `name` ran to the end, so it is skipped on the next start
+func markMigrationDone(ctx context.Context, name string) error {
+	_, err := MigrationCollection().InsertOne(ctx, bson.M{"_id": name, "completed": time.Now().UTC()})
+	return err
+}
+
+// numericTypes are the BSON types amounts were stored as before they were stored as Decimal128 base units
+var numericTypes = bson.A{"double", "int", "long"}
+
+// fieldMigration rewrites `field` of every document of `collection` still holding a number with the pipeline expression `to`.
+// The number is looked for in `match` instead of `field` when set, for fields that are arrays.
+type fieldMigration struct {
+	collection *mongo.Collection
+	field      string
+	to         interface{}
+	match      string
+}
+
+// baseUnitsExpr converts the whole units in `expr` to base units of an asset with `decimals` decimals, itself an expression
+func baseUnitsExpr(expr, decimals interface{}) bson.M {
+	return bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{bson.M{"$toDecimal": expr}, bson.M{"$pow": bson.A{10, decimals}}}}, 0}}
+}
+
+// assetDecimalsExpr resolves the decimals of the asset named by `expr`
+func assetDecimalsExpr(expr interface{}) bson.M {
+	var branches bson.A
+	for asset, decimals := range global.AssetDecimals {
+		branches = append(branches, bson.M{"case": bson.M{"$eq": bson.A{expr, asset}}, "then": decimals})
+	}
+	return bson.M{"$switch": bson.M{"branches": branches, "default": 0}}
+}
+
+// quoteDecimalsExpr resolves the decimals of the settlement asset of the market of an order or trade.
+// An order without a market predates multiple markets and belongs to the DefaultMarket.
+func quoteDecimalsExpr() bson.M {
+	var branches bson.A
+	for _, market := range global.AllMarkets() {
+		branches = append(branches, bson.M{"case": bson.M{"$eq": bson.A{"$market", market.Symbol}}, "then": global.AssetDecimals[market.Quote]})
+	}
+	return bson.M{"$switch": bson.M{"branches": branches, "default": global.AssetDecimals[global.Markets[global.DefaultMarket].Quote]}}
+}
+
+/*
+MigrateBaseUnits converts the amounts of documents written before they were stored as integer base units in Decimal128.
+
+Balances, holds and ledger amounts were already base units and are only rounded, order and trade quantities, settlement
+amounts and fees were whole units and are scaled to base units, and prices stay USD. Only fields still holding a number
+are rewritten, so it runs on every start and does nothing once the documents are converted.
+*/
+func MigrateBaseUnits(ctx context.Context) error {
+	bitclout := global.AssetDecimals["BCLT"]
+	round := func(field string) bson.M {
+		return bson.M{"$round": bson.A{bson.M{"$toDecimal": "$" + field}, 0}}
+	}
+	toDecimal := func(field string) bson.M {
+		return bson.M{"$toDecimal": "$" + field}
+	}
+	nanos := func(field string) bson.M {
+		return baseUnitsExpr("$"+field, bitclout)
+	}
+
+	var migrations []fieldMigration
+	for _, asset := range userLedgerAssets {
+		migrations = append(migrations,
+			fieldMigration{collection: UserCollection(), field: "balance." + asset, to: round("balance." + asset)},
+			fieldMigration{collection: UserCollection(), field: "balance.held." + asset, to: round("balance.held." + asset)},
+		)
+	}
+	for _, field := range []string{"orderQuantity", "orderQuantityProcessed", "displayQuantity"} {
+		migrations = append(migrations, fieldMigration{collection: OrderCollection(), field: field, to: nanos(field)})
+	}
+	for _, field := range []string{"quoteQuantity", "etherQuantity"} {
+		migrations = append(migrations, fieldMigration{collection: OrderCollection(), field: field, to: baseUnitsExpr("$"+field, quoteDecimalsExpr())})
+	}
+	// buys paid their fees in BitClout, sells in the settlement asset
+	feeDecimals := bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$orderSide", "buy"}}, bitclout, quoteDecimalsExpr()}}
+	migrations = append(migrations,
+		fieldMigration{collection: OrderCollection(), field: "fees", to: baseUnitsExpr("$fees", feeDecimals)},
+		fieldMigration{collection: OrderCollection(), field: "held", to: round("held")},
+	)
+	for _, field := range []string{"orderPrice", "requestedPrice", "stopPrice", "triggerPrice", "execPrice"} {
+		migrations = append(migrations, fieldMigration{collection: OrderCollection(), field: field, to: toDecimal(field)})
+	}
+	migrations = append(migrations,
+		fieldMigration{collection: TradeCollection(), field: "quantity", to: nanos("quantity")},
+		fieldMigration{collection: TradeCollection(), field: "price", to: toDecimal("price")},
+		fieldMigration{collection: TradeCollection(), field: "makerFee", to: baseUnitsExpr("$makerFee", assetDecimalsExpr("$makerFeeAsset"))},
+		fieldMigration{collection: TradeCollection(), field: "takerFee", to: baseUnitsExpr("$takerFee", assetDecimalsExpr("$takerFeeAsset"))},
+		fieldMigration{collection: LedgerCollection(), field: "amount", to: round("amount")},
+	)
+
+	migrations = append(migrations, orderHistoryMigrations()...)
+
+	for _, migration := range migrations {
+		match := migration.match
+		if match == "" {
+			match = migration.field
+		}
+		filter := bson.M{match: bson.M{"$type": numericTypes}}
+		update := mongo.Pipeline{{{Key: "$set", Value: bson.M{migration.field: migration.to}}}}
+		result, err := migration.collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("migrate: %v.%v to base units in %d documents\n", migration.collection.Name(), migration.field, result.ModifiedCount)
+		}
+	}
+	return nil
+}
+
+// orderHistoryMigrations convert the quantities and prices recorded in the amendments and self-trades of orders.
+// An element is converted while its quantity is still a number, the whole array is rewritten at once.
+func orderHistoryMigrations() []fieldMigration {
+	bitclout := global.AssetDecimals["BCLT"]
+	unconverted := func(expr string) bson.M {
+		return bson.M{"$in": bson.A{bson.M{"$type": expr}, numericTypes}}
+	}
+	amendments := bson.M{"$map": bson.M{"input": "$amendments", "as": "a", "in": bson.M{"$cond": bson.A{
+		unconverted("$$a.quantity"),
+		bson.M{"$mergeObjects": bson.A{"$$a", bson.M{
+			"previousPrice":    bson.M{"$toDecimal": "$$a.previousPrice"},
+			"previousQuantity": baseUnitsExpr("$$a.previousQuantity", bitclout),
+			"price":            bson.M{"$toDecimal": "$$a.price"},
+			"quantity":         baseUnitsExpr("$$a.quantity", bitclout),
+		}}},
+		"$$a",
+	}}}}
+	selfTrades := bson.M{"$map": bson.M{"input": "$selfTrades", "as": "s", "in": bson.M{"$cond": bson.A{
+		unconverted("$$s.decrement"),
+		bson.M{"$mergeObjects": bson.A{"$$s", bson.M{"decrement": baseUnitsExpr("$$s.decrement", bitclout)}}},
+		"$$s",
+	}}}}
+	return []fieldMigration{
+		{collection: OrderCollection(), field: "amendments", to: amendments, match: "amendments.quantity"},
+		{collection: OrderCollection(), field: "selfTrades", to: selfTrades, match: "selfTrades.decrement"},
+	}
+}
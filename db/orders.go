@@ -2,17 +2,14 @@ package db
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"math/big"
-	"strconv"
 	"time"
 
 	"exchange-engine/global"
 	"exchange-engine/models"
 
+	"github.com/shopspring/decimal"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,71 +17,37 @@ import (
 )
 
 func GetOrderFees(ctx context.Context) (*models.CurrencyAmountsBig, error) {
-	var totalFees *models.CurrencyAmounts
-	var totalFeesBig models.CurrencyAmountsBig
-
-	bitcloutMatchStage := bson.D{
-		{"$match", bson.D{
-			{"orderSide", "buy"},
-		}},
-	}
-	bitcloutGroupStage := bson.D{
-		{"$group", bson.D{
-			{"_id", 0},
-			{"totalBitclout", bson.D{
-				{"$sum", "$fees"},
-			}},
-		}},
-	}
 	opts := options.Aggregate().SetMaxTime(5 * time.Second)
-	cursor, err := OrderCollection().Aggregate(ctx, mongo.Pipeline{bitcloutMatchStage, bitcloutGroupStage}, opts)
+	// buys pay their fees in BitClout, sells on the ETH market in ether
+	totalBitclout, err := sumFees(ctx, bson.M{"orderSide": "buy"}, opts)
 	if err != nil {
 		return nil, err
 	}
-	var resultsBclt []bson.M
-	if err = cursor.All(ctx, &resultsBclt); err != nil {
-		return nil, err
-	}
-	jsonBytes, _ := json.Marshal(resultsBclt[0])
-	if err = json.Unmarshal(jsonBytes, &totalFees); err != nil {
+	totalEther, err := sumFees(ctx, bson.M{"orderSide": "sell", "market": bson.M{"$in": bson.A{nil, "BCLT-ETH"}}}, opts)
+	if err != nil {
+		log.Println("total fees eth err", err.Error())
 		return nil, err
 	}
+	return &models.CurrencyAmountsBig{Bitclout: totalBitclout.BigInt(), Ether: totalEther.BigInt()}, nil
+}
 
-	etherMatchStage := bson.D{
-		{"$match", bson.D{
-			{"orderSide", "sell"},
-		}},
-	}
-	etherGroupStage := bson.D{
-		{"$group", bson.D{
-			{"_id", 0},
-			{"totalEther", bson.D{
-				{"$sum", "$fees"},
-			}},
-		}},
+// sumFees adds up the fees of the orders matching `filter`, in base units
+func sumFees(ctx context.Context, filter bson.M, opts *options.AggregateOptions) (decimal.Decimal, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": 0, "total": bson.M{"$sum": "$fees"}}}},
 	}
-	cursor, err = OrderCollection().Aggregate(ctx, mongo.Pipeline{etherMatchStage, etherGroupStage}, opts)
+	cursor, err := OrderCollection().Aggregate(ctx, pipeline, opts)
 	if err != nil {
-		return nil, err
+		return decimal.Zero, err
 	}
-	var resultsEth []bson.M
-	if err = cursor.All(ctx, &resultsEth); err != nil {
-		return nil, err
+	var results []struct {
+		Total decimal.Decimal `bson:"total"`
 	}
-	jsonBytes, _ = json.Marshal(resultsEth[0])
-	if err = json.Unmarshal(jsonBytes, &totalFees); err != nil {
-		log.Println("total fees eth err", err.Error())
-		return nil, err
-	}
-	totalFeesBig.Bitclout = new(big.Int)
-	totalFeesBig.Ether = new(big.Int)
-	var okBitclout, okEther bool
-	totalFeesBig.Bitclout, okBitclout = totalFeesBig.Bitclout.SetString(strconv.FormatFloat(totalFees.Bitclout, 'f', 0, 64), 10)
-	totalFeesBig.Ether, okEther = totalFeesBig.Ether.SetString(strconv.FormatFloat(totalFees.Ether, 'f', 0, 64), 10)
-	if !okBitclout || !okEther {
-		return nil, errors.New(fmt.Sprintf("SetString Error bitclout: %v, ether: %v", okBitclout, okEther))
+	if err = cursor.All(ctx, &results); err != nil || len(results) == 0 {
+		return decimal.Zero, err
 	}
-	return &totalFeesBig, nil
+	return results[0].Total, nil
 }
 
 func GetActiveOrders(ctx context.Context, publicKey string) (numOrders int, err error) {
@@ -107,7 +70,123 @@ func GetActiveOrders(ctx context.Context, publicKey string) (numOrders int, err
 	return
 }
 
-func ValidateOrder(ctx context.Context, publicKey string, orderSide string, orderQuantity float64, totalEth float64) bool {
+// GetOpenOrders returns every order of `market` that is not complete, including orders placed before orders recorded their market
+func GetOpenOrders(ctx context.Context, market *global.Market) ([]*models.OrderSchema, error) {
+	filter := bson.M{"complete": false, "market": market.Symbol}
+	if market.Symbol == global.DefaultMarket {
+		filter["market"] = bson.M{"$in": bson.A{market.Symbol, nil, ""}}
+	}
+	return findOrders(ctx, filter)
+}
+
+// GetOrdersByID returns the orders with the given IDs, keyed by order ID. IDs without an order are left out.
+func GetOrdersByID(ctx context.Context, orderIDs []string) (map[string]*models.OrderSchema, error) {
+	orders := map[string]*models.OrderSchema{}
+	if len(orderIDs) == 0 {
+		return orders, nil
+	}
+	found, err := findOrders(ctx, bson.M{"orderID": bson.M{"$in": orderIDs}})
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range found {
+		orders[order.OrderID] = order
+	}
+	return orders, nil
+}
+
+func findOrders(ctx context.Context, filter bson.M) ([]*models.OrderSchema, error) {
+	var orders []*models.OrderSchema
+	cursor, err := OrderCollection().Find(ctx, filter)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err = cursor.All(ctx, &orders); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return orders, nil
+}
+
+// EnsureOrderIndexes creates the unique orderID index that guards against colliding order IDs,
+// after giving the orders that already share one a unique ID
+func EnsureOrderIndexes(ctx context.Context) error {
+	if err := rekeyDuplicateOrderIDs(ctx); err != nil {
+		return err
+	}
+	_, err := OrderCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "orderID", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+/*
+rekeyDuplicateOrderIDs gives every order sharing its orderID with another one a unique ID, only IDs generated
+before they were opaque can collide. The open order of a group keeps the ID the book knows it by, the others
+become `<orderID>-<_id>` and keep the old one in legacyOrderID. A group with several open orders is reported,
+the book cannot tell them apart and reconciliation flags the ones it does not hold.
+*/
+func rekeyDuplicateOrderIDs(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$orderID",
+			"count":  bson.M{"$sum": 1},
+			"orders": bson.M{"$push": bson.M{"id": "$_id", "complete": "$complete"}},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}
+	cursor, err := OrderCollection().Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		OrderID string `bson:"_id"`
+		Orders  []struct {
+			ID       primitive.ObjectID `bson:"id"`
+			Complete bool               `bson:"complete"`
+		} `bson:"orders"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		keep, open := 0, 0
+		for i, order := range group.Orders {
+			if !order.Complete {
+				if open == 0 {
+					keep = i
+				}
+				open++
+			}
+		}
+		if open > 1 {
+			log.Printf("orders: %d open orders share the ID %v\n", open, group.OrderID)
+		}
+		for i, order := range group.Orders {
+			if i == keep {
+				continue
+			}
+			rekeyed := group.OrderID + "-" + order.ID.Hex()
+			update := bson.M{"$set": bson.M{"orderID": rekeyed, "legacyOrderID": group.OrderID}}
+			if _, err := OrderCollection().UpdateOne(ctx, bson.M{"_id": order.ID}, update); err != nil {
+				return err
+			}
+			log.Printf("orders: re-keyed duplicate %v to %v\n", group.OrderID, rekeyed)
+		}
+	}
+	return nil
+}
+
+/*
+Checks that the user can afford an order from their available balance. The funds are only reserved by HoldOrderBalance.
+
+Arguments:
+	orderQuantity - The BitClout quantity of the order in nanos
+	totalQuote - The cost of the order in base units of the settlement asset of `market`
+*/
+func ValidateOrder(ctx context.Context, publicKey string, market *global.Market, orderSide string, orderQuantity, totalQuote decimal.Decimal) bool {
 	log.Printf("fetching user balance from: %v\n", publicKey)
 	// var userDoc *models.UserSchema
 	userDoc, err := GetUserDoc(ctx, publicKey)
@@ -115,13 +194,15 @@ func ValidateOrder(ctx context.Context, publicKey string, orderSide string, orde
 		log.Println(err.Error())
 		return false
 	}
-	if userDoc.Balance.InTransaction || orderQuantity > 500 || orderQuantity < 0.01 {
+	minQuantity := global.ToBaseUnits(decimal.NewFromFloat(market.MinQuantity), market.Base)
+	maxQuantity := global.ToBaseUnits(decimal.NewFromFloat(market.MaxQuantity), market.Base)
+	if userDoc.Balance.InTransaction || orderQuantity.LessThan(minQuantity) || (maxQuantity.Sign() > 0 && orderQuantity.GreaterThan(maxQuantity)) {
 		return false
 	} else {
 		if orderSide == "buy" {
-			return totalEth <= global.FromWei(userDoc.Balance.Ether)
+			return totalQuote.LessThanOrEqual(QuoteBalance(userDoc.Balance, market))
 		} else {
-			return orderQuantity <= global.FromNanos(userDoc.Balance.Bitclout)
+			return orderQuantity.LessThanOrEqual(availableBalance(userDoc.Balance, assetBitclout))
 		}
 	}
 }
@@ -135,7 +216,7 @@ func CreateOrder(ctx context.Context, order *models.OrderSchema) error {
 	if inTransaction {
 		return errors.New("user in transaction")
 	}
-	if order.OrderType == "limit" {
+	if order.OrderType != "market" {
 		numOrders, err := GetActiveOrders(ctx, order.Username)
 		if err != nil {
 			log.Println(err.Error())
@@ -156,235 +237,147 @@ func CreateOrder(ctx context.Context, order *models.OrderSchema) error {
 	return nil
 }
 
+// CancelCompleteOrder completes an open order with `errorString` and releases whatever it still holds.
+// An order that is already complete, for example by the fill that filled it, is left as it is.
 func CancelCompleteOrder(ctx context.Context, orderID string, errorString string) error {
 	log.Printf("cancel complete: %v\n", orderID)
 
-	update := bson.M{"$set": bson.M{"error": errorString, "complete": true, "completeTime": time.Now().UTC()}}
-	_, err := OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
-	if err != nil {
-		return err
-	}
-	return nil
+	return completeUnfilled(ctx, bson.M{"orderID": orderID, "complete": false}, bson.M{"error": errorString, "complete": true, "completeTime": time.Now().UTC()})
 }
 
-/*
-Calculates the change in a user's bitclout and ether balances
+// TriggerStopOrder records that a pending stop order was sent to the book at `triggerPrice`
+func TriggerStopOrder(ctx context.Context, orderID string, triggerPrice decimal.Decimal) error {
+	log.Printf("trigger stop: %v at %v\n", orderID, triggerPrice)
 
-Arguments:
-	`ctx`: The context from which this function is called
-	`orderSide`: Whether this is a BUY order or a sell order
-	`quantity`: The quantity of BitClout/Ethereum bought/sold
-	`totalPrice`: The total price previously sold
-Returns:
-	`bitcloutChange`: The change in the bitclout balance (BCLT)
-	`etherChange`: The change in the ether balance ($)
-	`fees`: The fees taken from the transaction ($)
-*/
-func calcChangeAndFees(orderSide string, quantity, totalPrice float64) (bitcloutChange, etherChange, fees float64) {
-	ETHUSD := global.Exchange.ETHUSD
-	if ETHUSD == 0 {
-		log.Panic("ETHUSD is 0. THIS IS NOT OK IF LIVE")
-	}
-
-	//update ether USD price var
-	if orderSide == "buy" {
-		fees = (quantity * global.Exchange.FEE)
-		bitcloutChange = quantity - fees
-		etherChange = -(totalPrice / ETHUSD)
-	} else {
-		fees = (totalPrice * global.Exchange.FEE) / ETHUSD
-		bitcloutChange = -quantity
-		etherChange = (totalPrice / ETHUSD) - fees
-	}
-
-	return bitcloutChange, etherChange, fees
-}
-
-func CompleteLimitOrder(ctx context.Context, orderID string, totalPrice float64) error {
-	ETHUSD := global.Exchange.ETHUSD
-
-	log.Printf("fulfill: %v\n", orderID)
-	var orderDoc *models.OrderSchema
-
-	//Find order in database
-	err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID}).Decode(&orderDoc)
-	if err != nil {
-		return err
-	}
-
-	bitcloutChange, etherChange, fees := calcChangeAndFees(
-		orderDoc.OrderSide,
-		orderDoc.OrderQuantity-orderDoc.OrderQuantityProcessed,
-		totalPrice)
-
-	// attempt to modify bitclout balance and eth balance
-	err = UpdateUserBalance(ctx, orderDoc.Username, bitcloutChange, etherChange)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-	execPrice := totalPrice / orderDoc.OrderQuantity
-	// Mark the order as complete after bitclout and eth balances are modified
-	// We can set `orderQuantityProcessed` since this order is completed.
-	update := bson.M{"$set": bson.M{
-		"orderQuantityProcessed": orderDoc.OrderQuantity,
-		"complete":               true,
-		"completeTime":           time.Now().UTC(),
-		"execPrice":              execPrice,
-	}, "$inc": bson.M{"fees": fees, "etherQuantity": (totalPrice / ETHUSD)}}
-	_, err = OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
+	update := bson.M{"$set": bson.M{"stopState": models.StopTriggered, "triggerPrice": triggerPrice, "triggerTime": time.Now().UTC()}}
+	_, err := OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
 	if err != nil {
 		return err
 	}
-
 	return nil
 }
 
-func CompleteLimitOrderDirect(ctx context.Context, orderID string) error {
-	ETHUSD := global.Exchange.ETHUSD
-
-	log.Printf("fulfill: %v\n", orderID)
-	var orderDoc *models.OrderSchema
+// CancelStopOrder completes a stop order that was cancelled before it triggered and releases its hold
+func CancelStopOrder(ctx context.Context, orderID string, errorString string) error {
+	log.Printf("cancel stop: %v\n", orderID)
 
-	//Finding order in database
-	err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID}).Decode(&orderDoc)
-	if err != nil {
-		return err
-	}
-
-	bitcloutChange, etherChange, fees := calcChangeAndFees(
-		orderDoc.OrderSide,
-		orderDoc.OrderQuantity-orderDoc.OrderQuantityProcessed,
-		((orderDoc.OrderQuantity - orderDoc.OrderQuantityProcessed) * orderDoc.OrderPrice))
-
-	// attempt to modify bitclout balance and eth balance
-	err = UpdateUserBalance(ctx, orderDoc.Username, bitcloutChange, etherChange)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-
-	// Mark the order as complete after bitclout and eth balances are modified
-	update := bson.M{"$set": bson.M{
-		"orderQuantityProcessed": orderDoc.OrderQuantity,
-		"complete":               true,
-		"completeTime":           time.Now().UTC(),
-		"execPrice":              orderDoc.OrderPrice,
-	}, "$inc": bson.M{"fees": fees, "etherChange": (((orderDoc.OrderQuantity - orderDoc.OrderQuantityProcessed) * orderDoc.OrderPrice) / ETHUSD)}}
-	_, err = OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return completeUnfilled(ctx, bson.M{"orderID": orderID}, bson.M{"error": errorString, "complete": true, "completeTime": time.Now().UTC(), "stopState": models.StopCancelled})
 }
 
 /*
-Partially Complete a Limit Order
-*/
-func PartialLimitOrder(ctx context.Context, orderID string, quantityDelta float64, totalPrice float64) error {
-	ETHUSD := global.Exchange.ETHUSD
-	log.Printf("partial fulfill: %v - %v\n", orderID, quantityDelta)
-	var orderDoc *models.OrderSchema
+AmendOrder changes the price and remaining quantity of a resting limit order and records the amendment in its history.
+The hold of the order follows the new remaining cost in the same transaction, an increase fails with ErrInsufficientFunds
+if it is not available.
 
-	err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID}).Decode(&orderDoc)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	bitcloutChange, etherChange, fees := calcChangeAndFees(
-		orderDoc.OrderSide,
-		quantityDelta,
-		totalPrice)
+Arguments:
+	quantity     - The new remaining quantity in nanos. The quantity already processed is kept.
+	keptPriority - Whether the order kept its place in the queue
+*/
+func AmendOrder(ctx context.Context, orderID string, quantity, price decimal.Decimal, keptPriority bool) error {
+	log.Printf("amend: %v - %v @ %v\n", orderID, quantity, price)
 
-	// attempt to modify bitclout balance and eth balance
-	err = UpdateUserBalance(ctx, orderDoc.Username, bitcloutChange, etherChange)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-	execPrice := (orderDoc.ExecPrice*orderDoc.OrderQuantityProcessed + totalPrice) / (quantityDelta + orderDoc.OrderQuantityProcessed)
-	// Mark the order as complete after bitclout and eth balances are modified
-	update := bson.M{"$set": bson.M{"execPrice": execPrice},
-		"$inc": bson.M{
-			"fees":                   fees,
-			"orderQuantityProcessed": quantityDelta,
-			"etherQuantity":          (totalPrice / ETHUSD),
-		},
-	}
-	_, err = OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
-	if err != nil {
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var orderDoc *models.OrderSchema
+		if err := OrderCollection().FindOne(sessCtx, bson.M{"orderID": orderID, "complete": false}).Decode(&orderDoc); err != nil {
+			return err
+		}
+		market, err := global.GetMarket(orderDoc.Market)
+		if err != nil {
+			return err
+		}
+		totalQuote, err := market.QuoteBaseUnits(global.FromBaseUnits(quantity, market.Base).Mul(price))
+		if err != nil {
+			return err
+		}
+		asset := heldAsset(market, orderDoc.OrderSide)
+		held := holdAmount(asset, quantity, totalQuote)
+		if err := changeHold(sessCtx, orderDoc, asset, held); err != nil {
+			return err
+		}
+		amendment := models.OrderAmendment{
+			Time:             time.Now().UTC(),
+			PreviousPrice:    orderDoc.OrderPrice,
+			PreviousQuantity: orderDoc.OrderQuantity,
+			Price:            price,
+			Quantity:         orderDoc.OrderQuantityProcessed.Add(quantity),
+			KeptPriority:     keptPriority,
+		}
+		update := bson.M{
+			"$set":  bson.M{"orderPrice": amendment.Price, "orderQuantity": amendment.Quantity, "held": held, "heldAsset": asset},
+			"$push": bson.M{"amendments": amendment},
+		}
+		_, err = OrderCollection().UpdateOne(sessCtx, bson.M{"orderID": orderID}, update)
 		return err
-	}
-	return nil
+	})
 }
 
-func PartialLimitOrderDirect(ctx context.Context, orderID string, quantityDelta float64) error {
-	ETHUSD := global.Exchange.ETHUSD
-	log.Printf("partial fulfill: %v - %v\n", orderID, quantityDelta)
-	var orderDoc *models.OrderSchema
-
-	err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID}).Decode(&orderDoc)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+/*
+RecordSelfTrade appends a self-trade prevention outcome to the order's history
 
-	bitcloutChange, etherChange, fees := calcChangeAndFees(
-		orderDoc.OrderSide,
-		quantityDelta,
-		(quantityDelta * orderDoc.OrderPrice))
+A decrement reduces the order quantity so that settling the rest of the order never includes it,
+and releases the part of the hold that covered it, in the same transaction.
+Cancellation is recorded separately through CancelCompleteOrder.
+*/
+func RecordSelfTrade(ctx context.Context, orderID string, selfTrade models.SelfTrade) error {
+	log.Printf("self-trade: %v - %v\n", orderID, selfTrade.Mode)
+
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		update := bson.M{"$push": bson.M{"selfTrades": selfTrade}}
+		var orderDoc *models.OrderSchema
+		var release decimal.Decimal
+		if selfTrade.Decrement.Sign() > 0 {
+			if err := OrderCollection().FindOne(sessCtx, bson.M{"orderID": orderID}).Decode(&orderDoc); err != nil {
+				return err
+			}
+			release = heldRelease(orderDoc, selfTrade.Decrement)
+			update["$inc"] = bson.M{"orderQuantity": selfTrade.Decrement.Neg(), "held": release.Neg()}
+		}
+		if _, err := OrderCollection().UpdateOne(sessCtx, bson.M{"orderID": orderID}, update); err != nil {
+			return err
+		}
+		if orderDoc != nil {
+			return releaseHold(sessCtx, orderDoc.Username, orderDoc.HeldAsset, release)
+		}
+		return nil
+	})
+}
 
-	// attempt to modify bitclout balance and eth balance
-	err = UpdateUserBalance(ctx, orderDoc.Username, bitcloutChange, etherChange)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
+// RepriceOrder records that a post-only order was moved from `requestedPrice` to `price` to avoid crossing the book
+func RepriceOrder(ctx context.Context, orderID string, requestedPrice, price decimal.Decimal) error {
+	log.Printf("reprice: %v %v -> %v\n", orderID, requestedPrice, price)
 
-	// Mark the order as complete after bitclout and eth balances are modified
-	// INCREMENT the `orderQuantityProcessed` to reflect the partial quantity processed
-	update := bson.M{"$set": bson.M{"execPrice": orderDoc.OrderPrice},
-		"$inc": bson.M{
-			"fees":                   fees,
-			"orderQuantityProcessed": quantityDelta,
-			"etherQuantity":          ((quantityDelta * orderDoc.OrderPrice) / ETHUSD),
-		},
-	}
-	_, err = OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
+	update := bson.M{"$set": bson.M{"orderPrice": price, "requestedPrice": requestedPrice}}
+	_, err := OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func MarketOrder(ctx context.Context, orderID string, quantityProcessed float64, totalPrice float64) error {
-	ETHUSD := global.Exchange.ETHUSD
-	log.Printf("Fulfilling market order `%s` - Processed: %v\n", orderID, quantityProcessed)
-	var orderDoc *models.OrderSchema
-
-	if err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID}).Decode(&orderDoc); err != nil {
-		log.Printf("Error fetching order `%s`: \n"+err.Error(), orderID)
-		return err
-	}
-	bitcloutChange, etherChange, fees := calcChangeAndFees(
-		orderDoc.OrderSide,
-		quantityProcessed,
-		totalPrice)
-
-	log.Printf("bitChange: %v, etherChange: %v\n", bitcloutChange, etherChange)
+/*
+Calculates the change in a user's bitclout and settlement asset balances, all in base units
 
-	if err := UpdateUserBalance(ctx, orderDoc.Username, bitcloutChange, etherChange); err != nil {
-		log.Println(err.Error())
-		return err
+Arguments:
+	`market`: The market the order was placed on
+	`orderSide`: Whether this is a BUY order or a sell order
+	`quantity`: The nanos of BitClout bought/sold
+	`quote`: What the quantity cost in base units of the settlement asset
+Returns:
+	`bitcloutChange`: The change in the bitclout balance (nanos)
+	`quoteChange`: The change in the settlement asset balance (wei or USDC base units)
+	`fees`: The fees taken from the transaction (nanos for buys, settlement asset for sells)
+*/
+func calcChangeAndFees(market *global.Market, orderSide string, quantity, quote decimal.Decimal) (bitcloutChange, quoteChange, fees decimal.Decimal) {
+	fee := decimal.NewFromFloat(market.Fee)
+	if orderSide == "buy" {
+		fees = quantity.Mul(fee).Round(0)
+		bitcloutChange = quantity.Sub(fees)
+		quoteChange = quote.Neg()
+	} else {
+		fees = quote.Mul(fee).Round(0)
+		bitcloutChange = quantity.Neg()
+		quoteChange = quote.Sub(fees)
 	}
 
-	// Mark the order as complete after bitclout and eth balances are modified
-	update := bson.M{"$set": bson.M{"etherQuantity": (totalPrice / ETHUSD), "fees": fees, "orderQuantityProcessed": quantityProcessed, "execPrice": (totalPrice / quantityProcessed), "complete": true, "completeTime": time.Now().UTC()}}
-	_, err := OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, update)
-	if err != nil {
-		return err
-	}
-	return nil
+	return bitcloutChange, quoteChange, fees
 }
@@ -2,42 +2,65 @@ package db
 
 import (
 	"exchange-engine/global"
-	"math"
 	"testing"
+
+	"github.com/shopspring/decimal"
 )
 
 func TestCalcChangeAndFees(t *testing.T) {
-	// Market Order Situation
-	// The price is calculated from existing orders in the orderbook
-	ETHUSD := 2417.67
-	// The percent difference should be less than 0.01
-	tol := 0.01
-
-	bitcloutChange, etherChange, fees := calcChangeAndFees("buy", 10, 150)
+	// 10 BCLT bought for 0.062 ETH, amounts are base units
+	market := global.Markets[global.DefaultMarket]
+	quantity, quote := decimal.NewFromInt(10e9), decimal.RequireFromString("62043868187056025")
 
-	if bitcloutChange != 10*(1-global.Exchange.FEE) {
-		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, 9.8)
+	bitcloutChange, etherChange, fees := calcChangeAndFees(market, "buy", quantity, quote)
+	if !bitcloutChange.Equal(decimal.NewFromInt(9.9e9)) {
+		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, 9.9e9)
+	}
+	if !etherChange.Equal(quote.Neg()) {
+		t.Fatalf("etherChange is calculated incorrectly. Received: %v. Expected: %v", etherChange, quote.Neg())
 	}
-	// Accept a tolerance here because the ETH->USD rate may change slightly between the call above and now
-	if math.Abs((etherChange - -(150/ETHUSD))/-(150/ETHUSD)) > tol {
-		t.Fatalf("etherChange is calculated incorrectly. Received: %v. Expected: %v", etherChange, -150/ETHUSD)
+	if !fees.Equal(decimal.NewFromInt(0.1e9)) {
+		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, 0.1e9)
 	}
 
-	if fees != 10*global.Exchange.FEE {
-		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, 10*global.Exchange.FEE)
+	// the fee on wei is rounded to a whole wei and the change keeps every wei of the quote
+	bitcloutChange, etherChange, fees = calcChangeAndFees(market, "sell", quantity, quote)
+	correctFees := decimal.RequireFromString("620438681870560")
+	if !bitcloutChange.Equal(quantity.Neg()) {
+		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, quantity.Neg())
+	}
+	if !etherChange.Equal(quote.Sub(correctFees)) {
+		t.Fatalf("etherChange is calculated incorrectly. Received: %v. Expected: %v", etherChange, quote.Sub(correctFees))
+	}
+	if !fees.Equal(correctFees) {
+		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, correctFees)
 	}
+}
+
+func TestCalcChangeAndFeesUSDC(t *testing.T) {
+	// 10 BCLT for 150 USDC, amounts are base units
+	market := global.Markets["BCLT-USDC"]
+	quantity, quote := decimal.NewFromInt(10e9), decimal.NewFromInt(150e6)
 
-	bitcloutChange, etherChange, fees = calcChangeAndFees("sell", 10, 150)
-	correctFees := 150 * global.Exchange.FEE / ETHUSD
-	if bitcloutChange != -10 {
-		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, -10)
+	bitcloutChange, usdcChange, fees := calcChangeAndFees(market, "buy", quantity, quote)
+	if !bitcloutChange.Equal(decimal.NewFromInt(9.9e9)) {
+		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, 9.9e9)
+	}
+	if !usdcChange.Equal(decimal.NewFromInt(-150e6)) {
+		t.Fatalf("usdcChange is calculated incorrectly. Received: %v. Expected: %v", usdcChange, -150e6)
 	}
-	// Accept a tolerance here because the ETH->USD rate may change slightly between the call above and now
-	if math.Abs((etherChange-((150/ETHUSD)-correctFees))/((150/ETHUSD)-correctFees)) > tol {
-		t.Fatalf("etherChange is calculated incorrectly. Received: %v. Expected: %v", etherChange, (150/ETHUSD)-correctFees)
+	if !fees.Equal(decimal.NewFromInt(0.1e9)) {
+		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, 0.1e9)
 	}
 
-	if math.Abs((fees-correctFees)/correctFees) > tol {
-		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, correctFees)
+	bitcloutChange, usdcChange, fees = calcChangeAndFees(market, "sell", quantity, quote)
+	if !bitcloutChange.Equal(decimal.NewFromInt(-10e9)) {
+		t.Fatalf("bitcloutChange is calculated incorrectly. Received: %v. Expected: %v", bitcloutChange, -10e9)
+	}
+	if !usdcChange.Equal(decimal.NewFromInt(148.5e6)) {
+		t.Fatalf("usdcChange is calculated incorrectly. Received: %v. Expected: %v", usdcChange, 148.5e6)
+	}
+	if !fees.Equal(decimal.NewFromInt(1.5e6)) {
+		t.Fatalf("fees are calculated incorrectly. Received: %v. Expected: %v", fees, 1.5e6)
 	}
 }
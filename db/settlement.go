@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+const (
+	transactionAttempts = 5                     // times a transaction failing with a transient error is run
+	transactionBackoff  = 20 * time.Millisecond // wait before the second attempt, doubled for every further one
+)
+
+// transient reports whether a transaction failed for a reason that running it again may fix
+func transient(err error, label string) bool {
+	serverErr, ok := err.(mongo.ServerError)
+	return ok && serverErr.HasErrorLabel(label)
+}
+
+/*
+runTransaction runs `fn` in a transaction, so every write it makes with the session context it is given is committed or none is.
+
+The whole transaction is run again when it fails with a TransientTransactionError, and the commit alone when its outcome
+is unknown, at most transactionAttempts times with an exponential back-off.
+*/
+func runTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	opts := options.Transaction().SetReadConcern(readconcern.Snapshot()).SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+	return DB.Client.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		backoff := transactionBackoff
+		for attempt := 1; ; attempt++ {
+			err := sessCtx.StartTransaction(opts)
+			if err == nil {
+				if err = fn(sessCtx); err != nil {
+					if abortErr := sessCtx.AbortTransaction(context.Background()); abortErr != nil {
+						log.Println(abortErr.Error())
+					}
+				} else {
+					err = commitTransaction(sessCtx)
+				}
+			}
+			if err == nil || attempt == transactionAttempts || !transient(err, "TransientTransactionError") {
+				return err
+			}
+			log.Printf("retrying transaction (attempt %d): %v\n", attempt+1, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	})
+}
+
+// commitTransaction commits the transaction of `sessCtx`, retrying while the outcome of the commit is unknown
+func commitTransaction(sessCtx mongo.SessionContext) error {
+	var err error
+	for attempt := 1; attempt <= transactionAttempts; attempt++ {
+		if err = sessCtx.CommitTransaction(sessCtx); err == nil || !transient(err, "UnknownTransactionCommitResult") {
+			return err
+		}
+		log.Printf("retrying commit (attempt %d): %v\n", attempt+1, err)
+	}
+	return err
+}
+
+// FillError is returned by SettleFill when a trade cannot be settled for one of its orders
+type FillError struct {
+	OrderID string
+	Maker   bool // whether the order is the resting maker of the trade
+	Err     error
+}
+
+func (e *FillError) Error() string {
+	return fmt.Sprintf("settling %v: %v", e.OrderID, e.Err)
+}
+
+// fillError blames `err` on the order `orderID`, unless the server failed rather than the order and the transaction may be retried
+func fillError(orderID string, maker bool, err error) error {
+	if _, ok := err.(mongo.ServerError); ok {
+		return err
+	}
+	return &FillError{OrderID: orderID, Maker: maker, Err: err}
+}
+
+/*
+SettleFill settles one trade between a resting maker order and a taker order in a single transaction:
+the ledger entries of both users and their fees, the holds of both orders, the processed quantity, fees
+and average price of both orders, and the trade record itself. Either all of it is written or none of it is.
+
+An order is completed by the fill that leaves nothing of it to trade. The fees both sides paid are recorded on `trade`.
+A FillError names the order that could not be settled, so a broken maker is not mistaken for a broken taker.
+*/
+func SettleFill(ctx context.Context, trade *models.TradeSchema) error {
+	log.Printf("settle: %v - %v @ %v (maker %v, taker %v)\n", trade.TradeID, trade.Quantity, trade.Price, trade.MakerOrderID, trade.TakerOrderID)
+	market, err := global.GetMarket(trade.Market)
+	if err != nil {
+		return err
+	}
+	totalPrice := global.FromBaseUnits(trade.Quantity, market.Base).Mul(trade.Price)
+	// both sides must exchange the same amount for the ledger to balance, so it is converted once
+	quote, err := market.QuoteBaseUnits(totalPrice)
+	if err != nil {
+		return err
+	}
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		makerFee, makerEntries, err := settleOrder(sessCtx, trade.MakerOrderID, market, trade.Quantity, trade.Price, quote)
+		if err != nil {
+			return fillError(trade.MakerOrderID, true, err)
+		}
+		takerFee, takerEntries, err := settleOrder(sessCtx, trade.TakerOrderID, market, trade.Quantity, trade.Price, quote)
+		if err != nil {
+			return fillError(trade.TakerOrderID, false, err)
+		}
+		if err := postTransaction(sessCtx, trade.TradeID, append(makerEntries, takerEntries...)); err != nil {
+			if accountErr, ok := err.(*AccountError); ok {
+				if accountErr.Account == userAccount(trade.MakerUser) {
+					return fillError(trade.MakerOrderID, true, err)
+				}
+				return fillError(trade.TakerOrderID, false, err)
+			}
+			return err
+		}
+		trade.MakerFee, trade.MakerFeeAsset = makerFee, feeAsset(market, oppositeSide(trade.Side))
+		trade.TakerFee, trade.TakerFeeAsset = takerFee, feeAsset(market, trade.Side)
+		_, err = TradeCollection().InsertOne(sessCtx, trade)
+		return err
+	})
+}
+
+/*
+settleOrder applies one fill of `quantity` nanos at `price` ($), costing `quote` base units of the settlement asset,
+to an open order and releases the part of its hold that covered the quantity. When the fill costs more than that,
+the difference is held from the available balance and released with it, so the fill never spends funds other
+orders hold and fails with ErrInsufficientFunds if the user does not have them.
+
+Return:
+	fees - The fee the order paid for the fill, see calcChangeAndFees
+	entries - The ledger entries of the fill for the user of the order, see fillEntries
+*/
+func settleOrder(ctx context.Context, orderID string, market *global.Market, quantity, price, quote decimal.Decimal) (fees decimal.Decimal, entries []*models.LedgerEntrySchema, err error) {
+	var orderDoc *models.OrderSchema
+	if err := OrderCollection().FindOne(ctx, bson.M{"orderID": orderID, "complete": false}).Decode(&orderDoc); err != nil {
+		return decimal.Zero, nil, err
+	}
+	_, _, fees = calcChangeAndFees(market, orderDoc.OrderSide, quantity, quote)
+	release, shortfall := fillRelease(orderDoc, quantity, quote)
+	if err := holdBalance(ctx, orderDoc.Username, orderDoc.HeldAsset, shortfall); err != nil {
+		return decimal.Zero, nil, err
+	}
+	if err := releaseHold(ctx, orderDoc.Username, orderDoc.HeldAsset, release.Add(shortfall)); err != nil {
+		return decimal.Zero, nil, err
+	}
+
+	processed := orderDoc.OrderQuantityProcessed.Add(quantity)
+	set := bson.M{"execPrice": orderDoc.ExecPrice.Mul(orderDoc.OrderQuantityProcessed).Add(price.Mul(quantity)).Div(processed)}
+	inc := bson.M{"fees": fees, "etherQuantity": quote, "held": release.Neg()}
+	if quantity.GreaterThanOrEqual(orderDoc.OrderQuantity.Sub(orderDoc.OrderQuantityProcessed)) {
+		set["orderQuantityProcessed"] = orderDoc.OrderQuantity
+		set["complete"] = true
+		set["completeTime"] = time.Now().UTC()
+	} else {
+		inc["orderQuantityProcessed"] = quantity
+	}
+	if _, err := OrderCollection().UpdateOne(ctx, bson.M{"orderID": orderID}, bson.M{"$set": set, "$inc": inc}); err != nil {
+		return decimal.Zero, nil, err
+	}
+	return fees, fillEntries(orderDoc.Username, market, orderDoc.OrderSide, quantity, quote, fees), nil
+}
+
+// CompleteOrder completes an order that will not trade again without an error, releasing whatever it still holds.
+// Its fills were already settled by SettleFill, which completes the order itself when they fill it.
+func CompleteOrder(ctx context.Context, orderID string) error {
+	log.Printf("complete: %v\n", orderID)
+
+	return completeUnfilled(ctx, bson.M{"orderID": orderID, "complete": false}, bson.M{"complete": true, "completeTime": time.Now().UTC()})
+}
+
+func oppositeSide(side string) string {
+	if side == "buy" {
+		return "sell"
+	}
+	return "buy"
+}
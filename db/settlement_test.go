@@ -0,0 +1,19 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestFillError(t *testing.T) {
+	err := fillError("sell-maker", true, mongo.ErrNoDocuments)
+	if fillErr, ok := err.(*FillError); !ok || fillErr.OrderID != "sell-maker" || !fillErr.Maker || fillErr.Err != mongo.ErrNoDocuments {
+		t.Fatalf("Expected a maker FillError, got %v", err)
+	}
+	// server errors are not the order's fault and stay retryable
+	serverErr := mongo.CommandError{Code: 112, Labels: []string{"TransientTransactionError"}}
+	if err := fillError("buy-taker", false, serverErr); !transient(err, "TransientTransactionError") {
+		t.Fatalf("Server error was blamed on the order: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureTradeIndexes creates the indexes behind the trade queries. Creating an existing index is a no-op.
+func EnsureTradeIndexes(ctx context.Context) error {
+	_, err := TradeCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tradeID", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "makerUser", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "takerUser", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "makerOrderID", Value: 1}}},
+		{Keys: bson.D{{Key: "takerOrderID", Value: 1}}},
+		{Keys: bson.D{{Key: "market", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	return err
+}
+
+/*
+Calculates the fees each side of a trade pays
+
+Arguments:
+	`market`: The market the trade happened on
+	`takerSide`: The side of the taker order ("buy" or "sell")
+	`quantity`: The nanos of BitClout traded
+	`quote`: What the trade cost in base units of the settlement asset
+Returns:
+	The fee in base units and the asset it is paid in for the maker and the taker. Buyers pay in BCLT, sellers in the settlement asset.
+*/
+func TradeFees(market *global.Market, takerSide string, quantity, quote decimal.Decimal) (makerFee decimal.Decimal, makerFeeAsset string, takerFee decimal.Decimal, takerFeeAsset string) {
+	makerSide := oppositeSide(takerSide)
+	_, _, makerFee = calcChangeAndFees(market, makerSide, quantity, quote)
+	_, _, takerFee = calcChangeAndFees(market, takerSide, quantity, quote)
+	return makerFee, feeAsset(market, makerSide), takerFee, feeAsset(market, takerSide)
+}
+
+// feeAsset returns the asset the `side` of a trade pays its fee in, see TradeFees
+func feeAsset(market *global.Market, side string) string {
+	if side == "buy" {
+		return market.Base
+	}
+	return market.Quote
+}
+
+// timeRange restricts `filter` to trades between `from` and `to`. A zero time leaves that end open.
+func timeRange(filter bson.M, from, to time.Time) bson.M {
+	timestamp := bson.M{}
+	if !from.IsZero() {
+		timestamp["$gte"] = from
+	}
+	if !to.IsZero() {
+		timestamp["$lt"] = to
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
+
+func findTrades(ctx context.Context, filter bson.M) ([]*models.TradeSchema, error) {
+	var trades []*models.TradeSchema
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetMaxTime(5 * time.Second)
+	cursor, err := TradeCollection().Find(ctx, filter, opts)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err = cursor.All(ctx, &trades); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetUserTrades returns the trades the user was maker or taker of between `from` and `to`, newest first
+func GetUserTrades(ctx context.Context, publicKey string, from, to time.Time) ([]*models.TradeSchema, error) {
+	return findTrades(ctx, timeRange(bson.M{"$or": bson.A{bson.M{"makerUser": publicKey}, bson.M{"takerUser": publicKey}}}, from, to))
+}
+
+// GetOrderTrades returns every fill of the order, newest first
+func GetOrderTrades(ctx context.Context, orderID string) ([]*models.TradeSchema, error) {
+	return findTrades(ctx, bson.M{"$or": bson.A{bson.M{"makerOrderID": orderID}, bson.M{"takerOrderID": orderID}}})
+}
+
+// GetMarketTrades returns the trades of a market between `from` and `to`, newest first
+func GetMarketTrades(ctx context.Context, market string, from, to time.Time) ([]*models.TradeSchema, error) {
+	return findTrades(ctx, timeRange(bson.M{"market": market}, from, to))
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"exchange-engine/global"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestTradeFees(t *testing.T) {
+	market := global.Markets["BCLT-USDC"]
+	// 10 BCLT at $15, in nanos and USDC base units
+	quantity, quote := decimal.NewFromInt(10e9), decimal.NewFromInt(150e6)
+	bitcloutFee, usdcFee := decimal.NewFromInt(0.1e9), decimal.NewFromInt(1.5e6)
+
+	// A buying taker pays in BCLT and the selling maker in USDC
+	makerFee, makerFeeAsset, takerFee, takerFeeAsset := TradeFees(market, "buy", quantity, quote)
+	if !makerFee.Equal(usdcFee) || makerFeeAsset != "USDC" {
+		t.Fatalf("maker fee is calculated incorrectly. Received: %v %s. Expected: %v USDC", makerFee, makerFeeAsset, usdcFee)
+	}
+	if !takerFee.Equal(bitcloutFee) || takerFeeAsset != "BCLT" {
+		t.Fatalf("taker fee is calculated incorrectly. Received: %v %s. Expected: %v BCLT", takerFee, takerFeeAsset, bitcloutFee)
+	}
+
+	makerFee, makerFeeAsset, takerFee, takerFeeAsset = TradeFees(market, "sell", quantity, quote)
+	if !makerFee.Equal(bitcloutFee) || makerFeeAsset != "BCLT" || !takerFee.Equal(usdcFee) || takerFeeAsset != "USDC" {
+		t.Fatalf("fees are calculated incorrectly for a selling taker. Received: %v %s / %v %s", makerFee, makerFeeAsset, takerFee, takerFeeAsset)
+	}
+}
@@ -2,17 +2,14 @@ package db
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
 	"log"
-	"math"
 	"math/big"
-	"strconv"
 	"time"
 
+	"exchange-engine/global"
 	"exchange-engine/models"
 
+	"github.com/shopspring/decimal"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -37,41 +34,78 @@ func GetUserDoc(ctx context.Context, publicKey string) (*models.UserSchema, erro
 	return userDoc, nil
 }
 
-func CreditUserBalance(ctx context.Context, userId primitive.ObjectID, bitcloutNanosCredit, etherWeiCredit uint64) error {
+/*
+Credits a deposit to a user's balance by posting it to the ledger, moving the funds from the exchange account to the user's.
+
+Arguments:
+	userId - The ID of the user doc
+	bitcloutNanosCredit, etherWeiCredit - The amounts deposited in base units
+	reference - The hash of the deposit transaction
+*/
+func CreditUserBalance(ctx context.Context, userId primitive.ObjectID, bitcloutNanosCredit, etherWeiCredit uint64, reference string) error {
 	log.Println("crediting user")
-	update := bson.M{"$inc": bson.M{"balance.bitclout": bitcloutNanosCredit, "balance.ether": etherWeiCredit}}
-	_, err := UserCollection().UpdateOne(ctx, bson.M{"_id": userId}, update)
-	if err != nil {
-		return err
-	}
-	return nil
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		userDoc, err := getUserDocByID(sessCtx, userId)
+		if err != nil {
+			return err
+		}
+		account, nanos, wei := userAccount(userDoc.Bitclout.PublicKey), fromUint64(bitcloutNanosCredit), fromUint64(etherWeiCredit)
+		return postTransaction(sessCtx, reference, []*models.LedgerEntrySchema{
+			{Kind: models.LedgerDeposit, Account: exchangeAccount, Asset: assetBitclout, Amount: nanos.Neg()},
+			{Kind: models.LedgerDeposit, Account: account, Asset: assetBitclout, Amount: nanos},
+			{Kind: models.LedgerDeposit, Account: exchangeAccount, Asset: assetEther, Amount: wei.Neg()},
+			{Kind: models.LedgerDeposit, Account: account, Asset: assetEther, Amount: wei},
+		})
+	})
 }
 
 /*
-Updates a user's BitClout and Ether balances by `bitcloutChange` and `etherChange` respectively.
+Debits a withdrawal from a user's balance by posting it to the ledger, moving the funds from the user's account back to the exchange account.
+Funds held by open orders cannot be withdrawn.
 
-One of `bitcloutChange` and `etherChange` MUST BE NEGATIVE. The other MUST BE POSITIVE.
+Arguments:
+	userId - The ID of the user doc
+	bitcloutNanosDebit, etherWeiDebit - The amounts withdrawn in base units
+	reference - The hash of the withdrawal transaction
+Return:
+	ErrInsufficientFunds if the available balance does not cover the withdrawal
 */
+func DebitUserBalance(ctx context.Context, userId primitive.ObjectID, bitcloutNanosDebit, etherWeiDebit uint64, reference string) error {
+	log.Println("debiting user")
+	return runTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		userDoc, err := getUserDocByID(sessCtx, userId)
+		if err != nil {
+			return err
+		}
+		nanos, wei := fromUint64(bitcloutNanosDebit), fromUint64(etherWeiDebit)
+		if availableBalance(userDoc.Balance, assetBitclout).LessThan(nanos) || availableBalance(userDoc.Balance, assetEther).LessThan(wei) {
+			return ErrInsufficientFunds
+		}
+		account := userAccount(userDoc.Bitclout.PublicKey)
+		return postTransaction(sessCtx, reference, []*models.LedgerEntrySchema{
+			{Kind: models.LedgerWithdrawal, Account: account, Asset: assetBitclout, Amount: nanos.Neg()},
+			{Kind: models.LedgerWithdrawal, Account: exchangeAccount, Asset: assetBitclout, Amount: nanos},
+			{Kind: models.LedgerWithdrawal, Account: account, Asset: assetEther, Amount: wei.Neg()},
+			{Kind: models.LedgerWithdrawal, Account: exchangeAccount, Asset: assetEther, Amount: wei},
+		})
+	})
+}
 
-func UpdateUserBalance(ctx context.Context, publicKey string, bitcloutChange, etherChange float64) error {
-	if (bitcloutChange > 0) == (etherChange > 0) {
-		return errors.New("both `bitcloutChange` and `etherChange` cannot be positive or negative")
-	}
+// fromUint64 converts an amount of base units from the chain, which can exceed an int64 in wei
+func fromUint64(amount uint64) decimal.Decimal {
+	return decimal.NewFromBigInt(new(big.Int).SetUint64(amount), 0)
+}
 
-	// nanosChange, err := global.ToNanos(bitcloutChange)
-	// if err != nil {
-	// 	return err
-	// }
-	// weiChange, err := global.ToWei(etherChange)
-	// if err != nil {
-	// 	return err
-	// }
-	update := bson.M{"$inc": bson.M{"balance.bitclout": math.Round(bitcloutChange * 1e9), "balance.ether": math.Round(etherChange * 1e18)}}
-	_, err := UserCollection().UpdateOne(ctx, bson.M{"bitclout.publicKey": publicKey}, update)
-	if err != nil {
-		return err
+func getUserDocByID(ctx context.Context, userId primitive.ObjectID) (*models.UserSchema, error) {
+	var userDoc *models.UserSchema
+	if err := UserCollection().FindOne(ctx, bson.M{"_id": userId}).Decode(&userDoc); err != nil {
+		log.Printf("Could not find user: %v\n", userId.Hex())
+		return nil, err
 	}
-	return nil
+	if userDoc.Balance == nil {
+		userDoc.Balance = &models.UserBalance{}
+	}
+	return userDoc, nil
 }
 
 func GetUserBalance(ctx context.Context, publicKey string) (balance *models.UserBalance, err error) {
@@ -86,6 +120,11 @@ func GetUserBalance(ctx context.Context, publicKey string) (balance *models.User
 	return userDoc.Balance, nil
 }
 
+// QuoteBalance returns the user's available balance of the settlement asset of `market` in base units
+func QuoteBalance(balance *models.UserBalance, market *global.Market) decimal.Decimal {
+	return availableBalance(balance, quoteAsset(market))
+}
+
 func CheckUserTransactionState(ctx context.Context, publicKey string) (bool, error) {
 	// var userDoc *models.UserSchema
 	userDoc, err := GetUserDoc(ctx, publicKey)
@@ -118,9 +157,6 @@ func GetUserOrders(ctx context.Context, publicKey string) ([]*models.OrderSchema
 }
 
 func GetTotalBalances(ctx context.Context) (*models.CurrencyAmountsBig, error) {
-	var totalBalances *models.CurrencyAmounts
-	var totalBalancesBig models.CurrencyAmountsBig
-
 	balanceAggregateStage := bson.D{
 		{"$group", bson.D{
 			{"_id", ""},
@@ -137,24 +173,16 @@ func GetTotalBalances(ctx context.Context) (*models.CurrencyAmountsBig, error) {
 	if err != nil {
 		return nil, err
 	}
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, err
+	var results []struct {
+		TotalBitclout decimal.Decimal `bson:"totalBitclout"`
+		TotalEther    decimal.Decimal `bson:"totalEther"`
 	}
-
-	jsonBytes, _ := json.Marshal(results[0])
-	err = json.Unmarshal(jsonBytes, &totalBalances)
-	if err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		return nil, err
 	}
-	totalBalancesBig.Bitclout = new(big.Int)
-	totalBalancesBig.Ether = new(big.Int)
-	var okBitclout, okEther bool
-	totalBalancesBig.Bitclout, okBitclout = totalBalancesBig.Bitclout.SetString(strconv.FormatFloat(totalBalances.Bitclout, 'f', 0, 64), 10)
-	totalBalancesBig.Ether, okEther = totalBalancesBig.Ether.SetString(strconv.FormatFloat(totalBalances.Ether, 'f', 0, 64), 10)
-	if !okBitclout || !okEther {
-		return nil, errors.New(fmt.Sprintf("SetString Error bitclout: %v, ether: %v", okBitclout, okEther))
+	if len(results) == 0 {
+		return &models.CurrencyAmountsBig{Bitclout: new(big.Int), Ether: new(big.Int)}, nil
 	}
 
-	return &totalBalancesBig, nil
+	return &models.CurrencyAmountsBig{Bitclout: results[0].TotalBitclout.BigInt(), Ether: results[0].TotalEther.BigInt()}, nil
 }
@@ -7,19 +7,79 @@ import (
 	"net/http"
 	"time"
 
+	"exchange-engine/config"
 	"exchange-engine/db"
 	"exchange-engine/global"
 	"exchange-engine/models"
 	"exchange-engine/orderbook"
-	"exchange-engine/s3"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func OrderIDGen(orderType string, orderSide string, publicKey string, quantity float64, created time.Time) (orderID string) {
-	return fmt.Sprintf("%s-%s-%s-%v-%v", orderType, orderSide, publicKey, quantity, created.UnixNano()/int64(time.Millisecond))
+/*
+OrderIDGen returns a new opaque order ID.
+
+IDs are MongoDB ObjectIDs (timestamp, random process identifier and counter), so they are unique
+across engine instances and reveal nothing about the order or its owner. The unique orderID index
+rejects the order should one ever collide.
+*/
+func OrderIDGen() (orderID string) {
+	return primitive.NewObjectID().Hex()
+}
+
+// parseSelfTradePrevention resolves the self-trade prevention mode of an order, falling back to the configured default
+func parseSelfTradePrevention(order *models.OrderSchema) (orderbook.SelfTradePrevention, error) {
+	mode := order.SelfTradePrevention
+	if mode == "" {
+		mode = config.ExchangeConfig.SelfTradePrevention
+	}
+	stp, err := orderbook.ParseSelfTradePrevention(mode)
+	order.SelfTradePrevention = stp.String()
+	return stp, err
+}
+
+/*
+createOrder holds what the order can spend from the user's available balance and records the order.
+The hold is given back if the order cannot be recorded.
+
+Arguments:
+	quantity - The most BitClout the order can sell, in nanos
+	totalQuote - The most the order can cost in base units of the settlement asset of `market`
+*/
+func createOrder(ctx context.Context, order *models.OrderSchema, market *global.Market, quantity, totalQuote decimal.Decimal) error {
+	if err := db.HoldOrderBalance(ctx, order, market, quantity, totalQuote); err != nil {
+		return err
+	}
+	if err := db.CreateOrder(ctx, order); err != nil {
+		if releaseErr := db.ReleaseHold(ctx, order); releaseErr != nil {
+			log.Println(releaseErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// newOrder starts the document of an order request on `market`, its quantities stored in nanos
+func newOrder(request *models.OrderRequest, market *global.Market) models.OrderSchema {
+	return models.OrderSchema{
+		Username:            request.Username,
+		Market:              market.Symbol,
+		OrderSide:           request.OrderSide,
+		OrderQuantity:       global.ToBaseUnits(request.OrderQuantity, market.Base),
+		OrderPrice:          request.OrderPrice,
+		DisplayQuantity:     global.ToBaseUnits(request.DisplayQuantity, market.Base),
+		StopPrice:           request.StopPrice,
+		TimeInForce:         request.TimeInForce,
+		ExpireTime:          request.ExpireTime,
+		PostOnly:            request.PostOnly,
+		PostOnlyReprice:     request.PostOnlyReprice,
+		SelfTradePrevention: request.SelfTradePrevention,
+		Created:             time.Now().UTC(),
+		OrderID:             OrderIDGen(),
+	}
 }
 
 func SanitizeHandler(c *gin.Context) {
@@ -38,6 +98,11 @@ func SanitizeHandler(c *gin.Context) {
 	return
 }
 
+/*
+MarketOrderHandler executes a protected market order. `:quote` is the total price the user expects
+for the order and `:slippage` the largest relative deviation they accept; it is turned into a worst
+price the engine never trades beyond, and whatever is left at that price is cancelled.
+*/
 func MarketOrderHandler(c *gin.Context) {
 	slippageParam := c.Param("slippage")
 	quoteParam := c.Param("quote")
@@ -53,14 +118,21 @@ func MarketOrderHandler(c *gin.Context) {
 		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var order models.OrderSchema
+	var request models.OrderRequest
 	var orderSide orderbook.Side
 
-	if err := c.ShouldBindWith(&order, binding.JSON); err != nil {
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
 		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	book, err := orderbook.GetOrderBook(request.Market)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order := newOrder(&request, book.Market())
+
 	// Ensure that the orderSide is "buy" or "sell"
 	if order.OrderSide == "buy" {
 		orderSide = orderbook.Buy
@@ -70,28 +142,36 @@ func MarketOrderHandler(c *gin.Context) {
 		c.SecureJSON(http.StatusBadRequest, gin.H{"error": "invalid side"})
 		return
 	}
+	stp, err := parseSelfTradePrevention(&order)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Ensure that the order has a valid quantity
-	orderQuantity := decimal.NewFromFloat(order.OrderQuantity)
-	if orderQuantity.Sign() <= 0 {
-		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": orderbook.ErrInvalidQuantity.Error()})
+	orderQuantity := request.OrderQuantity
+	if err := book.ValidateQuantity(orderQuantity); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Initialize the Order
 	order.OrderType = "market"
-	order.Created = time.Now().UTC()
-	order.OrderID = OrderIDGen(order.OrderType, order.OrderSide, order.Username, order.OrderQuantity, order.Created)
-	order.OrderQuantityProcessed = 0
-	order.EtherQuantity = 0
-	order.Fees = 0
-	estMarketPrice, err := orderbook.CalculateMarketPrice(orderSide, orderQuantity)
+	estMarketPrice, err := book.CalculateMarketPrice(orderSide, orderQuantity)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := book.ValidateNotional(estMarketPrice); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	estQuote, err := book.Market().QuoteBaseUnits(estMarketPrice)
 	if err != nil {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	estMarketPriceFloat, _ := estMarketPrice.Float64()
-	if !db.ValidateOrder(c.Request.Context(), order.Username, order.OrderSide, order.OrderQuantity, estMarketPriceFloat/global.Exchange.ETHUSD) {
+	if !db.ValidateOrder(c.Request.Context(), order.Username, book.Market(), order.OrderSide, order.OrderQuantity, estQuote) {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not validate order."})
 		return
 	}
@@ -101,43 +181,184 @@ func MarketOrderHandler(c *gin.Context) {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not execute order without slippage."})
 		return
 	}
-	// if math.Abs(estMarketPriceFloat-order.Quote)
-	// Attempt to create an order in the database
-	err = db.CreateOrder(c.Request.Context(), &order)
+	limitPrice, err := orderbook.ProtectionPrice(orderSide, orderQuantity, quote, slippage)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Attempt to create an order in the database, holding enough for every fill up to the protection price
+	limitQuote, err := book.Market().QuoteBaseUnits(limitPrice.Mul(orderQuantity))
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = createOrder(c.Request.Context(), &order, book.Market(), order.OrderQuantity, limitQuote)
 	if err != nil {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	// Attempt to Process the Market Order
-	quantityLeft, tradePrice, err := orderbook.ProcessMarketOrder(orderSide, orderQuantity)
+	// Attempt to Process the Market Order. The book may move after the estimate above, so the
+	// slippage bound is enforced again by the engine at every level it trades.
+	trades, quantityLeft, tradePrice, err := book.ProcessProtectedMarketOrder(orderSide, order.OrderID, order.Username, orderQuantity, limitPrice, stp)
 	log.Println(quantityLeft, tradePrice, err)
+	filled := orderbook.TakerQuantity(trades, order.OrderID)
+	if err == nil && filled.IsZero() {
+		err = orderbook.ErrPriceProtection
+	}
 	if err != nil {
 		db.CancelCompleteOrder(c.Request.Context(), order.OrderID, err.Error())
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// give the current order's issuer `orderQuantity - quantityLeft` (equivalent value as `tradePrice`)
-	tradePriceFloat, _ := tradePrice.Float64()
-	quantityLeftFloat, _ := quantityLeft.Float64()
-	err = db.MarketOrder(context.TODO(), order.OrderID, order.OrderQuantity-quantityLeftFloat, tradePriceFloat)
+	// the fills were settled as they happened. The remainder beyond the protection price never rests, record why it was not filled
+	cancelled := orderQuantity.Sub(filled)
+	if cancelled.IsPositive() {
+		err = db.CancelCompleteOrder(c.Request.Context(), order.OrderID, orderbook.ErrPriceProtection.Error())
+	} else {
+		err = db.CompleteOrder(c.Request.Context(), order.OrderID)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"id": order.OrderID, "trades": trades, "filled": filled, "cancelled": cancelled, "limitPrice": limitPrice})
+	return
+}
+
+/*
+MarketQuoteOrderHandler executes a market order denominated in the settlement asset of its market:
+a buy spends `quoteQuantity`, a sell sells until it has received `quoteQuantity`.
+
+`:quote` is the quantity the user expects to trade (see GetMarketQuantityHandler) and `:slippage`
+the largest relative difference to the current estimate the order is executed with. The same slippage
+bounds the price the order trades at and the quantity it trades, see ProtectionPrice.
+*/
+func MarketQuoteOrderHandler(c *gin.Context) {
+	quote, err := decimal.NewFromString(c.Param("quote"))
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if quote.Sign() <= 0 {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": orderbook.ErrInvalidQuantity.Error()})
+		return
+	}
+	slippage, err := decimal.NewFromString(c.Param("slippage"))
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var request struct {
+		Username            string          `json:"username" binding:"required"`
+		Market              string          `json:"market"`
+		OrderSide           string          `json:"orderSide" binding:"required"`
+		QuoteQuantity       decimal.Decimal `json:"quoteQuantity"` // whole units of the settlement asset
+		SelfTradePrevention string          `json:"selfTradePrevention"`
+	}
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book, err := orderbook.GetOrderBook(request.Market)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var orderSide orderbook.Side
+	if request.OrderSide == "buy" {
+		orderSide = orderbook.Buy
+	} else if request.OrderSide == "sell" {
+		orderSide = orderbook.Sell
+	} else {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": "invalid side"})
+		return
+	}
+	order := models.OrderSchema{
+		Username:            request.Username,
+		Market:              book.Market().Symbol,
+		OrderSide:           request.OrderSide,
+		QuoteQuantity:       global.ToBaseUnits(request.QuoteQuantity, book.Market().Quote),
+		SelfTradePrevention: request.SelfTradePrevention,
+	}
+	stp, err := parseSelfTradePrevention(&order)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Prices are quoted in USD, so the budget is matched in USD
+	budget := request.QuoteQuantity.Mul(decimal.NewFromFloat(book.Market().QuoteUSD()))
+	if err := book.ValidateNotional(budget); err != nil || budget.Sign() <= 0 {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": orderbook.ErrMinNotional.Error()})
+		return
+	}
+	estQuantity, err := book.CalculateMarketQuantity(orderSide, budget)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orderSlippage := quote.Sub(estQuantity).Abs().Div(quote)
+	if orderSlippage.GreaterThan(slippage) {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not execute order without slippage."})
+		return
+	}
+
+	// The order never trades at a price or quantity beyond the estimate with the slippage it accepts
+	limitPrice, err := orderbook.ProtectionPrice(orderSide, estQuantity, budget, slippage)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Initialize the Order. Its quantity is the most it may trade, what was actually traded is recorded on settlement.
+	order.OrderQuantity = global.ToBaseUnits(estQuantity.Mul(decimal.NewFromInt(1).Add(slippage)), book.Market().Base)
+	order.OrderType = "market"
+	order.Created = time.Now().UTC()
+	order.OrderID = OrderIDGen()
+	if !db.ValidateOrder(c.Request.Context(), order.Username, book.Market(), order.OrderSide, order.OrderQuantity, order.QuoteQuantity) {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not validate order."})
+		return
+	}
+	// A buy holds its budget. A sell holds its quantity, which the engine never sells more than.
+	err = createOrder(c.Request.Context(), &order, book.Market(), order.OrderQuantity, order.QuoteQuantity)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	maxQuantity := global.FromBaseUnits(order.OrderQuantity, book.Market().Base)
+	trades, budgetLeft, quantity, err := book.ProcessQuoteMarketOrder(orderSide, order.OrderID, order.Username, budget, maxQuantity, limitPrice, stp)
+	log.Println(budgetLeft, quantity, err)
+	if err == nil && quantity.IsZero() {
+		err = orderbook.ErrInsufficientQuantity
+	}
 	if err != nil {
 		db.CancelCompleteOrder(c.Request.Context(), order.OrderID, err.Error())
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	go orderbook.SanitizeUsersOrders(order.Username)
-	go s3.UploadToS3(orderbook.GetOrderbookBytes())
-	c.SecureJSON(http.StatusOK, gin.H{"id": order.OrderID})
+
+	// The fills were settled as they happened, complete the order and release what it held for the rest of the budget
+	if err := db.CompleteOrder(c.Request.Context(), order.OrderID); err != nil {
+		log.Println(err.Error())
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"id": order.OrderID, "trades": trades})
 	return
 }
 
 func LimitOrderHandler(c *gin.Context) {
-	var order models.OrderSchema
-	if err := c.ShouldBindWith(&order, binding.JSON); err != nil {
+	var request models.OrderRequest
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	book, err := orderbook.GetOrderBook(request.Market)
+	if err != nil {
 		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	order := newOrder(&request, book.Market())
 
 	var orderSide orderbook.Side
 	if order.OrderSide == "buy" {
@@ -149,36 +370,64 @@ func LimitOrderHandler(c *gin.Context) {
 		return
 	}
 
-	order.OrderType = "limit"
-	order.Created = time.Now().UTC()
-	order.Complete = false
-	order.OrderQuantityProcessed = 0
-	order.EtherQuantity = 0
-	order.Fees = 0
-	order.OrderID = OrderIDGen(order.OrderType, order.OrderSide, order.Username, order.OrderQuantity, order.Created)
+	timeInForce, err := orderbook.ParseTimeInForce(order.TimeInForce)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order.TimeInForce = timeInForce.String()
+	if timeInForce != orderbook.GoodTilDate {
+		order.ExpireTime = time.Time{}
+	}
+	stp, err := parseSelfTradePrevention(&order)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if !db.ValidateOrder(c.Request.Context(), order.Username, order.OrderSide, order.OrderQuantity, (order.OrderPrice*order.OrderQuantity)/global.Exchange.ETHUSD) {
-		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not validate order."})
+	// Enforce the market's tick size, lot size and order limits before anything is recorded
+	orderQuantity := request.OrderQuantity
+	orderPrice := request.OrderPrice
+	if err := book.ValidateLimitOrder(orderQuantity, orderPrice); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := db.CreateOrder(c.Request.Context(), &order)
+	// Iceberg orders only show `displayQuantity` on the book at a time
+	displayQuantity := request.DisplayQuantity
+	if displayQuantity.IsPositive() {
+		if err := book.ValidateQuantity(displayQuantity); err != nil {
+			c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	order.OrderType = "limit"
+
+	totalQuote, err := book.Market().QuoteBaseUnits(orderPrice.Mul(orderQuantity))
 	if err != nil {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	orderQuantity := decimal.NewFromFloat(order.OrderQuantity)
-	orderPrice := decimal.NewFromFloat(order.OrderPrice)
-	if orderQuantity.Sign() <= 0 || orderPrice.Sign() <= 0 {
-		db.CancelCompleteOrder(c.Request.Context(), order.OrderID, orderbook.ErrInvalidQuantity.Error())
-		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": orderbook.ErrInvalidQuantity.Error()})
+	if !db.ValidateOrder(c.Request.Context(), order.Username, book.Market(), order.OrderSide, order.OrderQuantity, totalQuote) {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not validate order."})
+		return
+	}
+	err = createOrder(c.Request.Context(), &order, book.Market(), order.OrderQuantity, totalQuote)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Attempt to process Limit Order
-	quantityLeft, totalPrice, error := orderbook.ProcessLimitOrder(orderSide, order.OrderID, orderQuantity, orderPrice)
-	totalPriceFloat, _ := totalPrice.Float64()
-	quantityLeftFloat, _ := quantityLeft.Float64()
+	trades, quantityLeft, totalPrice, error := book.ProcessLimitOrder(orderSide, order.OrderID, order.Username, orderQuantity, orderPrice, orderbook.LimitOptions{
+		TimeInForce: timeInForce,
+		ExpireTime:  order.ExpireTime,
+		PostOnly:    order.PostOnly,
+		Reprice:     order.PostOnlyReprice,
+
+		DisplayQuantity:     displayQuantity,
+		SelfTradePrevention: stp,
+	})
 	log.Println(quantityLeft, totalPrice)
 	if error != nil {
 		db.CancelCompleteOrder(c.Request.Context(), order.OrderID, error.Error())
@@ -186,33 +435,182 @@ func LimitOrderHandler(c *gin.Context) {
 		return
 	}
 
-	// If there is remaining quantity in the received order
+	// The fills were settled as they happened. If there is remaining quantity in the received order
 	if quantityLeft.IsPositive() {
-		// If the received order partially fulfilled orders
-		if quantityLeft != orderQuantity {
-			// Create a Partial Order for the remaining
-			error = db.PartialLimitOrder(c.Request.Context(), order.OrderID, order.OrderQuantity-quantityLeftFloat, totalPriceFloat)
-			if error != nil {
-				db.CancelCompleteOrder(c.Request.Context(), order.OrderID, error.Error())
-				c.SecureJSON(http.StatusInternalServerError, gin.H{"error": error.Error()})
-				return
-			}
+		// Immediate-or-cancel remainders never rest on the book
+		if !timeInForce.Rests() {
+			db.CancelCompleteOrder(c.Request.Context(), order.OrderID, orderbook.ErrUnfilledCancelled.Error())
 		}
 	} else {
-		// The received order was exhausted - it fulfilled orders in the orderbook
-		error = db.CompleteLimitOrder(c.Request.Context(), order.OrderID, totalPriceFloat)
-		if error != nil {
-			db.CancelCompleteOrder(c.Request.Context(), order.OrderID, error.Error())
-			c.SecureJSON(http.StatusInternalServerError, gin.H{"error": error.Error()})
-			return
+		// The received order was exhausted. Its last fill completed it, unless self-trade prevention removed the rest
+		if error = db.CompleteOrder(c.Request.Context(), order.OrderID); error != nil {
+			log.Println(error.Error())
 		}
 	}
-	go orderbook.SanitizeUsersOrders(order.Username)
-	go s3.UploadToS3(orderbook.GetOrderbookBytes())
+	c.SecureJSON(http.StatusOK, gin.H{"id": order.OrderID, "trades": trades})
+	return
+}
+
+/*
+StopOrderHandler places a stop order that waits in the stop book until the last traded price reaches `stopPrice`.
+
+Without an `orderPrice` it becomes a market order when triggered (orderType "stop"),
+otherwise a limit order at `orderPrice` (orderType "stop-limit").
+*/
+func StopOrderHandler(c *gin.Context) {
+	var request models.OrderRequest
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book, err := orderbook.GetOrderBook(request.Market)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order := newOrder(&request, book.Market())
+
+	var orderSide orderbook.Side
+	if order.OrderSide == "buy" {
+		orderSide = orderbook.Buy
+	} else if order.OrderSide == "sell" {
+		orderSide = orderbook.Sell
+	} else {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": "Invalid orderSide"})
+		return
+	}
+	stp, err := parseSelfTradePrevention(&order)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orderQuantity := request.OrderQuantity
+	stopPrice := request.StopPrice
+	orderPrice := request.OrderPrice
+	if orderQuantity.Sign() <= 0 || stopPrice.Sign() <= 0 || orderPrice.Sign() < 0 {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": orderbook.ErrInvalidStopPrice.Error()})
+		return
+	}
+	if err := book.ValidatePrice(stopPrice); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The stop price is the best estimate of what a stop-market order will cost
+	referencePrice := orderPrice
+	if orderPrice.IsZero() {
+		order.OrderType = "stop"
+		referencePrice = stopPrice
+	} else {
+		order.OrderType = "stop-limit"
+	}
+	if err := book.ValidateLimitOrder(orderQuantity, referencePrice); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order.StopState = models.StopPending
+
+	// A stop-market buy may trade up to its protection price once triggered, so it holds that much
+	holdPrice := referencePrice
+	if orderPrice.IsZero() {
+		holdPrice = orderbook.StopProtectionPrice(book.Market(), orderSide, stopPrice)
+	}
+	totalQuote, err := book.Market().QuoteBaseUnits(holdPrice.Mul(orderQuantity))
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !db.ValidateOrder(c.Request.Context(), order.Username, book.Market(), order.OrderSide, order.OrderQuantity, totalQuote) {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": "Could not validate order."})
+		return
+	}
+	err = createOrder(c.Request.Context(), &order, book.Market(), order.OrderQuantity, totalQuote)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = book.ProcessStopOrder(orderSide, order.OrderID, order.Username, orderQuantity, stopPrice, orderPrice, stp)
+	if err != nil {
+		db.CancelStopOrder(c.Request.Context(), order.OrderID, err.Error())
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.SecureJSON(http.StatusOK, gin.H{"id": order.OrderID})
 	return
 }
 
+/*
+AmendOrderHandler changes the price and/or quantity of a resting limit order.
+
+An omitted `orderPrice` or `orderQuantity` keeps the current value. `orderQuantity` is the new
+remaining quantity: decreasing it keeps the order's place in the queue, while a price change
+or increase moves it to the back of its level.
+*/
+func AmendOrderHandler(c *gin.Context) {
+	var amendment struct {
+		ID            string          `json:"orderID" binding:"required"`
+		OrderQuantity decimal.Decimal `json:"orderQuantity"`
+		OrderPrice    decimal.Decimal `json:"orderPrice"`
+	}
+	if err := c.ShouldBindWith(&amendment, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	quantity := amendment.OrderQuantity
+	price := amendment.OrderPrice
+	if quantity.Sign() < 0 || price.Sign() < 0 {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": orderbook.ErrInvalidQuantity.Error()})
+		return
+	}
+	order, err := orderbook.AmendOrder(amendment.ID, quantity, price)
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"id": order.ID(), "price": order.Price(), "quantity": order.TotalQuantity()})
+	return
+}
+
+/*
+GetTradesHandler returns the individual fills of an order, a user or a market, newest first.
+
+Exactly one of the `orderID`, `user` or `market` query parameters selects the trades.
+`from` and `to` (RFC 3339) optionally restrict user and market queries to a time range.
+*/
+func GetTradesHandler(c *gin.Context) {
+	var query struct {
+		OrderID string    `form:"orderID"`
+		User    string    `form:"user"`
+		Market  string    `form:"market"`
+		From    time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+		To      time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var (
+		trades []*models.TradeSchema
+		err    error
+	)
+	if query.OrderID != "" {
+		trades, err = db.GetOrderTrades(c.Request.Context(), query.OrderID)
+	} else if query.User != "" {
+		trades, err = db.GetUserTrades(c.Request.Context(), query.User, query.From, query.To)
+	} else if query.Market != "" {
+		trades, err = db.GetMarketTrades(c.Request.Context(), query.Market, query.From, query.To)
+	} else {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": "orderID, user or market is required"})
+		return
+	}
+	if err != nil {
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"trades": trades})
+	return
+}
+
 func CancelOrderHandler(c *gin.Context) {
 	var orderID struct {
 		ID string `json:"orderID" binding:"required"`
@@ -225,7 +623,140 @@ func CancelOrderHandler(c *gin.Context) {
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
-	go s3.UploadToS3(orderbook.GetOrderbookBytes())
 	c.String(http.StatusOK, fmt.Sprintf("Cancelled order: %s", orderID))
 	return
 }
+
+/*
+ReconcileHandler compares the books with the open orders in the database on demand.
+
+`market` restricts it to one book and `policy` (report, reinsert, cancel or halt) decides what is
+done about the discrepancies; by default they are only reported.
+*/
+func ReconcileHandler(c *gin.Context) {
+	var request struct {
+		Market string `json:"market"`
+		Policy string `json:"policy"`
+	}
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy, err := orderbook.ParseReconcilePolicy(request.Policy)
+	if request.Policy == "" {
+		policy, err = orderbook.ReconcileReport, nil
+	}
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var reports []*orderbook.Reconciliation
+	if request.Market == "" {
+		reports, err = orderbook.Reconcile(policy)
+	} else {
+		var book *orderbook.OrderBook
+		if book, err = orderbook.GetOrderBook(request.Market); err != nil {
+			c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var report *orderbook.Reconciliation
+		if report, err = book.Reconcile(policy, orderbook.ReconcileGrace); err == nil {
+			reports = append(reports, report)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"reports": reports})
+	return
+}
+
+// CancelOnlyHandler puts a market in, or takes it out of, cancel-only mode
+func CancelOnlyHandler(c *gin.Context) {
+	var request struct {
+		Market     string `json:"market" binding:"required"`
+		CancelOnly bool   `json:"cancelOnly"`
+	}
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book, err := orderbook.GetOrderBook(request.Market)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	book.SetCancelOnly(request.CancelOnly)
+	log.Printf("orderbook %s cancel-only: %v\n", book.Market().Symbol, request.CancelOnly)
+	c.SecureJSON(http.StatusOK, gin.H{"market": book.Market().Symbol, "cancelOnly": book.CancelOnly()})
+	return
+}
+
+// LedgerVerifyHandler reports every user balance that differs from the sum of the user's ledger entries
+func LedgerVerifyHandler(c *gin.Context) {
+	mismatches, err := db.VerifyBalances(c.Request.Context())
+	if err != nil {
+		log.Println(err)
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"mismatches": mismatches})
+	return
+}
+
+// LedgerRebuildHandler replaces the cached balance of a user with the sum of their ledger entries
+func LedgerRebuildHandler(c *gin.Context) {
+	var request struct {
+		PublicKey string `json:"publicKey" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	balance, err := db.RebuildUserBalance(c.Request.Context(), request.PublicKey)
+	if err != nil {
+		log.Println(err)
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"balance": balance})
+	return
+}
+
+/*
+WithdrawHandler debits a withdrawal paid out to a user from their balance, posting it to the ledger.
+
+`bitcloutNanos` and `etherWei` are the amounts paid out in base units and `reference` the hash of the
+withdrawal transaction. Funds held by open orders cannot be withdrawn.
+*/
+func WithdrawHandler(c *gin.Context) {
+	var request struct {
+		UserID        string `json:"userId" binding:"required"`
+		BitcloutNanos uint64 `json:"bitcloutNanos"`
+		EtherWei      uint64 `json:"etherWei"`
+		Reference     string `json:"reference" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(request.UserID)
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = db.DebitUserBalance(c.Request.Context(), userID, request.BitcloutNanos, request.EtherWei, request.Reference)
+	if err == db.ErrInsufficientFunds {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{"id": request.UserID, "reference": request.Reference})
+	return
+}
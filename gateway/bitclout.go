@@ -60,7 +60,7 @@ func QueryWallets(ctx context.Context) {
 									log.Println(transaction)
 									feesRemaining := BITCLOUT_DEPOSIT_FEENANOS - transaction.TransactionInfo.FeeNanos
 
-									err = db.CreditUserBalance(ctx, wallet.User, amountToTransfer, 0)
+									err = db.CreditUserBalance(ctx, wallet.User, amountToTransfer, 0, txn.TransactionIDBase58Check)
 									if err != nil {
 										log.Println(err)
 									}
@@ -4,8 +4,23 @@ import (
 	"errors"
 	"math/big"
 	"strconv"
+
+	"github.com/shopspring/decimal"
 )
 
+// AssetDecimals is the number of decimals of the base units of each asset: nanos, wei and USDC base units
+var AssetDecimals = map[string]int32{"BCLT": 9, "ETH": 18, "USDC": 6}
+
+// ToBaseUnits converts whole units of `asset` to an integer amount of its base units, rounding half away from zero
+func ToBaseUnits(amount decimal.Decimal, asset string) decimal.Decimal {
+	return amount.Shift(AssetDecimals[asset]).Round(0)
+}
+
+// FromBaseUnits converts base units of `asset` to whole units
+func FromBaseUnits(amount decimal.Decimal, asset string) decimal.Decimal {
+	return amount.Shift(-AssetDecimals[asset])
+}
+
 func ToWei(etherValue float64) (weiValue uint64, err error) {
 	weiString := strconv.FormatFloat(etherValue*1e18, 'f', 0, 64)
 	weiValue, err = strconv.ParseUint(weiString, 10, 64)
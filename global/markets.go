@@ -0,0 +1,115 @@
+package global
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// Market describes a trading pair, how its fills are settled and the instrument rules its orders follow
+type Market struct {
+	Symbol   string  `json:"symbol"`   // e.g. BCLT-ETH
+	Base     string  `json:"base"`     // asset being bought and sold, always quantity denominated
+	Quote    string  `json:"quote"`    // asset fills are settled in. Prices are always quoted in USD
+	Fee      float64 `json:"fee"`      // fraction of the received asset withheld on every fill
+	TickSize float64 `json:"tickSize"` // smallest price increment in USD
+
+	LotSize     float64 `json:"lotSize"`     // smallest quantity increment, quantities are multiples of it
+	MinQuantity float64 `json:"minQuantity"` // smallest quantity of a single order
+	MaxQuantity float64 `json:"maxQuantity"` // largest quantity of a single order
+	MinNotional float64 `json:"minNotional"` // smallest total price (USD) of a single order
+	PriceBand   float64 `json:"priceBand"`   // largest relative distance of an order price from the last trade (or oracle) price
+
+	Matching      string  `json:"matching"`      // how a price level is split between its orders: "fifo" (default), "pro-rata" or "pro-rata-top"
+	TopAllocation float64 `json:"topAllocation"` // fraction of every fill the oldest order of a level gets first with "pro-rata-top"
+}
+
+const DefaultMarket = "BCLT-ETH"
+
+var ErrMarketNotExists = errors.New("market does not exist")
+
+var Markets = map[string]*Market{
+	"BCLT-ETH": {
+		Symbol:   "BCLT-ETH",
+		Base:     "BCLT",
+		Quote:    "ETH",
+		Fee:      0.01,
+		TickSize: 0.01,
+
+		LotSize:     0.01,
+		MinQuantity: 0.01,
+		MaxQuantity: 500,
+		MinNotional: 1,
+		PriceBand:   0.2,
+
+		Matching: "fifo",
+	},
+	"BCLT-USDC": {
+		Symbol:   "BCLT-USDC",
+		Base:     "BCLT",
+		Quote:    "USDC",
+		Fee:      0.01,
+		TickSize: 0.01,
+
+		LotSize:     0.01,
+		MinQuantity: 0.01,
+		MaxQuantity: 500,
+		MinNotional: 1,
+		PriceBand:   0.2,
+
+		Matching: "fifo",
+	},
+}
+
+/*
+GetMarket returns the market registered under `symbol`.
+
+An empty symbol resolves to the DefaultMarket so that orders and requests predating
+multiple markets keep their original meaning.
+*/
+func GetMarket(symbol string) (*Market, error) {
+	if symbol == "" {
+		symbol = DefaultMarket
+	}
+	market, ok := Markets[symbol]
+	if !ok {
+		return nil, ErrMarketNotExists
+	}
+	return market, nil
+}
+
+// AllMarkets returns every registered market ordered by symbol
+func AllMarkets() (markets []*Market) {
+	for _, symbol := range MarketSymbols() {
+		markets = append(markets, Markets[symbol])
+	}
+	return
+}
+
+// MarketSymbols returns every registered market symbol in a stable order
+func MarketSymbols() (symbols []string) {
+	for symbol := range Markets {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return
+}
+
+// QuoteBaseUnits converts a USD amount to base units of the settlement asset at its current USD value
+func (m *Market) QuoteBaseUnits(usd decimal.Decimal) (decimal.Decimal, error) {
+	quoteUSD := m.QuoteUSD()
+	if quoteUSD == 0 {
+		return decimal.Zero, fmt.Errorf("%sUSD is 0", m.Quote)
+	}
+	return ToBaseUnits(usd.DivRound(decimal.NewFromFloat(quoteUSD), AssetDecimals[m.Quote]), m.Quote), nil
+}
+
+// QuoteUSD returns the USD value of one unit of the settlement asset
+func (m *Market) QuoteUSD() float64 {
+	if m.Quote == "ETH" {
+		return Exchange.ETHUSD
+	}
+	return 1
+}
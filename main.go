@@ -36,7 +36,9 @@ func init() {
 	}
 	config.Setup()
 	global.Setup()
-	s3.Setup()
+	if config.ExchangeConfig.SnapshotStore == "s3" {
+		s3.Setup()
+	}
 	db.Setup()
 	orderbook.Setup(false)
 }
@@ -50,15 +52,25 @@ func RouterSetup() *gin.Engine {
 	router.GET("/market-price/:side/:quantity", GetMarketPriceHandler)
 	router.GET("/market-quantity/:side/:maxPrice", GetMarketQuantityHandler)
 	router.GET("/ethusd", GetETHUSDHandler)
+	router.GET("/markets", GetMarketsHandler)
 	router.GET("/orderbook-state", GetCurrentDepthHandler)
 	router.GET("/fireeye-state", FireEyeStatusHandler)
 
 	//Debug mode bypasses server auth
 	exchangeRouter := router.Group("/exchange", internalServerAuth())
-	exchangeRouter.POST("/market/:quote/:slippage", MarketOrderHandler)
-	exchangeRouter.POST("/limit", LimitOrderHandler)
+	exchangeRouter.POST("/market/:quote/:slippage", circuitBreakerGate(), MarketOrderHandler)
+	exchangeRouter.POST("/market-quote/:quote/:slippage", circuitBreakerGate(), MarketQuoteOrderHandler)
+	exchangeRouter.POST("/limit", circuitBreakerGate(), LimitOrderHandler)
+	exchangeRouter.POST("/stop", circuitBreakerGate(), StopOrderHandler)
+	exchangeRouter.POST("/amend", AmendOrderHandler)
 	exchangeRouter.POST("/cancel", CancelOrderHandler)
 	exchangeRouter.POST("/sanitize", SanitizeHandler)
+	exchangeRouter.GET("/trades", GetTradesHandler)
+	exchangeRouter.POST("/reconcile", ReconcileHandler)
+	exchangeRouter.POST("/cancel-only", CancelOnlyHandler)
+	exchangeRouter.GET("/ledger/verify", LedgerVerifyHandler)
+	exchangeRouter.POST("/ledger/rebuild", LedgerRebuildHandler)
+	exchangeRouter.POST("/withdraw", WithdrawHandler)
 	router.NoRoute(func(c *gin.Context) {
 		c.AbortWithStatus(http.StatusNotFound)
 	})
@@ -93,6 +105,7 @@ func main() {
 		gocron.Every(10).Seconds().Do(global.SetExchangeRates)
 		gocron.Every(5).Seconds().Do(fireeye.SyncStatus, context.Background())
 		gocron.Every(30).Seconds().Do(gateway.QueryWallets, context.Background())
+		gocron.Every(5).Seconds().Do(orderbook.ExpireOrders)
 		<-gocron.Start()
 	}()
 
@@ -116,5 +129,6 @@ func main() {
 	if err := srv.Shutdown(ctxterm); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	orderbook.FlushSnapshots()
 	log.Println("Server gracefully shutdown.")
 }
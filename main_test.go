@@ -56,12 +56,17 @@ func TestMarketPriceRoute(t *testing.T) {
 		Side     string  `json:"side"`
 	}{}
 	log.Println(decimal.NewFromInt(testQuantity))
-	priceBuy, opErr := ob.CalculateMarketPrice(ob.Buy, decimal.NewFromInt(testQuantity))
+	book, opErr := ob.GetOrderBook(global.DefaultMarket)
 	if opErr != nil {
 		t.Errorf("Market Price Test Error: %v\n", opErr)
 		return
 	}
-	priceSell, opErr := ob.CalculateMarketPrice(ob.Sell, decimal.NewFromInt(testQuantity))
+	priceBuy, opErr := book.CalculateMarketPrice(ob.Buy, decimal.NewFromInt(testQuantity))
+	if opErr != nil {
+		t.Errorf("Market Price Test Error: %v\n", opErr)
+		return
+	}
+	priceSell, opErr := book.CalculateMarketPrice(ob.Sell, decimal.NewFromInt(testQuantity))
 	if opErr != nil {
 		t.Errorf("Market Price Test Error: %v\n", opErr)
 		return
@@ -5,12 +5,15 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"exchange-engine/fireeye"
+	"exchange-engine/orderbook"
 
 	"github.com/gin-gonic/gin"
 )
@@ -42,6 +45,46 @@ func fireEyeGate() gin.HandlerFunc {
 	}
 }
 
+/*
+circuitBreakerGate blocks new orders for a market while its circuit breaker halts matching,
+or while it only accepts cancellations.
+
+The market is read from the JSON body (or the `market` query parameter) without consuming it,
+in the same way internalServerAuth reads the body for its signature.
+*/
+func circuitBreakerGate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		messageBuffer, err := ioutil.ReadAll(c.Request.Body)
+		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(messageBuffer))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var request struct {
+			Market string `json:"market"`
+		}
+		json.Unmarshal(messageBuffer, &request)
+		if request.Market == "" {
+			request.Market = c.Query("market")
+		}
+		book, err := orderbook.GetOrderBook(request.Market)
+		if err != nil {
+			// unknown markets are rejected by the handlers
+			c.Next()
+			return
+		}
+		if book.CancelOnly() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": orderbook.ErrCancelOnly.Error()})
+			return
+		}
+		if halted, until, reason := book.Breaker().Halted(time.Now()); halted {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": orderbook.ErrTradingHalted.Error(), "reason": reason, "until": until})
+			return
+		}
+		c.Next()
+	}
+}
+
 func validateHMAC(signature, data []byte) bool {
 	authKey := os.Getenv("SERVER_AUTH")
 	mac := hmac.New(sha256.New, []byte(authKey))
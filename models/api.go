@@ -1,6 +1,11 @@
 package models
 
-import "math/big"
+import (
+	"math/big"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
 
 type CurrencyAmounts struct {
 	Bitclout float64 `json:"totalBitclout" bson:"totalBitclout,omitempty" binding:"-"`
@@ -104,3 +109,22 @@ type EthPriceAPIResult struct {
 type SanitizeRequest struct {
 	PublicKey string `json:"publicKey" bson:"publicKey" binding:"required"`
 }
+
+/*
+OrderRequest is the body of a market, limit or stop order. Quantities are whole BitClout and prices USD,
+both sent as decimal strings (plain JSON numbers are accepted too) so no precision is lost on the way in.
+*/
+type OrderRequest struct {
+	Username            string          `json:"username" binding:"required"`
+	Market              string          `json:"market"`
+	OrderSide           string          `json:"orderSide" binding:"required"`
+	OrderQuantity       decimal.Decimal `json:"orderQuantity"`
+	OrderPrice          decimal.Decimal `json:"orderPrice"`
+	DisplayQuantity     decimal.Decimal `json:"displayQuantity"`
+	StopPrice           decimal.Decimal `json:"stopPrice"`
+	TimeInForce         string          `json:"timeInForce"`
+	ExpireTime          time.Time       `json:"expireTime"`
+	PostOnly            bool            `json:"postOnly"`
+	PostOnlyReprice     bool            `json:"postOnlyReprice"`
+	SelfTradePrevention string          `json:"selfTradePrevention"`
+}
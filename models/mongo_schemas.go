@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/shopspring/decimal"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -81,17 +82,104 @@ type OrderSchema struct {
 	Username               string             `json:"username" bson:"username" binding:"required"`
 	Created                time.Time          `json:"created" bson:"created,omitempty" binding:"-"`
 	OrderID                string             `json:"orderID" bson:"orderID" binding:"-"`
+	LegacyOrderID          string             `json:"legacyOrderID,omitempty" bson:"legacyOrderID,omitempty" binding:"-"` // ID the order shared with another before it was re-keyed
+	Market                 string             `json:"market" bson:"market,omitempty" binding:"-"`
 	OrderSide              string             `json:"orderSide" bson:"orderSide" binding:"required"`
 	OrderType              string             `json:"orderType" bson:"orderType" binding:"-"`
-	Fees                   float64            `json:"fees" bson:"fees" binding:"-"`
-	EtherQuantity          float64            `json:"etherQuantity" bson:"etherQuantity" binding:"-"`
-	OrderQuantity          float64            `json:"orderQuantity" bson:"orderQuantity" binding:"required"`
-	OrderPrice             float64            `json:"orderPrice,omitempty" bson:"orderPrice,omitempty" binding:"-"`
-	ExecPrice              float64            `json:"execPrice,omitempty" bson:"execPrice,omitempty" binding:"-"`
-	OrderQuantityProcessed float64            `json:"orderQuantityProcessed" bson:"orderQuantityProcessed" binding:"-"`
+	Fees                   decimal.Decimal    `json:"fees" bson:"fees" binding:"-"`                                       // base units, of BitClout for a buy and of the settlement asset for a sell
+	EtherQuantity          decimal.Decimal    `json:"etherQuantity" bson:"etherQuantity" binding:"-"`                     // base units of the settlement asset traded
+	OrderQuantity          decimal.Decimal    `json:"orderQuantity" bson:"orderQuantity" binding:"-"`                     // nanos, as are all BitClout quantities
+	OrderPrice             decimal.Decimal    `json:"orderPrice,omitempty" bson:"orderPrice,omitempty" binding:"-"`       // USD, as are all prices
+	QuoteQuantity          decimal.Decimal    `json:"quoteQuantity,omitempty" bson:"quoteQuantity,omitempty" binding:"-"` // base units of the settlement asset
+	TimeInForce            string             `json:"timeInForce,omitempty" bson:"timeInForce,omitempty" binding:"-"`
+	ExpireTime             time.Time          `json:"expireTime,omitempty" bson:"expireTime,omitempty" binding:"-"`
+	PostOnly               bool               `json:"postOnly" bson:"postOnly,omitempty" binding:"-"`
+	PostOnlyReprice        bool               `json:"postOnlyReprice" bson:"postOnlyReprice,omitempty" binding:"-"`
+	RequestedPrice         decimal.Decimal    `json:"requestedPrice,omitempty" bson:"requestedPrice,omitempty" binding:"-"`
+	DisplayQuantity        decimal.Decimal    `json:"displayQuantity,omitempty" bson:"displayQuantity,omitempty" binding:"-"`
+	StopPrice              decimal.Decimal    `json:"stopPrice,omitempty" bson:"stopPrice,omitempty" binding:"-"`
+	StopState              string             `json:"stopState,omitempty" bson:"stopState,omitempty" binding:"-"`
+	TriggerPrice           decimal.Decimal    `json:"triggerPrice,omitempty" bson:"triggerPrice,omitempty" binding:"-"`
+	TriggerTime            time.Time          `json:"triggerTime,omitempty" bson:"triggerTime,omitempty" binding:"-"`
+	ExecPrice              decimal.Decimal    `json:"execPrice,omitempty" bson:"execPrice,omitempty" binding:"-"`
+	OrderQuantityProcessed decimal.Decimal    `json:"orderQuantityProcessed" bson:"orderQuantityProcessed" binding:"-"`
 	Complete               bool               `json:"complete" bson:"complete" binding:"-"`
 	Error                  string             `json:"error" bson:"error" binding:"-"`
 	CompleteTime           time.Time          `json:"completeTime" bson:"completeTime,omitempty" binding:"-"`
+	Amendments             []OrderAmendment   `json:"amendments,omitempty" bson:"amendments,omitempty" binding:"-"`
+	SelfTradePrevention    string             `json:"selfTradePrevention,omitempty" bson:"selfTradePrevention,omitempty" binding:"-"`
+	SelfTrades             []SelfTrade        `json:"selfTrades,omitempty" bson:"selfTrades,omitempty" binding:"-"`
+	Held                   decimal.Decimal    `json:"held,omitempty" bson:"held" binding:"-"` // base units of HeldAsset still reserved for the order
+	HeldAsset              string             `json:"heldAsset,omitempty" bson:"heldAsset,omitempty" binding:"-"`
+}
+
+// SelfTrade records how self-trade prevention resolved a match against another order of the same user
+type SelfTrade struct {
+	Time           time.Time       `json:"time" bson:"time"`
+	CounterOrderID string          `json:"counterOrderID" bson:"counterOrderID"`
+	Mode           string          `json:"mode" bson:"mode"`
+	Decrement      decimal.Decimal `json:"decrement,omitempty" bson:"decrement,omitempty"`
+	Cancelled      bool            `json:"cancelled" bson:"cancelled"`
+}
+
+// OrderAmendment records one change to the price or quantity of a resting order
+type OrderAmendment struct {
+	Time             time.Time       `json:"time" bson:"time"`
+	PreviousPrice    decimal.Decimal `json:"previousPrice" bson:"previousPrice"`
+	PreviousQuantity decimal.Decimal `json:"previousQuantity" bson:"previousQuantity"`
+	Price            decimal.Decimal `json:"price" bson:"price"`
+	Quantity         decimal.Decimal `json:"quantity" bson:"quantity"`
+	KeptPriority     bool            `json:"keptPriority" bson:"keptPriority"`
+}
+
+// StopState values of a stop or stop-limit order
+const (
+	StopPending   = "pending"
+	StopTriggered = "triggered"
+	StopCancelled = "cancelled"
+)
+
+// TradeSchema is a single match between a maker and a taker order
+type TradeSchema struct {
+	ID            primitive.ObjectID `json:"_id" bson:"_id,omitempty" binding:"-"`
+	TradeID       string             `json:"tradeID" bson:"tradeID" binding:"-"`
+	Sequence      uint64             `json:"sequence" bson:"sequence" binding:"-"`
+	Market        string             `json:"market" bson:"market" binding:"-"`
+	Side          string             `json:"side" bson:"side" binding:"-"` // side of the taker
+	Price         decimal.Decimal    `json:"price" bson:"price" binding:"-"`
+	Quantity      decimal.Decimal    `json:"quantity" bson:"quantity" binding:"-"`
+	MakerOrderID  string             `json:"makerOrderID" bson:"makerOrderID" binding:"-"`
+	MakerUser     string             `json:"makerUser" bson:"makerUser" binding:"-"`
+	MakerFee      decimal.Decimal    `json:"makerFee" bson:"makerFee" binding:"-"`
+	MakerFeeAsset string             `json:"makerFeeAsset" bson:"makerFeeAsset" binding:"-"`
+	TakerOrderID  string             `json:"takerOrderID" bson:"takerOrderID" binding:"-"`
+	TakerUser     string             `json:"takerUser" bson:"takerUser" binding:"-"`
+	TakerFee      decimal.Decimal    `json:"takerFee" bson:"takerFee" binding:"-"`
+	TakerFeeAsset string             `json:"takerFeeAsset" bson:"takerFeeAsset" binding:"-"`
+	QuoteUSD      float64            `json:"quoteUSD" bson:"quoteUSD" binding:"-"` // USD value of one unit of the settlement asset at the time of the trade
+	Timestamp     time.Time          `json:"timestamp" bson:"timestamp" binding:"-"`
+}
+
+// Kind values of a LedgerEntrySchema
+const (
+	LedgerOpening    = "opening"    // balance a user had before the ledger was introduced
+	LedgerDeposit    = "deposit"    // funds entering the exchange
+	LedgerWithdrawal = "withdrawal" // funds leaving the exchange
+	LedgerTrade      = "trade"      // one side of a fill
+	LedgerFee        = "fee"        // fee a fill paid to the exchange
+)
+
+// LedgerEntrySchema is one leg of a ledger transaction. The legs of a transaction share its TransactionID
+// and their amounts add up to zero for every asset.
+type LedgerEntrySchema struct {
+	ID            primitive.ObjectID `json:"_id" bson:"_id,omitempty" binding:"-"`
+	TransactionID string             `json:"transactionID" bson:"transactionID" binding:"-"`
+	Kind          string             `json:"kind" bson:"kind" binding:"-"`
+	Account       string             `json:"account" bson:"account" binding:"-"`               // "user:<public key>", "fees" or "exchange"
+	Asset         string             `json:"asset" bson:"asset" binding:"-"`                   // named after its field in UserBalance
+	Amount        decimal.Decimal    `json:"amount" bson:"amount" binding:"-"`                 // base units, positive for a credit and negative for a debit
+	Reference     string             `json:"reference" bson:"reference,omitempty" binding:"-"` // trade ID or transaction hash
+	Timestamp     time.Time          `json:"timestamp" bson:"timestamp" binding:"-"`
 }
 
 type UserSchema struct {
@@ -108,10 +196,18 @@ type UserSchema struct {
 }
 
 type UserBalance struct {
-	Bitclout      uint64  `json:"bitclout" bson:"bitclout" binding:"required"`
-	Ether         float64 `json:"ether" bson:"ether" binding:"required"`
-	USDC          uint64  `json:"usdc" bson:"usdc" binding:"required"`
-	InTransaction bool    `json:"in_transaction" bson:"in_transaction" binding:"required"`
+	Bitclout      decimal.Decimal `json:"bitclout" bson:"bitclout" binding:"-"` // nanos
+	Ether         decimal.Decimal `json:"ether" bson:"ether" binding:"-"`       // wei
+	USDC          decimal.Decimal `json:"usdc" bson:"usdc" binding:"-"`         // USDC base units
+	InTransaction bool            `json:"in_transaction" bson:"in_transaction" binding:"required"`
+	Held          HeldBalance     `json:"held" bson:"held" binding:"-"`
+}
+
+// HeldBalance is the part of a UserBalance reserved for open orders, in the same units
+type HeldBalance struct {
+	Bitclout decimal.Decimal `json:"bitclout" bson:"bitclout"`
+	Ether    decimal.Decimal `json:"ether" bson:"ether"`
+	USDC     decimal.Decimal `json:"usdc" bson:"usdc"`
 }
 
 type UserVerification struct {
@@ -0,0 +1,169 @@
+package orderbook
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"exchange-engine/config"
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+// pricePoint is a fill price observed by a CircuitBreaker
+type pricePoint struct {
+	price decimal.Decimal
+	time  time.Time
+}
+
+/*
+CircuitBreaker halts matching on a book for `cooldown` once its price moves more than `move`
+(relative to the lowest price) within `window`.
+
+Fills are observed from the matching loop, while Halted is read by the HTTP handlers, so its
+state is guarded by its own mutex instead of the sequencer.
+*/
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	move     decimal.Decimal
+	window   time.Duration
+	cooldown time.Duration
+
+	prices      []pricePoint
+	haltedUntil time.Time
+	reason      string
+}
+
+// NewCircuitBreaker creates a breaker, a zero `move` disables it
+func NewCircuitBreaker(move float64, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		move:     decimal.NewFromFloat(move),
+		window:   window,
+		cooldown: cooldown,
+	}
+}
+
+// newConfiguredBreaker creates a breaker with the exchange wide settings from config.ExchangeConfig
+func newConfiguredBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(config.ExchangeConfig.BreakerMove, config.ExchangeConfig.BreakerWindow, config.ExchangeConfig.BreakerCooldown)
+}
+
+// observe records a fill at `price` and trips the breaker if the price moved too far within the window
+func (cb *CircuitBreaker) observe(price decimal.Decimal, now time.Time) {
+	if !cb.move.IsPositive() || !price.IsPositive() {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// drop the observations that left the window
+	start := 0
+	for start < len(cb.prices) && now.Sub(cb.prices[start].time) > cb.window {
+		start++
+	}
+	cb.prices = append(cb.prices[start:], pricePoint{price, now})
+
+	low, high := price, price
+	for _, point := range cb.prices {
+		if point.price.LessThan(low) {
+			low = point.price
+		}
+		if point.price.GreaterThan(high) {
+			high = point.price
+		}
+	}
+	if high.Sub(low).Div(low).GreaterThan(cb.move) {
+		cb.haltedUntil = now.Add(cb.cooldown)
+		cb.reason = fmt.Sprintf("price moved from %s to %s within %s", low, high, cb.window)
+		// the move that tripped the breaker must not trip it again once matching resumes
+		cb.prices = nil
+	}
+}
+
+// Halted reports whether matching is halted at `now` and why
+func (cb *CircuitBreaker) Halted(now time.Time) (halted bool, until time.Time, reason string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if now.Before(cb.haltedUntil) {
+		return true, cb.haltedUntil, cb.reason
+	}
+	return false, time.Time{}, ""
+}
+
+// Breaker returns the circuit breaker of the book
+func (ob *OrderBook) Breaker() *CircuitBreaker {
+	return ob.breaker
+}
+
+// halted reports whether the circuit breaker currently pauses matching
+func (ob *OrderBook) halted() bool {
+	halted, _, _ := ob.breaker.Halted(time.Now())
+	return halted
+}
+
+// setLastPrice records a fill at `price` for stop orders, price bands and the circuit breaker
+func (ob *OrderBook) setLastPrice(price decimal.Decimal) {
+	ob.lastPrice = price
+	ob.changes.lastPrice = true
+	ob.breaker.observe(price, time.Now())
+}
+
+// bandReference is the price bands are centered on: the last fill, or the oracle price before anything traded
+func (ob *OrderBook) bandReference() decimal.Decimal {
+	if ob.lastPrice.IsPositive() {
+		return ob.lastPrice
+	}
+	return decimal.NewFromFloat(global.Exchange.CLOUTUSD)
+}
+
+// priceBand returns the lowest and highest price orders may trade at, zero if the market has no band
+func (ob *OrderBook) priceBand() (low, high decimal.Decimal) {
+	band := decimal.NewFromFloat(ob.market.PriceBand)
+	reference := ob.bandReference()
+	if !band.IsPositive() || !reference.IsPositive() {
+		return decimal.Zero, decimal.Zero
+	}
+	one := decimal.New(1, 0)
+	return reference.Mul(one.Sub(band)), reference.Mul(one.Add(band))
+}
+
+// validateBand rejects limit prices outside the price band
+func (ob *OrderBook) validateBand(price decimal.Decimal) error {
+	low, high := ob.priceBand()
+	if high.IsZero() {
+		return nil
+	}
+	if price.LessThan(low) || price.GreaterThan(high) {
+		return ErrPriceOutsideBand
+	}
+	return nil
+}
+
+// bandLimit tightens the worst price a market order of `side` may trade at to the price band.
+// A zero `limitPrice` is unbounded.
+func (ob *OrderBook) bandLimit(side Side, limitPrice decimal.Decimal) decimal.Decimal {
+	low, high := ob.priceBand()
+	if high.IsZero() {
+		return limitPrice
+	}
+	if side == Buy && (limitPrice.IsZero() || high.LessThan(limitPrice)) {
+		return high
+	}
+	if side == Sell && (limitPrice.IsZero() || low.GreaterThan(limitPrice)) {
+		return low
+	}
+	return limitPrice
+}
+
+// beyondLimit reports whether a market order of `side` may not trade at `price`
+func beyondLimit(side Side, price, limitPrice decimal.Decimal) bool {
+	if limitPrice.Sign() <= 0 {
+		return false
+	}
+	if side == Buy {
+		return price.GreaterThan(limitPrice)
+	}
+	return price.LessThan(limitPrice)
+}
@@ -0,0 +1,84 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(0.1, time.Minute, 5*time.Minute)
+	start := time.Now()
+	cb.observe(decimal.New(100, 0), start)
+	cb.observe(decimal.New(109, 0), start.Add(10*time.Second))
+	if halted, _, _ := cb.Halted(start.Add(10 * time.Second)); halted {
+		t.Fatal("Breaker tripped on a 9% move")
+	}
+	// the 100 observation left the window, so 109 -> 115 is within the limit
+	cb.observe(decimal.New(115, 0), start.Add(2*time.Minute))
+	if halted, _, _ := cb.Halted(start.Add(2 * time.Minute)); halted {
+		t.Fatal("Breaker counted a move outside its window")
+	}
+	cb.observe(decimal.New(98, 0), start.Add(2*time.Minute+time.Second))
+	halted, until, _ := cb.Halted(start.Add(2*time.Minute + time.Second))
+	if !halted || !until.Equal(start.Add(7*time.Minute+time.Second)) {
+		t.Fatalf("Breaker did not halt until the end of the cooldown: %v %v", halted, until)
+	}
+	if halted, _, _ := cb.Halted(until); halted {
+		t.Fatal("Breaker still halted after the cooldown")
+	}
+
+	disabled := NewCircuitBreaker(0, time.Minute, time.Minute)
+	disabled.observe(decimal.New(1, 0), start)
+	disabled.observe(decimal.New(100, 0), start)
+	if halted, _, _ := disabled.Halted(start); halted {
+		t.Fatal("Disabled breaker tripped")
+	}
+}
+
+func TestPriceBands(t *testing.T) {
+	ob := NewOrderBook(&global.Market{Symbol: "TEST", PriceBand: 0.2})
+	defer ob.Close()
+	if err := ob.validateBand(decimal.New(1, 0)); err != nil {
+		t.Fatalf("Band enforced without a reference price: %v", err)
+	}
+
+	ob.lastPrice = decimal.New(50, 0)
+	tests := []struct {
+		price int64
+		err   error
+	}{
+		{40, nil},
+		{60, nil},
+		{39, ErrPriceOutsideBand},
+		{61, ErrPriceOutsideBand},
+	}
+	for _, test := range tests {
+		if err := ob.validateBand(decimal.New(test.price, 0)); err != test.err {
+			t.Fatalf("%d: expected %v, got %v", test.price, test.err, err)
+		}
+	}
+	if limit := ob.bandLimit(Buy, decimal.Zero); !limit.Equal(decimal.New(60, 0)) {
+		t.Fatalf("Unprotected buy was limited to %s instead of 60", limit)
+	}
+	if limit := ob.bandLimit(Buy, decimal.New(55, 0)); !limit.Equal(decimal.New(55, 0)) {
+		t.Fatalf("Tighter buy protection was widened to %s", limit)
+	}
+	if limit := ob.bandLimit(Sell, decimal.New(10, 0)); !limit.Equal(decimal.New(40, 0)) {
+		t.Fatalf("Sell protection below the band was not raised to 40, got %s", limit)
+	}
+
+	// Orders are rejected while the breaker halts matching
+	ob.breaker = NewCircuitBreaker(0.1, time.Minute, time.Minute)
+	ob.breaker.observe(decimal.New(50, 0), time.Now())
+	ob.breaker.observe(decimal.New(58, 0), time.Now())
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-halted", "buyer", decimal.New(1, 0), decimal.New(50, 0), LimitOptions{}); err != ErrTradingHalted {
+		t.Fatalf("Expected ErrTradingHalted, got %v", err)
+	}
+	if _, _, _, err := ob.ProcessMarketOrder(Buy, "market-buy-halted", "buyer", decimal.New(1, 0), CancelNewest); err != ErrTradingHalted {
+		t.Fatalf("Expected ErrTradingHalted, got %v", err)
+	}
+}
@@ -4,9 +4,37 @@ import "errors"
 
 // OrderBook erros
 var (
-	ErrInvalidQuantity      = errors.New("orderbook: invalid order quantity")
-	ErrInvalidPrice         = errors.New("orderbook: invalid order price")
-	ErrOrderExists          = errors.New("orderbook: order already exists")
-	ErrOrderNotExists       = errors.New("orderbook: order does not exist")
-	ErrInsufficientQuantity = errors.New("orderbook: insufficient quantity to calculate price")
+	ErrInvalidQuantity            = errors.New("orderbook: invalid order quantity")
+	ErrInvalidPrice               = errors.New("orderbook: invalid order price")
+	ErrOrderExists                = errors.New("orderbook: order already exists")
+	ErrOrderNotExists             = errors.New("orderbook: order does not exist")
+	ErrInsufficientQuantity       = errors.New("orderbook: insufficient quantity to calculate price")
+	ErrMarketNotExists            = errors.New("orderbook: market does not exist")
+	ErrInvalidTimeInForce         = errors.New("orderbook: invalid time in force")
+	ErrInvalidExpireTime          = errors.New("orderbook: good-til-date order requires a future expire time")
+	ErrCannotFillOrKill           = errors.New("orderbook: fill-or-kill order cannot be filled in full")
+	ErrOrderExpired               = errors.New("orderbook: order expired")
+	ErrUnfilledCancelled          = errors.New("orderbook: unfilled quantity cancelled")
+	ErrPostOnlyWouldCross         = errors.New("orderbook: post-only order would cross the book")
+	ErrPostOnlyTimeInForce        = errors.New("orderbook: post-only order must be good-til-cancelled or good-til-date")
+	ErrInvalidStopPrice           = errors.New("orderbook: invalid stop price")
+	ErrStopWouldTrigger           = errors.New("orderbook: stop order would trigger immediately")
+	ErrInvalidDisplayQuantity     = errors.New("orderbook: display quantity must be positive and at most the order quantity")
+	ErrAmendNoChange              = errors.New("orderbook: amendment does not change the order")
+	ErrAmendWouldCross            = errors.New("orderbook: amended order would cross the book")
+	ErrInvalidSelfTradePrevention = errors.New("orderbook: invalid self-trade prevention mode")
+	ErrSelfTrade                  = errors.New("orderbook: self-trade prevented")
+	ErrInvalidTickSize            = errors.New("orderbook: price is not a multiple of the tick size")
+	ErrInvalidLotSize             = errors.New("orderbook: quantity is not a multiple of the lot size")
+	ErrQuantityOutOfRange         = errors.New("orderbook: quantity is outside the market's order limits")
+	ErrMinNotional                = errors.New("orderbook: order value is below the market's minimum notional")
+	ErrPriceOutsideBand           = errors.New("orderbook: price is outside the market's price band")
+	ErrTradingHalted              = errors.New("orderbook: trading is halted by the circuit breaker")
+	ErrInvalidMatcher             = errors.New("orderbook: invalid matching algorithm")
+	ErrPriceProtection            = errors.New("orderbook: remaining quantity is beyond the protection price")
+	ErrInvalidSnapshotStore       = errors.New("orderbook: invalid snapshot store")
+	ErrSnapshotVersion            = errors.New("orderbook: unsupported snapshot version")
+	ErrCancelOnly                 = errors.New("orderbook: market only accepts cancellations")
+	ErrInvalidReconcilePolicy     = errors.New("orderbook: invalid reconciliation policy")
+	ErrReconciled                 = errors.New("orderbook: order cancelled by reconciliation with the database")
 )
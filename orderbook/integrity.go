@@ -0,0 +1,167 @@
+package orderbook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+snapshotVersion is the format version of the snapshots written by this engine.
+
+	1 - the book itself, written before snapshots carried a version
+	2 - the book wrapped with its sequence number and checksum
+*/
+const snapshotVersion = 2
+
+// snapshotEnvelope wraps a serialized book with what is needed to verify it on load
+type snapshotEnvelope struct {
+	Version  int             `json:"version"`
+	Sequence uint64          `json:"sequence"` // last command applied to the book
+	Checksum string          `json:"checksum"` // hex SHA-256 of Book
+	Book     json.RawMessage `json:"book"`
+}
+
+// SnapshotError lists the inconsistencies found in a snapshot that could still be loaded
+type SnapshotError struct {
+	Problems []string
+}
+
+// Error implements error interface
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("orderbook: snapshot failed verification: %s", strings.Join(e.Problems, "; "))
+}
+
+func snapshotChecksum(book []byte) string {
+	sum := sha256.Sum256(book)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeSnapshot wraps the serialized `book` at sequence `sequence`
+func encodeSnapshot(book []byte, sequence uint64) ([]byte, error) {
+	return json.Marshal(&snapshotEnvelope{
+		Version:  snapshotVersion,
+		Sequence: sequence,
+		Checksum: snapshotChecksum(book),
+		Book:     book,
+	})
+}
+
+/*
+decodeSnapshot unwraps a snapshot of any version.
+
+Return:
+	book - The serialized book
+	sequence - The last command applied to the book
+	problems - A checksum mismatch, in which case the book is still returned for verification
+	err - The snapshot cannot be read at all
+*/
+func decodeSnapshot(data []byte) (book []byte, sequence uint64, problems []string, err error) {
+	envelope := snapshotEnvelope{}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, 0, nil, err
+	}
+	switch {
+	case envelope.Version == 0:
+		// version 1 books carry their sequence next to the sides
+		return data, envelope.Sequence, nil, nil
+	case envelope.Version > snapshotVersion:
+		return nil, 0, nil, fmt.Errorf("%w: version %d", ErrSnapshotVersion, envelope.Version)
+	}
+	if checksum := snapshotChecksum(envelope.Book); checksum != envelope.Checksum {
+		problems = append(problems, fmt.Sprintf("checksum is %s, expected %s", checksum, envelope.Checksum))
+	}
+	return envelope.Book, envelope.Sequence, problems, nil
+}
+
+/*
+verify recomputes the order count, depth and per-level volume of the side and checks every order
+sits on the level of its price and side.
+
+The recomputed values replace the stored ones, so a book loaded in cancel-only mode is at least
+consistent with its own orders.
+*/
+func (os *OrderSide) verify(name string, side Side) (problems []string) {
+	numOrders := 0
+	volume := decimal.Zero
+	for key, queue := range os.prices {
+		if key != queue.Price().String() {
+			problems = append(problems, fmt.Sprintf("%s level %s is keyed as %s", name, queue.Price(), key))
+		}
+		if queue.Len() == 0 {
+			problems = append(problems, fmt.Sprintf("%s level %s is empty", name, queue.Price()))
+		}
+		levelVolume := decimal.Zero
+		for e := queue.Head(); e != nil; e = e.Next() {
+			order := e.Value.(*Order)
+			if order.Side() != side {
+				problems = append(problems, fmt.Sprintf("%s order %s is a %s order", name, order.ID(), order.Side()))
+			}
+			if !os.levelPrice(order).Equal(queue.Price()) {
+				problems = append(problems, fmt.Sprintf("%s order %s at %s rests on level %s", name, order.ID(), os.levelPrice(order), queue.Price()))
+			}
+			if order.Quantity().Sign() <= 0 {
+				problems = append(problems, fmt.Sprintf("%s order %s has quantity %s", name, order.ID(), order.Quantity()))
+			}
+			levelVolume = levelVolume.Add(order.Quantity())
+		}
+		if !levelVolume.Equal(queue.volume) {
+			problems = append(problems, fmt.Sprintf("%s level %s has volume %s, expected %s", name, queue.Price(), queue.volume, levelVolume))
+			queue.volume = levelVolume
+		}
+		numOrders += queue.Len()
+		volume = volume.Add(levelVolume)
+	}
+	if numOrders != os.numOrders {
+		problems = append(problems, fmt.Sprintf("%s has %d orders, expected %d", name, numOrders, os.numOrders))
+		os.numOrders = numOrders
+	}
+	if len(os.prices) != os.depth || os.priceTree.Size() != os.depth {
+		problems = append(problems, fmt.Sprintf("%s has %d levels, expected %d", name, len(os.prices), os.depth))
+		os.depth = len(os.prices)
+	}
+	if !volume.Equal(os.volume) {
+		problems = append(problems, fmt.Sprintf("%s has volume %s, expected %s", name, volume, os.volume))
+		os.volume = volume
+	}
+	return
+}
+
+// verify checks the invariants of a book that was just loaded from a snapshot
+func (ob *OrderBook) verify() (problems []string) {
+	problems = append(problems, ob.asks.verify("asks", Sell)...)
+	problems = append(problems, ob.bids.verify("bids", Buy)...)
+	problems = append(problems, ob.stops.buys.verify("buy stops", Buy)...)
+	problems = append(problems, ob.stops.sells.verify("sell stops", Sell)...)
+
+	if ask, bid := ob.asks.MinPriceQueue(), ob.bids.MaxPriceQueue(); ask != nil && bid != nil && bid.Price().GreaterThanOrEqual(ask.Price()) {
+		problems = append(problems, fmt.Sprintf("book is crossed, best bid %s and best ask %s", bid.Price(), ask.Price()))
+	}
+	for _, side := range []*OrderSide{ob.stops.buys, ob.stops.sells} {
+		for _, e := range side.Orders() {
+			if order := e.Value.(*Order); ob.orders[order.ID()] != nil {
+				problems = append(problems, fmt.Sprintf("order %s rests on the book and in the stop book", order.ID()))
+			}
+		}
+	}
+	return
+}
+
+// CancelOnly returns whether the book only accepts cancellations
+func (ob *OrderBook) CancelOnly() bool {
+	return atomic.LoadInt32(&ob.cancelOnly) == 1
+}
+
+// SetCancelOnly stops the book from accepting orders and amendments, cancellations still go through
+func (ob *OrderBook) SetCancelOnly(cancelOnly bool) {
+	var value int32
+	if cancelOnly {
+		value = 1
+	}
+	atomic.StoreInt32(&ob.cancelOnly, value)
+}
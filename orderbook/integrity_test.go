@@ -0,0 +1,97 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestSnapshotIntegrity(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	for i, price := range []int64{50, 50, 52} {
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-"+string(rune('a'+i)), "seller", decimal.New(2, 0), decimal.New(price, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-a", "buyer", decimal.New(3, 0), decimal.New(45, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := snapshotEnvelope{}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Version != snapshotVersion || envelope.Sequence != ob.Sequence() || envelope.Checksum == "" {
+		t.Fatalf("Unexpected snapshot envelope: %s %v", data, err)
+	}
+
+	restored := NewOrderBook(ob.Market())
+	defer restored.Close()
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.asks.Volume().Equal(decimal.New(6, 0)) || !restored.bids.Volume().Equal(decimal.New(3, 0)) || restored.Sequence() != ob.Sequence() {
+		t.Fatalf("Snapshot round trip lost the volumes: %s and %s", restored.asks.Volume(), restored.bids.Volume())
+	}
+
+	// a level whose stored volume disagrees with its orders fails the checksum and verification
+	tampered := strings.Replace(string(data), `"volume":"4"`, `"volume":"5"`, 1)
+	if tampered == string(data) {
+		t.Fatal("Snapshot has no level to tamper with")
+	}
+	err = restored.UnmarshalJSON([]byte(tampered))
+	snapshotErr, ok := err.(*SnapshotError)
+	if !ok || len(snapshotErr.Problems) != 2 || !strings.Contains(snapshotErr.Problems[0], "checksum") || !strings.Contains(snapshotErr.Problems[1], "asks level 50 has volume 5, expected 4") {
+		t.Fatalf("Tampered snapshot was not reported: %v", err)
+	}
+	if level := restored.asks.MinPriceQueue(); !level.Volume().Equal(decimal.New(4, 0)) || !restored.asks.Volume().Equal(decimal.New(6, 0)) {
+		t.Fatalf("Tampered volume was not recomputed: %s", level.Volume())
+	}
+
+	// counts are recomputed from the orders of version 1 snapshots, which carry no checksum
+	legacy := `{"asks":{"numOrders":3,"depth":1,"prices":{"50":{"volume":"2","price":"50","orders":[{"side":"sell","id":"sell-a","owner":"seller","timestamp":"2021-06-29T20:53:20Z","quantity":"2","price":"50"}]}}},` +
+		`"bids":{"numOrders":0,"depth":0,"prices":{}},"sequence":7}`
+	err = restored.UnmarshalJSON([]byte(legacy))
+	if snapshotErr, ok := err.(*SnapshotError); !ok || len(snapshotErr.Problems) != 1 || snapshotErr.Problems[0] != "asks has 1 orders, expected 3" {
+		t.Fatalf("Legacy snapshot order count was not verified: %v", err)
+	}
+	if restored.asks.Len() != 1 || !restored.asks.Volume().Equal(decimal.New(2, 0)) || restored.Sequence() != 7 {
+		t.Fatalf("Unexpected legacy book: %d orders, volume %s, sequence %d", restored.asks.Len(), restored.asks.Volume(), restored.Sequence())
+	}
+
+	if err := restored.UnmarshalJSON([]byte(`{"version":99,"book":{}}`)); !errors.Is(err, ErrSnapshotVersion) {
+		t.Fatalf("Snapshot of an unknown version was loaded: %v", err)
+	}
+}
+
+func TestCancelOnly(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	ob.SetCancelOnly(true)
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-a", "seller", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != ErrCancelOnly {
+		t.Fatalf("Cancel-only book accepted a limit order: %v", err)
+	}
+	if _, _, _, err := ob.ProcessMarketOrder(Buy, "buy-a", "buyer", decimal.New(2, 0), CancelNewest); err != ErrCancelOnly {
+		t.Fatalf("Cancel-only book accepted a market order: %v", err)
+	}
+	if err := ob.ProcessStopOrder(Buy, "stop-a", "buyer", decimal.New(2, 0), decimal.New(60, 0), decimal.Zero, CancelNewest); err != ErrCancelOnly {
+		t.Fatalf("Cancel-only book accepted a stop order: %v", err)
+	}
+
+	// the mode survives a restart
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook(ob.Market())
+	defer restored.Close()
+	if err := restored.UnmarshalJSON(data); err != nil || !restored.CancelOnly() {
+		t.Fatalf("Cancel-only mode was not restored: %v", err)
+	}
+}
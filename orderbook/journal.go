@@ -0,0 +1,314 @@
+package orderbook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"exchange-engine/config"
+
+	"github.com/shopspring/decimal"
+)
+
+// journal operations
+const (
+	journalAppend = "append" // the order joins the tail of its level (or the stop book)
+	journalUpdate = "update" // the order changes in place, keeping its queue position
+	journalRemove = "remove" // the order leaves the book
+)
+
+// journalOp is one change a command made to a single order
+type journalOp struct {
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	Order *Order `json:"order,omitempty"`
+	Stop  bool   `json:"stop,omitempty"` // the order rests in the stop book
+}
+
+/*
+journalEntry holds every change one command made to the book.
+
+Entries describe the resulting state of the orders a command touched rather than the command
+itself, so replaying them never settles a fill against the database a second time.
+*/
+type journalEntry struct {
+	Sequence  uint64          `json:"sequence"`
+	LastPrice decimal.Decimal `json:"lastPrice"`
+	Ops       []journalOp     `json:"ops"`
+}
+
+/*
+Journal is an append-only, fsync'd log of the changes made to one OrderBook.
+
+Every command that changes the book is written and synced before the command returns, so a book
+can be rebuilt after a crash from its last snapshot followed by the journal entries after it.
+
+The fills of a command are settled in the database while it runs, before its entry is written. A crash
+in between loses the entry but not the fills, and OrderBook.RepairSettled applies them again on startup.
+*/
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// journalPath returns where the journal of the book is kept
+func (ob *OrderBook) journalPath() string {
+	return filepath.Join(config.ExchangeConfig.JournalDir, ob.SnapshotName()+".wal")
+}
+
+// OpenJournal opens the journal at `path`, creating it and its directory if they do not exist
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// append writes `entry` and waits until it is on disk
+func (j *Journal) append(entry *journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+/*
+entries reads the journal entries after sequence `after`.
+
+A torn last line, left by a crash in the middle of a write, is ignored: the command it belongs
+to was never acknowledged.
+*/
+func (j *Journal) entries(after uint64) (entries []*journalEntry, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.readEntries(after)
+}
+
+// readEntries reads the entries after sequence `after`, the caller holds j.mu
+func (j *Journal) readEntries(after uint64) (entries []*journalEntry, err error) {
+	file, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				log.Printf("journal %s: ignoring torn entry at line %d\n", j.path, line)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := &journalEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("journal %s line %d: %v", j.path, line, err)
+		}
+		if entry.Sequence > after {
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Compact drops the entries up to sequence `upTo`, which are covered by a snapshot
+func (j *Journal) Compact(upTo uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.readEntries(upTo)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_RDWR, 0600)
+	return err
+}
+
+// journalChanges records the orders the current command changed, in the order they have to be replayed
+type journalChanges struct {
+	touched   map[string]bool // orders changed in place or removed
+	appended  []string        // orders appended to a level, oldest append first
+	lastPrice bool            // whether the command traded
+}
+
+// touch records that the order `orderID` changed in place or left the book
+func (ob *OrderBook) touch(orderID string) {
+	if ob.journal == nil {
+		return
+	}
+	if ob.changes.touched == nil {
+		ob.changes.touched = map[string]bool{}
+	}
+	ob.changes.touched[orderID] = true
+}
+
+// touchAppend records that the order `orderID` joined the tail of a level
+func (ob *OrderBook) touchAppend(orderID string) {
+	if ob.journal == nil {
+		return
+	}
+	for i, id := range ob.changes.appended {
+		if id == orderID {
+			ob.changes.appended = append(ob.changes.appended[:i], ob.changes.appended[i+1:]...)
+			break
+		}
+	}
+	ob.changes.appended = append(ob.changes.appended, orderID)
+}
+
+/*
+commitJournal writes the changes of the command `seq` before it is acknowledged.
+
+A book that can no longer be journaled must not accept further commands, so a failed write stops the process.
+*/
+func (ob *OrderBook) commitJournal(seq uint64) {
+	changes := ob.changes
+	ob.changes = journalChanges{}
+	if ob.journal == nil || (len(changes.touched) == 0 && len(changes.appended) == 0 && !changes.lastPrice) {
+		return
+	}
+
+	appended := map[string]bool{}
+	for _, id := range changes.appended {
+		appended[id] = true
+	}
+	// map order is random, sorting the IDs writes the same entry for the same command every time
+	touched := make([]string, 0, len(changes.touched))
+	for id := range changes.touched {
+		if !appended[id] {
+			touched = append(touched, id)
+		}
+	}
+	sort.Strings(touched)
+	entry := &journalEntry{Sequence: seq, LastPrice: ob.lastPrice}
+	for _, id := range touched {
+		if order := ob.getOrder(id); order != nil {
+			entry.Ops = append(entry.Ops, journalOp{Op: journalUpdate, ID: id, Order: order, Stop: ob.stops.Get(id) != nil})
+		} else {
+			entry.Ops = append(entry.Ops, journalOp{Op: journalRemove, ID: id})
+		}
+	}
+	for _, id := range changes.appended {
+		if order := ob.getOrder(id); order != nil {
+			entry.Ops = append(entry.Ops, journalOp{Op: journalAppend, ID: id, Order: order, Stop: ob.stops.Get(id) != nil})
+		} else {
+			entry.Ops = append(entry.Ops, journalOp{Op: journalRemove, ID: id})
+		}
+	}
+	if err := ob.journal.append(entry); err != nil {
+		log.Panicf("%s: failed to journal command %d: %v", ob.market.Symbol, seq, err)
+	}
+}
+
+// removeAnywhere takes the order `orderID` off the book or the stop book without touching the database
+func (ob *OrderBook) removeAnywhere(orderID string) {
+	if e, ok := ob.orders[orderID]; ok {
+		delete(ob.orders, orderID)
+		ob.restingSide(e.Value.(*Order).Side()).Remove(e)
+	}
+	ob.stops.Remove(orderID)
+}
+
+// replay applies a journal entry to the book
+func (ob *OrderBook) replay(entry *journalEntry) {
+	for _, op := range entry.Ops {
+		switch op.Op {
+		case journalRemove:
+			ob.removeAnywhere(op.ID)
+		case journalUpdate:
+			if e, ok := ob.orders[op.ID]; ok && !op.Stop {
+				ob.restingSide(op.Order.Side()).Update(e, op.Order)
+				continue
+			}
+			fallthrough
+		case journalAppend:
+			ob.removeAnywhere(op.ID)
+			if op.Stop {
+				ob.stops.Append(op.Order)
+			} else {
+				ob.orders[op.ID] = ob.restingSide(op.Order.Side()).Append(op.Order)
+			}
+		}
+	}
+	ob.lastPrice = entry.LastPrice
+	ob.sequence = entry.Sequence
+}
+
+/*
+ReplayJournal rebuilds the changes made after the loaded snapshot from `journal` and journals
+every further command to it.
+
+Return:
+	replayed - The number of journal entries applied
+*/
+func (ob *OrderBook) ReplayJournal(journal *Journal) (replayed int, err error) {
+	ob.submit(func(uint64) {
+		var entries []*journalEntry
+		// the submitted command itself took a sequence number the snapshot never had
+		ob.sequence--
+		entries, err = journal.entries(ob.sequence)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			ob.replay(entry)
+		}
+		replayed = len(entries)
+		ob.journal = journal
+	})
+	return
+}
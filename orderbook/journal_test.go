@@ -0,0 +1,144 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orderbook.wal")
+	market := global.Markets[global.DefaultMarket]
+	ob := NewOrderBook(market)
+	defer ob.Close()
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := ob.ReplayJournal(journal); err != nil || replayed != 0 {
+		t.Fatalf("Replayed %d entries of a new journal (%v)", replayed, err)
+	}
+
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-60", "seller", decimal.New(2, 0), decimal.New(60, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-40", "buyer", decimal.New(2, 0), decimal.New(40, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after the snapshot only survive in the journal
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-iceberg", "seller", decimal.New(10, 0), decimal.New(60, 0), LimitOptions{DisplayQuantity: decimal.New(3, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.ProcessStopOrder(Buy, "buy-stop", "buyer", decimal.New(1, 0), decimal.New(70, 0), decimal.Zero, CancelNewest); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-41", "buyer", decimal.New(1, 0), decimal.New(41, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// rejected commands change nothing and are not journaled
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-41", "buyer", decimal.New(1, 0), decimal.New(41, 0), LimitOptions{}); err != ErrOrderExists {
+		t.Fatalf("Expected ErrOrderExists, got %v", err)
+	}
+	expected, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of a write leaves a torn last line
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"sequence":99,"ops":[{"op":"rem`)
+	file.Close()
+
+	restored := NewOrderBook(market)
+	defer restored.Close()
+	if err := restored.UnmarshalJSON(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := restored.ReplayJournal(reopened)
+	if err != nil || replayed != 3 {
+		t.Fatalf("Expected 3 journal entries after the snapshot, replayed %d (%v)", replayed, err)
+	}
+	actual, err := restored.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rejected command took a sequence number but left no entry
+	if withoutSequence(t, actual) != withoutSequence(t, expected) {
+		t.Fatalf("Replayed book differs:\n%s\nexpected:\n%s", actual, expected)
+	}
+	if restored.Sequence() != ob.Sequence()-1 {
+		t.Fatalf("Replayed book is at sequence %d, expected %d", restored.Sequence(), ob.Sequence()-1)
+	}
+
+	// compacting drops what the snapshot covers
+	if err := reopened.Compact(restored.Sequence() - 1); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := reopened.entries(0); err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 entry after compaction, got %d (%v)", len(entries), err)
+	}
+}
+
+// withoutSequence returns a book snapshot without its sequence number
+func withoutSequence(t *testing.T, snapshot []byte) string {
+	book := map[string]interface{}{}
+	if err := json.Unmarshal(snapshot, &book); err != nil {
+		t.Fatal(err)
+	}
+	delete(book, "sequence")
+	data, err := json.Marshal(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestJournalEntryOrder(t *testing.T) {
+	ob, _ := newTestBook(t)
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "orderbook.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ob.ReplayJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"sell-c", "sell-a", "sell-b"} {
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, id, "seller", decimal.New(1, 0), decimal.New(int64(50+i), 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, err := ob.ProcessMarketOrder(Buy, "buy-sweep", "buyer", decimal.New(3, 0), CancelNewest); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sweep fills sell-c first, its entry lists the orders it took by ID
+	entries, err := journal.entries(0)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("Expected 4 journal entries, got %d (%v)", len(entries), err)
+	}
+	var ids []string
+	for _, op := range entries[3].Ops {
+		ids = append(ids, op.ID)
+	}
+	if len(ids) != 3 || !sort.StringsAreSorted(ids) {
+		t.Fatalf("Sweep was journaled as %v, expected the makers sorted by ID", ids)
+	}
+}
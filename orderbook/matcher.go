@@ -0,0 +1,167 @@
+package orderbook
+
+import (
+	"container/list"
+	"log"
+	"strings"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+// Allocation is the quantity a Matcher assigns to one resting order of a price level
+type Allocation struct {
+	Element  *list.Element
+	Quantity decimal.Decimal
+}
+
+/*
+Matcher decides how an incoming quantity is split across the orders resting at one price level.
+
+Allocate must assign exactly the smaller of `quantity` and the volume of `queue`, in multiples of
+`lot` where possible, and list the allocations in the order they are to be executed. A zero `lot`
+means quantities are unrestricted.
+*/
+type Matcher interface {
+	Allocate(queue *OrderQueue, quantity, lot decimal.Decimal) []Allocation
+	String() string
+}
+
+// FIFO fills the orders of a level strictly by time priority
+type FIFO struct{}
+
+// Allocate implements Matcher
+func (FIFO) Allocate(queue *OrderQueue, quantity, lot decimal.Decimal) (allocations []Allocation) {
+	return allocateByTime(queue, nil, quantity)
+}
+
+func (FIFO) String() string {
+	return "fifo"
+}
+
+// ProRata splits the quantity across the orders of a level in proportion to their size
+type ProRata struct{}
+
+// Allocate implements Matcher
+func (ProRata) Allocate(queue *OrderQueue, quantity, lot decimal.Decimal) []Allocation {
+	return allocateProRata(queue, nil, quantity, lot)
+}
+
+func (ProRata) String() string {
+	return "pro-rata"
+}
+
+// TopOrderProRata first gives the oldest order of a level up to `Share` of the quantity and splits the rest pro-rata
+type TopOrderProRata struct {
+	Share decimal.Decimal
+}
+
+// Allocate implements Matcher
+func (m TopOrderProRata) Allocate(queue *OrderQueue, quantity, lot decimal.Decimal) []Allocation {
+	if quantity.GreaterThanOrEqual(queue.Volume()) {
+		return allocateByTime(queue, nil, quantity)
+	}
+	head := queue.Head()
+	if head == nil {
+		return nil
+	}
+	top := decimal.Min(roundDown(quantity.Mul(m.Share), lot), head.Value.(*Order).Quantity())
+	taken := map[*list.Element]decimal.Decimal{}
+	if top.IsPositive() {
+		taken[head] = top
+	}
+	return allocateProRata(queue, taken, quantity.Sub(top), lot)
+}
+
+func (m TopOrderProRata) String() string {
+	return "pro-rata-top"
+}
+
+/*
+ParseMatcher returns the matching algorithm called `name`.
+
+Arguments:
+	name     - "fifo" (or empty), "pro-rata" or "pro-rata-top"
+	topShare - The fraction of every fill the oldest order of a level gets first with "pro-rata-top"
+*/
+func ParseMatcher(name string, topShare float64) (Matcher, error) {
+	switch strings.ToLower(name) {
+	case "", "fifo":
+		return FIFO{}, nil
+	case "pro-rata":
+		return ProRata{}, nil
+	case "pro-rata-top":
+		share := decimal.NewFromFloat(topShare)
+		if share.Sign() <= 0 || share.GreaterThan(decimal.New(1, 0)) {
+			return nil, ErrInvalidMatcher
+		}
+		return TopOrderProRata{Share: share}, nil
+	}
+	return nil, ErrInvalidMatcher
+}
+
+// roundDown rounds `quantity` down to a multiple of `lot`, or to quantityPrecision if `lot` is zero
+func roundDown(quantity, lot decimal.Decimal) decimal.Decimal {
+	if !lot.IsPositive() {
+		return quantity.Truncate(quantityPrecision)
+	}
+	return quantity.Div(lot).Floor().Mul(lot)
+}
+
+// allocateProRata adds the pro-rata share of `quantity` of every order to `taken` and hands out
+// what rounding left over by time priority
+func allocateProRata(queue *OrderQueue, taken map[*list.Element]decimal.Decimal, quantity, lot decimal.Decimal) []Allocation {
+	if taken == nil {
+		taken = map[*list.Element]decimal.Decimal{}
+	}
+	volume := decimal.Zero
+	for e := queue.Head(); e != nil; e = e.Next() {
+		volume = volume.Add(e.Value.(*Order).Quantity().Sub(taken[e]))
+	}
+	if !volume.IsPositive() {
+		return allocateByTime(queue, taken, decimal.Zero)
+	}
+	if quantity.GreaterThanOrEqual(volume) {
+		return allocateByTime(queue, taken, quantity)
+	}
+	left := quantity
+	for e := queue.Head(); e != nil; e = e.Next() {
+		available := e.Value.(*Order).Quantity().Sub(taken[e])
+		share := decimal.Min(roundDown(quantity.Mul(available).Div(volume), lot), available)
+		if share.IsPositive() {
+			taken[e] = taken[e].Add(share)
+			left = left.Sub(share)
+		}
+	}
+	return allocateByTime(queue, taken, left)
+}
+
+// allocateByTime adds `quantity` to the orders in `taken` by time priority and returns
+// the resulting allocations in queue order
+func allocateByTime(queue *OrderQueue, taken map[*list.Element]decimal.Decimal, quantity decimal.Decimal) (allocations []Allocation) {
+	for e := queue.Head(); e != nil; e = e.Next() {
+		if !quantity.IsPositive() && len(taken) == len(allocations) {
+			break
+		}
+		allocated := taken[e]
+		if quantity.IsPositive() {
+			fill := decimal.Min(quantity, e.Value.(*Order).Quantity().Sub(allocated))
+			allocated = allocated.Add(fill)
+			quantity = quantity.Sub(fill)
+		}
+		if allocated.IsPositive() {
+			allocations = append(allocations, Allocation{Element: e, Quantity: allocated})
+		}
+	}
+	return
+}
+
+// marketMatcher returns the matching algorithm `market` is configured with
+func marketMatcher(market *global.Market) Matcher {
+	matcher, err := ParseMatcher(market.Matching, market.TopAllocation)
+	if err != nil {
+		log.Panicf("%s: %s %q", market.Symbol, err.Error(), market.Matching)
+	}
+	return matcher
+}
@@ -0,0 +1,117 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// allocationQueue creates a level at 50 with one order per quantity, oldest first
+func allocationQueue(quantities ...string) *OrderQueue {
+	queue := NewOrderQueue(decimal.New(50, 0))
+	placed := time.Now()
+	for i, quantity := range quantities {
+		queue.Append(NewOrder(string(rune('a'+i)), "seller", Sell, decimal.RequireFromString(quantity), decimal.New(50, 0), placed.Add(time.Duration(i)*time.Second)))
+	}
+	return queue
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		name     string
+		matcher  Matcher
+		queue    []string
+		quantity string
+		lot      string
+		expected map[string]string
+	}{
+		{"fifo partial", FIFO{}, []string{"3", "5", "2"}, "4", "0.01", map[string]string{"a": "3", "b": "1"}},
+		{"fifo sweep", FIFO{}, []string{"3", "5", "2"}, "20", "0.01", map[string]string{"a": "3", "b": "5", "c": "2"}},
+		{"pro-rata exact", ProRata{}, []string{"2", "6", "2"}, "5", "0.01", map[string]string{"a": "1", "b": "3", "c": "1"}},
+		// 1 lot is split 1/3 each, rounding hands every lot to the oldest order
+		{"pro-rata rounding", ProRata{}, []string{"1", "1", "1"}, "0.01", "0.01", map[string]string{"a": "0.01"}},
+		// 0.033.. rounds down to 0.03 each, the remaining 0.01 goes to the oldest order
+		{"pro-rata residual", ProRata{}, []string{"1", "1", "1"}, "0.1", "0.01", map[string]string{"a": "0.04", "b": "0.03", "c": "0.03"}},
+		{"pro-rata sweep", ProRata{}, []string{"1", "2"}, "5", "0.01", map[string]string{"a": "1", "b": "2"}},
+		// the oldest order takes 40% of 5 first, the other 3 are split over the remaining 0:6:2
+		{"top order", TopOrderProRata{Share: decimal.NewFromFloat(0.4)}, []string{"2", "6", "2"}, "5", "0.01", map[string]string{"a": "2", "b": "2.25", "c": "0.75"}},
+		// the top allocation is capped at the size of the oldest order
+		{"top order capped", TopOrderProRata{Share: decimal.NewFromFloat(0.5)}, []string{"1", "4", "4"}, "4", "0.01", map[string]string{"a": "1", "b": "1.5", "c": "1.5"}},
+	}
+	for _, test := range tests {
+		queue := allocationQueue(test.queue...)
+		allocations := test.matcher.Allocate(queue, decimal.RequireFromString(test.quantity), decimal.RequireFromString(test.lot))
+		if len(allocations) != len(test.expected) {
+			t.Fatalf("%s: expected %d allocations, got %v", test.name, len(test.expected), allocations)
+		}
+		total := decimal.Zero
+		for _, allocation := range allocations {
+			id := allocation.Element.Value.(*Order).ID()
+			if expected := decimal.RequireFromString(test.expected[id]); !allocation.Quantity.Equal(expected) {
+				t.Fatalf("%s: order %s was allocated %s, expected %s", test.name, id, allocation.Quantity, expected)
+			}
+			total = total.Add(allocation.Quantity)
+		}
+		if expected := decimal.Min(decimal.RequireFromString(test.quantity), queue.Volume()); !total.Equal(expected) {
+			t.Fatalf("%s: allocated %s in total, expected %s", test.name, total, expected)
+		}
+	}
+}
+
+func TestParseMatcher(t *testing.T) {
+	for _, name := range []string{"", "fifo", "pro-rata"} {
+		if _, err := ParseMatcher(name, 0); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+	if matcher, err := ParseMatcher("pro-rata-top", 0.4); err != nil || matcher.String() != "pro-rata-top" {
+		t.Fatalf("Expected pro-rata-top, got %v (%v)", matcher, err)
+	}
+	if _, err := ParseMatcher("pro-rata-top", 0); err != ErrInvalidMatcher {
+		t.Fatalf("Expected ErrInvalidMatcher for a zero top allocation, got %v", err)
+	}
+	if _, err := ParseMatcher("lifo", 0); err != ErrInvalidMatcher {
+		t.Fatalf("Expected ErrInvalidMatcher, got %v", err)
+	}
+}
+
+func TestProRataMatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		matcher  Matcher
+		expected map[string]string // filled quantity per maker
+	}{
+		{"pro-rata", ProRata{}, map[string]string{"sell-a": "1", "sell-b": "3", "sell-c": "1"}},
+		{"top order", TopOrderProRata{Share: decimal.NewFromFloat(0.4)}, map[string]string{"sell-a": "2", "sell-b": "2.25", "sell-c": "0.75"}},
+	}
+	for _, test := range tests {
+		ob, store := newTestBook(t)
+		ob.matcher = test.matcher
+		placed := map[string]int64{"sell-a": 2, "sell-b": 6, "sell-c": 2}
+		for _, id := range []string{"sell-a", "sell-b", "sell-c"} {
+			if _, _, _, err := ob.ProcessLimitOrder(Sell, id, "seller", decimal.New(placed[id], 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trades, quantityLeft, _, err := ob.ProcessMarketOrder(Buy, "buy-market", "buyer", decimal.New(5, 0), CancelNewest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !quantityLeft.IsZero() || len(trades) != len(test.expected) || len(store.trades) != len(trades) {
+			t.Fatalf("%s: %d trades (%d settled), %s left", test.name, len(trades), len(store.trades), quantityLeft)
+		}
+		for _, trade := range trades {
+			filled := decimal.RequireFromString(test.expected[trade.MakerOrderID])
+			if !trade.Quantity.Equal(filled) {
+				t.Fatalf("%s: %s filled %s, expected %s", test.name, trade.MakerOrderID, trade.Quantity, filled)
+			}
+			// the rest of every maker keeps resting, a filled one leaves the book
+			left := decimal.New(placed[trade.MakerOrderID], 0).Sub(filled)
+			order := ob.GetOrder(trade.MakerOrderID)
+			if left.IsZero() && order != nil || left.IsPositive() && (order == nil || !order.Quantity().Equal(left)) {
+				t.Fatalf("%s: %s rests as %v, expected %s left", test.name, trade.MakerOrderID, order, left)
+			}
+		}
+	}
+}
@@ -13,23 +13,32 @@ import (
 type Order struct {
 	side      Side
 	id        string
+	owner     string // public key of the user the order belongs to
 	timestamp time.Time
 	quantity  decimal.Decimal
 	price     decimal.Decimal
+	tif       TimeInForce
+	expires   time.Time           // zero unless tif is GoodTilDate
+	stopPrice decimal.Decimal     // zero unless the order is waiting in the StopBook
+	stp       SelfTradePrevention // applied when a triggered stop order matches its owner's resting orders
+	display   decimal.Decimal     // size of each visible slice of an iceberg order, zero otherwise
+	hidden    decimal.Decimal     // iceberg reserve not yet shown on the book
 }
 
 /*
 NewOrder creates new constant object Order
 Arguments:
 	orderID - The ID of the order to create
+	owner - The public key of the user placing the order
 	side - Whether the order is an `ob.Buy` or an `ob.Sell`
 	price - The price at which the order is created
 	timestamp - The time at which the order was created
 	update - Whether to update the database with the order. If update is false, no database calls are created
 */
-func NewOrder(orderID string, side Side, quantity, price decimal.Decimal, timestamp time.Time) *Order {
+func NewOrder(orderID, owner string, side Side, quantity, price decimal.Decimal, timestamp time.Time) *Order {
 	return &Order{
 		id:        orderID,
+		owner:     owner,
 		side:      side,
 		quantity:  quantity,
 		price:     price,
@@ -41,8 +50,26 @@ func NewOrder(orderID string, side Side, quantity, price decimal.Decimal, timest
 // 	err := db.Update()
 // }
 
-func (o *Order) User() string {
-	s := strings.Split(o.id, "-")
+// withQuantity returns a copy of the order with a different remaining quantity
+func (o *Order) withQuantity(quantity decimal.Decimal) *Order {
+	order := *o
+	order.quantity = quantity
+	return &order
+}
+
+// Owner returns the public key of the user the order belongs to
+func (o *Order) Owner() string {
+	return o.owner
+}
+
+// legacyOrderOwner returns the public key embedded in an order ID generated before orders
+// carried their owner (`type-side-publicKey-quantity-millis`).
+// IDs that do not embed one are their own owner, so they never self-trade.
+func legacyOrderOwner(orderID string) string {
+	s := strings.Split(orderID, "-")
+	if len(s) < 3 {
+		return orderID
+	}
 	return s[2]
 }
 
@@ -71,6 +98,96 @@ func (o *Order) Time() time.Time {
 	return o.timestamp
 }
 
+// StopPrice returns stopPrice field copy, zero if the order is not a stop order
+func (o *Order) StopPrice() decimal.Decimal {
+	return o.stopPrice
+}
+
+// IsStop returns whether the order waits for the last price to reach its stop price
+func (o *Order) IsStop() bool {
+	return o.stopPrice.Sign() > 0
+}
+
+// referencePrice returns the limit price, or the stop price of a stop-market order
+func (o *Order) referencePrice() decimal.Decimal {
+	if o.price.IsZero() {
+		return o.stopPrice
+	}
+	return o.price
+}
+
+// DisplayQuantity returns display field copy, zero unless the order is an iceberg
+func (o *Order) DisplayQuantity() decimal.Decimal {
+	return o.display
+}
+
+// HiddenQuantity returns the iceberg reserve that is not shown on the book
+func (o *Order) HiddenQuantity() decimal.Decimal {
+	return o.hidden
+}
+
+// IsIceberg returns whether the order only shows a slice of its quantity
+func (o *Order) IsIceberg() bool {
+	return o.display.Sign() > 0
+}
+
+// TotalQuantity returns the visible and hidden quantity left to trade
+func (o *Order) TotalQuantity() decimal.Decimal {
+	return o.quantity.Add(o.hidden)
+}
+
+// refreshed returns the next visible slice of an iceberg order with a new time priority
+func (o *Order) refreshed(timestamp time.Time) *Order {
+	order := *o
+	order.quantity = decimal.Min(o.display, o.hidden)
+	order.hidden = o.hidden.Sub(order.quantity)
+	order.timestamp = timestamp
+	return &order
+}
+
+/*
+amended returns a copy of the order with a new price and remaining total quantity.
+
+A quantity decrease at the same price keeps time priority (and an iceberg shrinks its reserve first),
+anything else gives it up and takes `timestamp`.
+*/
+func (o *Order) amended(quantity, price decimal.Decimal, timestamp time.Time) (order *Order, keepPriority bool) {
+	amended := *o
+	amended.price = price
+	keepPriority = price.Equal(o.price) && quantity.LessThan(o.TotalQuantity())
+	if keepPriority {
+		amended.hidden = decimal.Max(decimal.Zero, quantity.Sub(o.quantity))
+	} else {
+		amended.timestamp = timestamp
+		amended.hidden = decimal.Zero
+		if o.IsIceberg() && quantity.GreaterThan(o.display) {
+			amended.hidden = quantity.Sub(o.display)
+		}
+	}
+	amended.quantity = quantity.Sub(amended.hidden)
+	return &amended, keepPriority
+}
+
+// SelfTradePrevention returns stp field copy
+func (o *Order) SelfTradePrevention() SelfTradePrevention {
+	return o.stp
+}
+
+// TimeInForce returns tif field copy
+func (o *Order) TimeInForce() TimeInForce {
+	return o.tif
+}
+
+// ExpireTime returns expires field copy, zero if the order never expires
+func (o *Order) ExpireTime() time.Time {
+	return o.expires
+}
+
+// Expired returns whether a good-til-date order has passed its expire time at `now`
+func (o *Order) Expired(now time.Time) bool {
+	return o.tif == GoodTilDate && !o.expires.After(now)
+}
+
 // String implements Stringer interface
 func (o *Order) String() string {
 	return fmt.Sprintf("\n\"%s\":\n\tside: %s\n\tquantity: %s\n\tprice: %s\n\ttime: %s\n", o.ID(), o.Side(), o.Quantity(), o.Price(), o.Time())
@@ -78,19 +195,46 @@ func (o *Order) String() string {
 
 // MarshalJSON implements json.Marshaler interface
 func (o *Order) MarshalJSON() ([]byte, error) {
+	var expires *time.Time
+	if o.tif == GoodTilDate {
+		expires = &o.expires
+	}
+	var stopPrice *decimal.Decimal
+	if o.IsStop() {
+		stopPrice = &o.stopPrice
+	}
+	var display, hidden *decimal.Decimal
+	if o.IsIceberg() {
+		display = &o.display
+		hidden = &o.hidden
+	}
 	return json.Marshal(
 		&struct {
-			S         Side            `json:"side"`
-			ID        string          `json:"id"`
-			Timestamp time.Time       `json:"timestamp"`
-			Quantity  decimal.Decimal `json:"quantity"`
-			Price     decimal.Decimal `json:"price"`
+			S           Side                `json:"side"`
+			ID          string              `json:"id"`
+			Owner       string              `json:"owner"`
+			Timestamp   time.Time           `json:"timestamp"`
+			Quantity    decimal.Decimal     `json:"quantity"`
+			Price       decimal.Decimal     `json:"price"`
+			TimeInForce TimeInForce         `json:"timeInForce,omitempty"`
+			ExpireTime  *time.Time          `json:"expireTime,omitempty"`
+			StopPrice   *decimal.Decimal    `json:"stopPrice,omitempty"`
+			STP         SelfTradePrevention `json:"selfTradePrevention,omitempty"`
+			Display     *decimal.Decimal    `json:"displayQuantity,omitempty"`
+			Hidden      *decimal.Decimal    `json:"hiddenQuantity,omitempty"`
 		}{
-			S:         o.Side(),
-			ID:        o.ID(),
-			Timestamp: o.Time(),
-			Quantity:  o.Quantity(),
-			Price:     o.Price(),
+			S:           o.Side(),
+			ID:          o.ID(),
+			Owner:       o.Owner(),
+			Timestamp:   o.Time(),
+			Quantity:    o.Quantity(),
+			Price:       o.Price(),
+			TimeInForce: o.TimeInForce(),
+			ExpireTime:  expires,
+			StopPrice:   stopPrice,
+			STP:         o.stp,
+			Display:     display,
+			Hidden:      hidden,
 		},
 	)
 }
@@ -98,11 +242,18 @@ func (o *Order) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON implements json.Unmarshaler interface
 func (o *Order) UnmarshalJSON(data []byte) error {
 	obj := struct {
-		S         Side            `json:"side"`
-		ID        string          `json:"id"`
-		Timestamp time.Time       `json:"timestamp"`
-		Quantity  decimal.Decimal `json:"quantity"`
-		Price     decimal.Decimal `json:"price"`
+		S           Side                `json:"side"`
+		ID          string              `json:"id"`
+		Owner       string              `json:"owner"`
+		Timestamp   time.Time           `json:"timestamp"`
+		Quantity    decimal.Decimal     `json:"quantity"`
+		Price       decimal.Decimal     `json:"price"`
+		TimeInForce TimeInForce         `json:"timeInForce"`
+		ExpireTime  *time.Time          `json:"expireTime"`
+		StopPrice   *decimal.Decimal    `json:"stopPrice"`
+		STP         SelfTradePrevention `json:"selfTradePrevention"`
+		Display     *decimal.Decimal    `json:"displayQuantity"`
+		Hidden      *decimal.Decimal    `json:"hiddenQuantity"`
 	}{}
 
 	if err := json.Unmarshal(data, &obj); err != nil {
@@ -111,8 +262,23 @@ func (o *Order) UnmarshalJSON(data []byte) error {
 
 	o.side = obj.S
 	o.id = obj.ID
+	o.owner = obj.Owner
 	o.timestamp = obj.Timestamp
 	o.quantity = obj.Quantity
 	o.price = obj.Price
+	o.tif = obj.TimeInForce
+	if obj.ExpireTime != nil {
+		o.expires = *obj.ExpireTime
+	}
+	if obj.StopPrice != nil {
+		o.stopPrice = *obj.StopPrice
+	}
+	o.stp = obj.STP
+	if obj.Display != nil {
+		o.display = *obj.Display
+	}
+	if obj.Hidden != nil {
+		o.hidden = *obj.Hidden
+	}
 	return nil
 }
@@ -3,56 +3,76 @@ package orderbook
 import (
 	"container/list"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"exchange-engine/config"
+	"exchange-engine/global"
 	"exchange-engine/models"
-	"exchange-engine/s3"
 
 	"github.com/shopspring/decimal"
 )
 
+// quantityPrecision is the number of decimal places quantities are traded in (BCLT nanos)
+const quantityPrecision = 9
+
 // OrderBook implements standard matching algorithm
 type OrderBook struct {
+	market *global.Market
 	orders map[string]*list.Element // orderID -> *Order (*list.Element.Value.(*Order))
 
 	asks *OrderSide
 	bids *OrderSide
-}
 
-var OB = &OrderBook{}
+	stops     *StopBook
+	lastPrice decimal.Decimal // price of the last fill, zero until something trades
+	breaker   *CircuitBreaker
+	matcher   Matcher    // how a price level is split between its resting orders
+	store     OrderStore // where fills, self-trades and order outcomes are recorded
 
-/*
-Initializes the orderbook
+	journal *Journal       // nil unless the book journals its changes
+	changes journalChanges // changes of the command being applied, written to the journal when it completes
 
-Arguments:
-	blank - Whether the orderbook is empty. If false, the orderbook is retrieved from the s3 bucket.
-*/
-func Setup(blank bool) {
-	log.Println("orderbook setup")
-	if !blank {
-		recoverOrderbook := s3.GetOrderbook()
-		if recoverOrderbook != nil {
-			log.Println("unmarshalling fetched orderbook")
-			err := UnmarshalJSON(recoverOrderbook)
-			if err != nil {
-				log.Fatalln("Error loading fetched orderbook")
-			}
-			log.Println(String())
-		}
-	} else {
-		OB = NewOrderBook()
-	}
-	log.Printf("orderbook setup complete\n%v", String())
+	snapshots  *snapshotWriter // nil unless the book is backed up to the snapshot store
+	cancelOnly int32           // set when the book was loaded from a snapshot that failed verification, accessed atomically
+
+	sequence uint64        // last applied command, only touched by the matching loop
+	commands chan *command // feeds the matching loop
+	quit     chan struct{}
+	depth    atomic.Value // *depthSnapshot published after every command
 }
 
-// NewOrderBook creates Orderbook object
-func NewOrderBook() *OrderBook {
-	return &OrderBook{
+// NewOrderBook creates Orderbook object for `market` and starts its matching loop
+func NewOrderBook(market *global.Market) *OrderBook {
+	ob := &OrderBook{
+		market: market,
 		orders: map[string]*list.Element{},
 		bids:   NewOrderSide(),
 		asks:   NewOrderSide(),
+		stops:  NewStopBook(),
+
+		breaker: newConfiguredBreaker(),
+		matcher: marketMatcher(market),
+		store:   dbOrderStore{},
+	}
+	ob.start()
+	return ob
+}
+
+// Market returns the market traded on this book
+func (ob *OrderBook) Market() *global.Market {
+	return ob.market
+}
+
+// SnapshotName returns the name the book is backed up under
+func (ob *OrderBook) SnapshotName() string {
+	if ob.market.Symbol == global.DefaultMarket {
+		return config.S3Config.LogName
 	}
+	return fmt.Sprintf("%s-%s", config.S3Config.LogName, strings.ToLower(ob.market.Symbol))
 }
 
 // PriceLevel contains price and volume in depth
@@ -61,20 +81,106 @@ type PriceLevel struct {
 	Quantity decimal.Decimal `json:"quantity"`
 }
 
+// LimitOptions holds the optional execution instructions of a limit order
+type LimitOptions struct {
+	TimeInForce TimeInForce
+	ExpireTime  time.Time // only used with GoodTilDate
+	PostOnly    bool      // the order must only add liquidity
+	Reprice     bool      // a crossing post-only order is moved one tick behind the best opposite price instead of rejected
+
+	DisplayQuantity decimal.Decimal // zero for a fully visible order, otherwise the iceberg slice size
+
+	SelfTradePrevention SelfTradePrevention // what happens when the order would match a resting order of the same user
+}
+
 // ProcessMarketOrder immediately gets definite quantity from the order book with market price
 // Arguments:
-//      side     - what do you want to do (ob.Sell or ob.Buy)
-//      quantity - how much quantity you want to sell or buy
-//      * to create new decimal number you should use decimal.New() func
+//
+//	side     - what do you want to do (ob.Sell or ob.Buy)
+//	orderID  - ID of the market order, recorded as the taker of its trades
+//	owner    - public key of the user placing the order
+//	quantity - how much quantity you want to sell or buy
+//	stp      - what happens when the order would match a resting order of the same user
+//	* to create new decimal number you should use decimal.New() func
+//
+// Return:
+//
+//	error        - not nil if price is less or equal 0
+//	trades       - every fill of the order, followed by the fills of any stop orders it triggered
+//	quantityLeft - More than zero if there are too few orders to process the `quantity`
+//	fullPrice - The total price of the existing orders fulfilled using `quantity`. Zero if no orders are fulfilled.
+func (ob *OrderBook) ProcessMarketOrder(side Side, orderID, owner string, quantity decimal.Decimal, stp SelfTradePrevention) (trades []Trade, quantityLeft decimal.Decimal, fullPrice decimal.Decimal, err error) {
+	ob.submit(func(uint64) {
+		trades, quantityLeft, fullPrice, err = ob.processMarketOrder(side, orderID, owner, quantity, decimal.Zero, stp)
+		trades = append(trades, ob.triggerStops()...)
+	})
+	return
+}
+
+// ProcessProtectedMarketOrder works like ProcessMarketOrder but never trades at a price worse than `limitPrice`
+// Arguments:
+//
+//	limitPrice - highest price a buy (lowest price a sell) is filled at, see ProtectionPrice
 //
 // Return:
-//      error        - not nil if price is less or equal 0
-//      quantityLeft - More than zero if there are too few orders to process the `quantity`
-//      fullPrice - The total price of the existing orders fulfilled using `quantity`. Zero if no orders are fulfilled.
-func ProcessMarketOrder(side Side, quantity decimal.Decimal) (quantityLeft decimal.Decimal, fullPrice decimal.Decimal, err error) {
+//
+//	quantityLeft - More than zero if the order ran out of orders at or better than `limitPrice`.
+//	               The remainder never rests on the book and has to be cancelled by the caller.
+func (ob *OrderBook) ProcessProtectedMarketOrder(side Side, orderID, owner string, quantity, limitPrice decimal.Decimal, stp SelfTradePrevention) (trades []Trade, quantityLeft decimal.Decimal, fullPrice decimal.Decimal, err error) {
+	if limitPrice.Sign() <= 0 {
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidPrice
+	}
+	ob.submit(func(uint64) {
+		trades, quantityLeft, fullPrice, err = ob.processMarketOrder(side, orderID, owner, quantity, limitPrice, stp)
+		trades = append(trades, ob.triggerStops()...)
+	})
+	return
+}
+
+// ProtectionPrice converts a slippage bound into the worst price a market order may trade at.
+// `quote` is the total price the user expects to pay (receive) for `quantity`.
+func ProtectionPrice(side Side, quantity, quote, slippage decimal.Decimal) (decimal.Decimal, error) {
+	if quantity.Sign() <= 0 {
+		return decimal.Zero, ErrInvalidQuantity
+	}
+	if quote.Sign() <= 0 || slippage.Sign() < 0 {
+		return decimal.Zero, ErrInvalidPrice
+	}
+	price := quote.Div(quantity)
+	if side == Buy {
+		return price.Mul(decimal.New(1, 0).Add(slippage)), nil
+	}
+	price = price.Mul(decimal.New(1, 0).Sub(slippage))
+	if price.Sign() <= 0 {
+		return decimal.Zero, ErrInvalidPrice
+	}
+	return price, nil
+}
+
+// StopProtectionPrice returns the worst price a stop-market order with `stopPrice` may trade at once triggered:
+// the stop price moved by the price band of `market`, or the stop price itself in a market without a band.
+// A buy holds its quantity at this price, so it never costs more than it held.
+func StopProtectionPrice(market *global.Market, side Side, stopPrice decimal.Decimal) decimal.Decimal {
+	band := decimal.NewFromFloat(market.PriceBand)
+	if side == Buy {
+		return stopPrice.Mul(decimal.New(1, 0).Add(band))
+	}
+	return stopPrice.Mul(decimal.New(1, 0).Sub(band))
+}
+
+// processMarketOrder matches `quantity` against the opposite side, stopping at the first level beyond
+// `limitPrice` unless it is zero
+func (ob *OrderBook) processMarketOrder(side Side, orderID, owner string, quantity, limitPrice decimal.Decimal, stp SelfTradePrevention) (trades []Trade, quantityLeft decimal.Decimal, fullPrice decimal.Decimal, err error) {
 	if quantity.Sign() <= 0 {
-		return decimal.Zero, decimal.Zero, ErrInvalidQuantity
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidQuantity
+	}
+	if ob.CancelOnly() {
+		return nil, decimal.Zero, decimal.Zero, ErrCancelOnly
 	}
+	if ob.halted() {
+		return nil, decimal.Zero, decimal.Zero, ErrTradingHalted
+	}
+	limitPrice = ob.bandLimit(side, limitPrice)
 	quantityToTrade := quantity
 	// fullPrice = decimal.Zero
 	var (
@@ -83,50 +189,192 @@ func ProcessMarketOrder(side Side, quantity decimal.Decimal) (quantityLeft decim
 	)
 
 	if side == Buy {
-		iter = OB.asks.MinPriceQueue
-		sideToProcess = OB.asks
+		iter = ob.asks.MinPriceQueue
+		sideToProcess = ob.asks
 	} else {
-		iter = OB.bids.MaxPriceQueue
-		sideToProcess = OB.bids
+		iter = ob.bids.MaxPriceQueue
+		sideToProcess = ob.bids
 	}
 
 	for quantityToTrade.Sign() > 0 && sideToProcess.Len() > 0 {
 		bestPrice := iter()
-		quantityLeft, totalPrice := processQueue(bestPrice, quantityToTrade)
+		if beyondLimit(side, bestPrice.Price(), limitPrice) {
+			break
+		}
+		quantityLeft, totalPrice, levelTrades, cancelled, settleErr := ob.processQueue(bestPrice, orderID, owner, stp, quantityToTrade)
 		fullPrice = fullPrice.Add(totalPrice)
+		trades = append(trades, levelTrades...)
 		quantityToTrade = quantityLeft
+		if err = settleErr; cancelled {
+			break
+		}
 	}
 	quantityLeft = quantityToTrade
 	return
 }
 
+// ProcessQuoteMarketOrder immediately trades against the best prices until `budget` is consumed
+// Arguments:
+//
+//	side    - ob.Buy spends the budget, ob.Sell sells until it has received the budget
+//	orderID - ID of the market order, recorded as the taker of its trades
+//	owner   - public key of the user placing the order
+//	budget      - total price (USD) to trade
+//	maxQuantity - most the order may trade, the quantity its order document and hold were made for
+//	limitPrice  - highest price a buy (lowest price a sell) is filled at, see ProtectionPrice
+//	stp         - what happens when the order would match a resting order of the same user
+//
+// Return:
+//
+//	error      - not nil if budget, maxQuantity or limitPrice is less or equal 0
+//	trades     - every fill of the order, followed by the fills of any stop orders it triggered
+//	budgetLeft - More than zero if there are too few orders at or better than `limitPrice`
+//	             to consume the `budget` within `maxQuantity`
+//	quantity   - The quantity traded for `budget - budgetLeft`
+func (ob *OrderBook) ProcessQuoteMarketOrder(side Side, orderID, owner string, budget, maxQuantity, limitPrice decimal.Decimal, stp SelfTradePrevention) (trades []Trade, budgetLeft decimal.Decimal, quantity decimal.Decimal, err error) {
+	ob.submit(func(uint64) {
+		trades, budgetLeft, quantity, err = ob.processQuoteMarketOrder(side, orderID, owner, budget, maxQuantity, limitPrice, stp)
+		trades = append(trades, ob.triggerStops()...)
+	})
+	return
+}
+
+func (ob *OrderBook) processQuoteMarketOrder(side Side, orderID, owner string, budget, maxQuantity, limitPrice decimal.Decimal, stp SelfTradePrevention) (trades []Trade, budgetLeft decimal.Decimal, quantity decimal.Decimal, err error) {
+	if budget.Sign() <= 0 || maxQuantity.Sign() <= 0 {
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidQuantity
+	}
+	if limitPrice.Sign() <= 0 {
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidPrice
+	}
+	if ob.CancelOnly() {
+		return nil, decimal.Zero, decimal.Zero, ErrCancelOnly
+	}
+	if ob.halted() {
+		return nil, decimal.Zero, decimal.Zero, ErrTradingHalted
+	}
+	limitPrice = ob.bandLimit(side, limitPrice)
+	var (
+		iter          func() *OrderQueue
+		sideToProcess *OrderSide
+	)
+
+	if side == Buy {
+		iter = ob.asks.MinPriceQueue
+		sideToProcess = ob.asks
+	} else {
+		iter = ob.bids.MaxPriceQueue
+		sideToProcess = ob.bids
+	}
+
+	budgetLeft = budget
+	quantity = decimal.Zero
+	for sideToProcess.Len() > 0 && quantity.LessThan(maxQuantity) {
+		bestPrice := iter()
+		if beyondLimit(side, bestPrice.Price(), limitPrice) {
+			break
+		}
+		// Take the whole level if the budget covers it, otherwise as many lots as the rest of the budget buys,
+		// and never more than is left of `maxQuantity`
+		quantityToTrade := bestPrice.Volume()
+		if bestPrice.Price().Mul(quantityToTrade).GreaterThan(budgetLeft) {
+			quantityToTrade = ob.roundLot(budgetLeft.Div(bestPrice.Price()))
+		}
+		if rest := maxQuantity.Sub(quantity); quantityToTrade.GreaterThan(rest) {
+			quantityToTrade = ob.roundLot(rest)
+		}
+		if quantityToTrade.Sign() <= 0 {
+			break
+		}
+		_, totalPrice, levelTrades, cancelled, settleErr := ob.processQueue(bestPrice, orderID, owner, stp, quantityToTrade)
+		budgetLeft = budgetLeft.Sub(totalPrice)
+		quantity = quantity.Add(TakerQuantity(levelTrades, orderID))
+		trades = append(trades, levelTrades...)
+		if err = settleErr; cancelled {
+			break
+		}
+	}
+	return
+}
+
 // ProcessLimitOrder places new order to the OrderBook
 // Arguments:
-//      side     - what do you want to do (ob.Sell or ob.Buy)
-//      orderID  - unique order ID in depth
-//      quantity - how much quantity you want to sell or buy
-//      price    - no more expensive (or cheaper) this price
-//      * to create new decimal number you should use decimal.New() func
+//
+//	side     - what do you want to do (ob.Sell or ob.Buy)
+//	orderID  - unique order ID in depth
+//	owner    - public key of the user placing the order
+//	quantity - how much quantity you want to sell or buy
+//	price    - no more expensive (or cheaper) this price
+//	* to create new decimal number you should use decimal.New() func
 //
 // Return:
-//      error   - not nil if quantity (or price) is less or equal 0. Or if order with given ID is exists
-//      done    - not nil if your order produces ends of anoter order, this order will add to
-//                the "done" slice. If your order have done too, it will be places to this array too
-//      partial - not nil if your order has done but top order is not fully done. Or if your order is
-//                partial done and placed to the orderbook without full quantity - partial will contain
-//                your order with quantity to left
-//      partialQuantityProcessed - if partial order is not nil this result contains processed quatity from partial order
-func ProcessLimitOrder(side Side, orderID string, quantity, price decimal.Decimal) (quantityToTrade decimal.Decimal, fullPrice decimal.Decimal, err error) {
-	if _, ok := OB.orders[orderID]; ok {
-		return decimal.Zero, decimal.Zero, ErrOrderExists
+//
+//	error   - not nil if quantity (or price) is less or equal 0. Or if order with given ID is exists
+//	trades  - every fill of the order, followed by the fills of any stop orders it triggered
+//	done    - not nil if your order produces ends of anoter order, this order will add to
+//	          the "done" slice. If your order have done too, it will be places to this array too
+//	partial - not nil if your order has done but top order is not fully done. Or if your order is
+//	          partial done and placed to the orderbook without full quantity - partial will contain
+//	          your order with quantity to left
+//	partialQuantityProcessed - if partial order is not nil this result contains processed quatity from partial order
+//	opts     - time in force of the order. An unfilled remainder only rests for GoodTilCancelled and GoodTilDate,
+//	           FillOrKill orders are rejected with ErrCannotFillOrKill without touching the book unless they fill in full.
+//	           A DisplayQuantity rests the remainder as an iceberg showing at most that much at a time
+func (ob *OrderBook) ProcessLimitOrder(side Side, orderID, owner string, quantity, price decimal.Decimal, opts LimitOptions) (trades []Trade, quantityToTrade decimal.Decimal, fullPrice decimal.Decimal, err error) {
+	ob.submit(func(uint64) {
+		trades, quantityToTrade, fullPrice, err = ob.processLimitOrder(side, orderID, owner, quantity, price, opts)
+		trades = append(trades, ob.triggerStops()...)
+	})
+	return
+}
+
+func (ob *OrderBook) processLimitOrder(side Side, orderID, owner string, quantity, price decimal.Decimal, opts LimitOptions) (trades []Trade, quantityToTrade decimal.Decimal, fullPrice decimal.Decimal, err error) {
+	if ob.getOrder(orderID) != nil {
+		return nil, decimal.Zero, decimal.Zero, ErrOrderExists
 	}
 
 	if quantity.Sign() <= 0 {
-		return decimal.Zero, decimal.Zero, ErrInvalidQuantity
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidQuantity
 	}
 
 	if price.Sign() <= 0 {
-		return decimal.Zero, decimal.Zero, ErrInvalidPrice
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidPrice
+	}
+
+	if opts.DisplayQuantity.Sign() < 0 || opts.DisplayQuantity.GreaterThan(quantity) {
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidDisplayQuantity
+	}
+
+	if err := ob.validateBand(price); err != nil {
+		return nil, decimal.Zero, decimal.Zero, err
+	}
+
+	if ob.CancelOnly() {
+		return nil, decimal.Zero, decimal.Zero, ErrCancelOnly
+	}
+	if ob.halted() {
+		return nil, decimal.Zero, decimal.Zero, ErrTradingHalted
+	}
+
+	if opts.TimeInForce == GoodTilDate && !opts.ExpireTime.After(time.Now()) {
+		return nil, decimal.Zero, decimal.Zero, ErrInvalidExpireTime
+	}
+
+	if opts.PostOnly {
+		if !opts.TimeInForce.Rests() {
+			return nil, decimal.Zero, decimal.Zero, ErrPostOnlyTimeInForce
+		}
+		postPrice, err := ob.postOnlyPrice(side, price, opts.Reprice)
+		if err != nil {
+			return nil, decimal.Zero, decimal.Zero, err
+		}
+		if !postPrice.Equal(price) {
+			ob.repriceOrder(orderID, price, postPrice)
+			price = postPrice
+		}
+	}
+
+	if opts.TimeInForce == FillOrKill && ob.fillableQuantity(side, owner, price, quantity).LessThan(quantity) {
+		return nil, decimal.Zero, decimal.Zero, ErrCannotFillOrKill
 	}
 
 	quantityToTrade = quantity
@@ -138,100 +386,375 @@ func ProcessLimitOrder(side Side, orderID string, quantity, price decimal.Decima
 	)
 
 	if side == Buy {
-		sideToAdd = OB.bids
-		sideToProcess = OB.asks
+		sideToAdd = ob.bids
+		sideToProcess = ob.asks
 		comparator = price.GreaterThanOrEqual
-		iter = OB.asks.MinPriceQueue
+		iter = ob.asks.MinPriceQueue
 	} else {
-		sideToAdd = OB.asks
-		sideToProcess = OB.bids
+		sideToAdd = ob.asks
+		sideToProcess = ob.bids
 		comparator = price.LessThanOrEqual
-		iter = OB.bids.MaxPriceQueue
+		iter = ob.bids.MaxPriceQueue
 	}
 
 	bestPrice := iter()
+	cancelled := false
 	for quantityToTrade.Sign() > 0 && sideToProcess.Len() > 0 && comparator(bestPrice.Price()) {
-		quantityLeft, totalPrice := processQueue(bestPrice, quantityToTrade)
+		quantityLeft, totalPrice, levelTrades, stopped, settleErr := ob.processQueue(bestPrice, orderID, owner, opts.SelfTradePrevention, quantityToTrade)
 		fullPrice = fullPrice.Add(totalPrice)
+		trades = append(trades, levelTrades...)
 		quantityToTrade = quantityLeft
+		if err = settleErr; stopped {
+			cancelled = true
+			break
+		}
 		bestPrice = iter()
 	}
 
 	//If the given order has exhausted the price depth
-	if quantityToTrade.Sign() > 0 {
-		o := NewOrder(orderID, side, quantityToTrade, price, time.Now().UTC())
-		OB.orders[orderID] = sideToAdd.Append(o)
+	if quantityToTrade.Sign() > 0 && opts.TimeInForce.Rests() && !cancelled {
+		o := NewOrder(orderID, owner, side, quantityToTrade, price, time.Now().UTC())
+		o.tif = opts.TimeInForce
+		if o.tif == GoodTilDate {
+			o.expires = opts.ExpireTime
+		}
+		if opts.DisplayQuantity.Sign() > 0 && quantityToTrade.GreaterThan(opts.DisplayQuantity) {
+			o.display = opts.DisplayQuantity
+			o.hidden = quantityToTrade.Sub(opts.DisplayQuantity)
+			o.quantity = opts.DisplayQuantity
+		}
+		ob.orders[orderID] = sideToAdd.Append(o)
+		ob.touchAppend(orderID)
 	}
 
 	return
 }
 
-func processQueue(orderQueue *OrderQueue, quantityToTrade decimal.Decimal) (quantityLeft decimal.Decimal, totalPrice decimal.Decimal) {
+// ProcessStopOrder places a stop order that is sent to the book once the last traded price reaches `stopPrice`
+// Arguments:
+//
+//	side      - what do you want to do (ob.Sell or ob.Buy)
+//	orderID   - unique order ID in depth
+//	owner     - public key of the user placing the order
+//	quantity  - how much quantity you want to sell or buy
+//	stopPrice - buy stops trigger when the last price rises to it, sell stops when it falls to it
+//	price     - limit price of a stop-limit order, zero for a stop-market order
+//	stp       - self-trade prevention applied once the order triggers
+//
+// Return:
+//
+//	error - not nil if quantity or stopPrice is less or equal 0, the order exists,
+//	        or the last price already triggers it (ErrStopWouldTrigger)
+func (ob *OrderBook) ProcessStopOrder(side Side, orderID, owner string, quantity, stopPrice, price decimal.Decimal, stp SelfTradePrevention) (err error) {
+	ob.submit(func(uint64) {
+		err = ob.processStopOrder(side, orderID, owner, quantity, stopPrice, price, stp)
+	})
+	return
+}
+
+func (ob *OrderBook) processStopOrder(side Side, orderID, owner string, quantity, stopPrice, price decimal.Decimal, stp SelfTradePrevention) error {
+	if ob.getOrder(orderID) != nil {
+		return ErrOrderExists
+	}
+
+	if quantity.Sign() <= 0 {
+		return ErrInvalidQuantity
+	}
+
+	if stopPrice.Sign() <= 0 {
+		return ErrInvalidStopPrice
+	}
+
+	if price.Sign() < 0 {
+		return ErrInvalidPrice
+	}
+
+	if Triggers(side, stopPrice, ob.lastPrice) {
+		return ErrStopWouldTrigger
+	}
+
+	if ob.CancelOnly() {
+		return ErrCancelOnly
+	}
+
+	o := NewOrder(orderID, owner, side, quantity, price, time.Now().UTC())
+	o.stopPrice = stopPrice
+	o.stp = stp
+	ob.stops.Append(o)
+	ob.touchAppend(orderID)
+	return nil
+}
+
+// triggerStops executes every stop order the last price reaches, including those triggered by earlier stops
+func (ob *OrderBook) triggerStops() (trades []Trade) {
+	// pending stops wait until matching resumes and the next fill triggers them
+	if ob.halted() || ob.CancelOnly() {
+		return
+	}
+	for order := ob.stops.Next(ob.lastPrice); order != nil; order = ob.stops.Next(ob.lastPrice) {
+		ob.stops.Remove(order.ID())
+		ob.touch(order.ID())
+		trades = append(trades, ob.executeStop(order)...)
+	}
+	return
+}
+
+/*
+postOnlyPrice returns the price a post-only order may rest at without taking liquidity.
+
+Arguments:
+	side    - The side of the post-only order
+	price   - The requested price
+	reprice - Whether a crossing order is moved one tick behind the best opposite price.
+	          If false a crossing order is rejected with ErrPostOnlyWouldCross.
+*/
+func (ob *OrderBook) postOnlyPrice(side Side, price decimal.Decimal, reprice bool) (decimal.Decimal, error) {
+	tick := ob.tickSize()
+	if side == Buy {
+		best := ob.asks.MinPriceQueue()
+		if best == nil || price.LessThan(best.Price()) {
+			return price, nil
+		}
+		if !reprice {
+			return price, ErrPostOnlyWouldCross
+		}
+		price = best.Price().Sub(tick)
+	} else {
+		best := ob.bids.MaxPriceQueue()
+		if best == nil || price.GreaterThan(best.Price()) {
+			return price, nil
+		}
+		if !reprice {
+			return price, ErrPostOnlyWouldCross
+		}
+		price = best.Price().Add(tick)
+	}
+	if price.Sign() <= 0 {
+		return price, ErrPostOnlyWouldCross
+	}
+	return price, nil
+}
+
+/*
+fillableQuantity returns how much of `quantity` a limit order at `price` can match immediately.
+
+Makers in the crossing levels are validated first, exactly as processQueue would, so that expired
+makers are cancelled up front and cannot make a fill-or-kill order stop half way.
+Resting orders of `user` are never counted since self-trade prevention stops them from matching.
+*/
+func (ob *OrderBook) fillableQuantity(side Side, user string, price, quantity decimal.Decimal) decimal.Decimal {
+	var (
+		level      *OrderQueue
+		iter       func(decimal.Decimal) *OrderQueue
+		comparator func(decimal.Decimal) bool
+	)
+	if side == Buy {
+		level = ob.asks.MinPriceQueue()
+		iter = ob.asks.GreaterThan
+		comparator = price.GreaterThanOrEqual
+	} else {
+		level = ob.bids.MaxPriceQueue()
+		iter = ob.bids.LessThan
+		comparator = price.LessThanOrEqual
+	}
+
+	fillable := decimal.Zero
+	for level != nil && fillable.LessThan(quantity) && comparator(level.Price()) {
+		levelPrice := level.Price()
+		for e := level.Head(); e != nil && fillable.LessThan(quantity); {
+			next := e.Next()
+			if err := ob.validateMaker(e.Value.(*Order)); err != nil {
+				if err = ob.cancelOrder(e.Value.(*Order).ID(), err.Error()); err != nil {
+					log.Println(err.Error())
+				}
+			} else if e.Value.(*Order).Owner() != user {
+				fillable = fillable.Add(e.Value.(*Order).TotalQuantity())
+			}
+			e = next
+		}
+		level = iter(levelPrice)
+	}
+	return fillable
+}
+
+// validateMaker returns why a resting order may not be matched, nil if it may.
+// Its funds are held while it rests, so only its expiry is checked.
+func (ob *OrderBook) validateMaker(order *Order) error {
+	if order.Expired(time.Now()) {
+		return ErrOrderExpired
+	}
+	return nil
+}
+
+/*
+processQueue matches the taker order `takerID` against the resting orders of one price level.
+The level is split between its orders by the book's Matcher.
+
+A maker whose fill cannot be settled is cancelled and the level is matched on without it.
+
+Return:
+	quantityLeft - The taker quantity that is neither filled nor removed by self-trade prevention
+	cancelled    - Whether self-trade prevention, or a fill that could not be settled, cancelled the rest of the taker order
+	err          - Why a fill could not be settled for the taker, the rest of the taker order is cancelled
+*/
+func (ob *OrderBook) processQueue(orderQueue *OrderQueue, takerID, takerOwner string, stp SelfTradePrevention, quantityToTrade decimal.Decimal) (quantityLeft decimal.Decimal, totalPrice decimal.Decimal, trades []Trade, cancelled bool, err error) {
 	totalPrice = decimal.Zero
 	quantityLeft = quantityToTrade
 	for orderQueue.Len() > 0 && quantityLeft.Sign() > 0 {
-		headOrderEl := orderQueue.Head()
-		headOrder := headOrderEl.Value.(*Order)
-		err := validateBalance(headOrder, true)
-		if err == nil {
-			//partial order
-			if quantityLeft.LessThan(headOrder.Quantity()) {
-				// create a new order with the remaining quantity.
-				totalPrice = totalPrice.Add(quantityLeft.Mul(headOrder.Price()))
-				partial := PartialOrder(headOrder.ID(), quantityLeft)
-				log.Printf("Partial price: %s %s", totalPrice.String(), quantityLeft.Mul(headOrder.Price()).String())
-				orderQueue.Update(headOrderEl, partial)
-				quantityLeft = decimal.Zero
-			} else {
-				//full order
-				quantityLeft = quantityLeft.Sub(headOrder.Quantity())
-				totalPrice = totalPrice.Add(headOrder.Quantity().Mul(headOrder.Price()))
-				log.Printf("Complete price: %s %s", totalPrice.String(), headOrder.Quantity().Mul(headOrder.Price()).String())
-				CompleteOrder(headOrder.ID())
+		allocations := ob.matcher.Allocate(orderQueue, quantityLeft, ob.lotSize())
+		for _, allocation := range allocations {
+			order := allocation.Element.Value.(*Order)
+			err := ob.validateMaker(order)
+			if err == nil && order.Owner() == takerOwner {
+				if quantityLeft, cancelled = ob.preventSelfTrade(allocation.Element, takerID, stp, quantityLeft); cancelled {
+					return quantityLeft, totalPrice, trades, true, nil
+				}
+				// the rest of the allocations assumed this order would trade, so allocate again
+				break
+			} else if err != nil {
+				if err = ob.cancelOrder(order.ID(), err.Error()); err != nil {
+					log.Println(err.Error())
+				}
+				break
 			}
-		} else {
-			if err = CancelOrder(headOrder.ID(), err.Error()); err != nil {
-				log.Println(err.Error())
+			trade, err := ob.fillMaker(allocation.Element, takerID, takerOwner, allocation.Quantity)
+			if makerFault(err) {
+				if err = ob.cancelOrder(order.ID(), err.Error()); err != nil {
+					log.Println(err.Error())
+				}
+				break
+			} else if err != nil {
+				// the taker was cancelled by settleTrade
+				return quantityLeft, totalPrice, trades, true, err
 			}
+			quantityLeft = quantityLeft.Sub(allocation.Quantity)
+			totalPrice = totalPrice.Add(allocation.Quantity.Mul(order.Price()))
+			trades = append(trades, trade)
 		}
 	}
 	return
 }
 
-// Order returns order by id
-func GetOrder(orderID string) *Order {
-	e, ok := OB.orders[orderID]
+/*
+fillMaker trades `quantity` of the resting order held by `e` against the taker order `takerID`.
+
+The trade is settled for both orders before the book changes, so a fill that cannot be settled
+leaves the book as it was and returns the error, see settleTrade and makerFault.
+*/
+func (ob *OrderBook) fillMaker(e *list.Element, takerID, takerOwner string, quantity decimal.Decimal) (Trade, error) {
+	order := e.Value.(*Order)
+	trade := ob.newTrade(order, takerID, takerOwner, quantity)
+	if err := ob.settleTrade(trade); err != nil {
+		return trade, err
+	}
+	ob.setLastPrice(order.Price())
+	//partial order
+	if quantity.LessThan(order.Quantity()) {
+		// the order keeps its place with the remaining quantity
+		log.Printf("Partial price: %s", quantity.Mul(order.Price()).String())
+		ob.restingSide(order.Side()).Update(e, order.withQuantity(order.Quantity().Sub(quantity)))
+		ob.touch(order.ID())
+		return trade, nil
+	}
+	//full order
+	log.Printf("Complete price: %s", quantity.Mul(order.Price()).String())
+	if order.HiddenQuantity().Sign() > 0 {
+		ob.refreshOrder(order.ID())
+	} else {
+		ob.completeOrder(order.ID())
+	}
+	return trade, nil
+}
+
+func (ob *OrderBook) completeOrder(orderID string) *Order {
+	e, ok := ob.orders[orderID]
 	if !ok {
 		return nil
 	}
+	delete(ob.orders, orderID)
+	var order *Order
+	if e.Value.(*Order).Side() == Buy {
+		order = ob.bids.Remove(e)
+	} else {
+		order = ob.asks.Remove(e)
+	}
+	ob.touch(orderID)
+	return order
+}
+
+/*
+refreshOrder shows the next slice of an iceberg order from its reserve once the visible slice is filled.
+
+The new slice joins the back of its price level, so every refresh gives up time priority.
+*/
+func (ob *OrderBook) refreshOrder(orderID string) *Order {
+	e, ok := ob.orders[orderID]
+	if !ok {
+		return nil
+	}
+	order := e.Value.(*Order).refreshed(time.Now().UTC())
+	if order.Side() == Buy {
+		ob.bids.Remove(e)
+		ob.orders[orderID] = ob.bids.Append(order)
+	} else {
+		ob.asks.Remove(e)
+		ob.orders[orderID] = ob.asks.Append(order)
+	}
+	ob.touchAppend(orderID)
+	log.Printf("Refreshed iceberg: %s %s shown, %s hidden\n", orderID, order.Quantity(), order.HiddenQuantity())
+	return order
+}
+
+// restingSide returns the side of the book that orders on `side` rest on
+func (ob *OrderBook) restingSide(side Side) *OrderSide {
+	if side == Buy {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// GetOrder returns order by id
+func (ob *OrderBook) GetOrder(orderID string) (order *Order) {
+	ob.query(func() {
+		order = ob.getOrder(orderID)
+	})
+	return
+}
+
+func (ob *OrderBook) getOrder(orderID string) *Order {
+	e, ok := ob.orders[orderID]
+	if !ok {
+		return ob.stops.Get(orderID)
+	}
 	return e.Value.(*Order)
 }
 
+// LastPrice returns the price of the last fill, zero if nothing has traded since startup
+func (ob *OrderBook) LastPrice() (price decimal.Decimal) {
+	ob.query(func() {
+		price = ob.lastPrice
+	})
+	return
+}
+
 // CalculateMarketPrice returns total market price for requested quantity
 // if err is not nil price returns total price of all levels in side
-func CalculateMarketPrice(side Side, quantity decimal.Decimal) (price decimal.Decimal, err error) {
+// Reads the last published depth snapshot and never blocks the matching loop.
+func (ob *OrderBook) CalculateMarketPrice(side Side, quantity decimal.Decimal) (price decimal.Decimal, err error) {
 	price = decimal.Zero
 
-	var (
-		level *OrderQueue
-		iter  func(decimal.Decimal) *OrderQueue
-	)
-
+	snap := ob.snapshot()
+	levels := snap.bids
 	if side == Buy {
-		level = OB.asks.MinPriceQueue()
-		iter = OB.asks.GreaterThan
-	} else {
-		level = OB.bids.MaxPriceQueue()
-		iter = OB.bids.LessThan
+		levels = snap.asks
 	}
 
-	for quantity.Sign() > 0 && level != nil {
-		levelVolume := level.Volume()
-		levelPrice := level.Price()
+	for i := 0; quantity.Sign() > 0 && i < len(levels); i++ {
+		levelVolume := levels[i].Quantity
+		levelPrice := levels[i].Price
 		if quantity.GreaterThanOrEqual(levelVolume) {
 			price = price.Add(levelPrice.Mul(levelVolume))
 			quantity = quantity.Sub(levelVolume)
-			level = iter(levelPrice)
 		} else {
 			price = price.Add(levelPrice.Mul(quantity))
 			quantity = decimal.Zero
@@ -244,31 +767,24 @@ func CalculateMarketPrice(side Side, quantity decimal.Decimal) (price decimal.De
 	return
 }
 
-// CalculateMarketPrice returns total market price for requested quantity
-// if err is not nil price returns total price of all levels in side
-func CalculateMarketQuantity(side Side, maxPrice decimal.Decimal) (quantity decimal.Decimal, err error) {
+// CalculateMarketQuantity returns total quantity purchasable for the requested price
+// Reads the last published depth snapshot and never blocks the matching loop.
+func (ob *OrderBook) CalculateMarketQuantity(side Side, maxPrice decimal.Decimal) (quantity decimal.Decimal, err error) {
 	quantity = decimal.Zero
-	var (
-		level *OrderQueue
-		iter  func(decimal.Decimal) *OrderQueue
-	)
 
+	snap := ob.snapshot()
+	levels := snap.bids
 	if side == Buy {
-		level = OB.asks.MinPriceQueue()
-		iter = OB.asks.GreaterThan
-	} else {
-		level = OB.bids.MaxPriceQueue()
-		iter = OB.bids.LessThan
+		levels = snap.asks
 	}
 
-	for maxPrice.Sign() > 0 && level != nil {
-		levelVolume := level.Volume()
-		levelPrice := level.Price()
+	for i := 0; maxPrice.Sign() > 0 && i < len(levels); i++ {
+		levelVolume := levels[i].Quantity
+		levelPrice := levels[i].Price
 		log.Println(levelPrice, levelVolume)
 		if maxPrice.GreaterThanOrEqual(levelPrice.Mul(levelVolume)) {
 			quantity = quantity.Add(levelVolume)
 			maxPrice = maxPrice.Sub(levelPrice.Mul(levelVolume))
-			level = iter(levelPrice)
 		} else {
 			quantity = quantity.Add(maxPrice.Div(levelPrice))
 			maxPrice = decimal.Zero
@@ -282,25 +798,53 @@ func CalculateMarketQuantity(side Side, maxPrice decimal.Decimal) (quantity deci
 }
 
 // String implements fmt.Stringer interface
-func String() string {
-	return OB.asks.String() + "\r\n------------------------------------" + OB.bids.String()
+func (ob *OrderBook) String() (str string) {
+	ob.query(func() {
+		str = ob.asks.String() + "\r\n------------------------------------" + ob.bids.String()
+	})
+	return
 }
 
 // MarshalJSON implements json.Marshaler interface
-func MarshalJSON() ([]byte, error) {
-	return json.Marshal(
+func (ob *OrderBook) MarshalJSON() (data []byte, err error) {
+	ob.query(func() {
+		data, err = ob.marshalJSON()
+	})
+	return
+}
+
+func (ob *OrderBook) marshalJSON() ([]byte, error) {
+	book, err := json.Marshal(
 		&struct {
-			Asks *OrderSide `json:"asks"`
-			Bids *OrderSide `json:"bids"`
+			Asks       *OrderSide      `json:"asks"`
+			Bids       *OrderSide      `json:"bids"`
+			Stops      *StopBook       `json:"stops"`
+			LastPrice  decimal.Decimal `json:"lastPrice"`
+			CancelOnly bool            `json:"cancelOnly,omitempty"`
 		}{
-			Asks: OB.asks,
-			Bids: OB.bids,
+			Asks:       ob.asks,
+			Bids:       ob.bids,
+			Stops:      ob.stops,
+			LastPrice:  ob.lastPrice,
+			CancelOnly: ob.CancelOnly(),
 		},
 	)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSnapshot(book, ob.sequence)
+}
+
+func (ob *OrderBook) GetOrderbookBytes() (data []byte) {
+	ob.query(func() {
+		data = ob.bytes()
+	})
+	return
 }
 
-func GetOrderbookBytes() (data []byte) {
-	data, err := MarshalJSON()
+// bytes serializes the book from inside the matching loop
+func (ob *OrderBook) bytes() (data []byte) {
+	data, err := ob.marshalJSON()
 	if err != nil {
 		log.Println(err)
 		return
@@ -308,29 +852,27 @@ func GetOrderbookBytes() (data []byte) {
 	return data
 }
 
-func DepthMarshalJSON() (*models.DepthSchema, error) {
-
-	level := OB.asks.MaxPriceQueue()
+// DepthMarshalJSON returns both sides of the book ordered from highest to lowest price.
+// Reads the last published depth snapshot and never blocks the matching loop.
+func (ob *OrderBook) DepthMarshalJSON() (*models.DepthSchema, error) {
+	snap := ob.snapshot()
 	var asks, bids []*models.PriceLevelSchema
-	for level != nil {
-		priceFloat, _ := level.Price().Float64()
-		volumeFloat, _ := level.Volume().Float64()
+	for i := len(snap.asks) - 1; i >= 0; i-- {
+		priceFloat, _ := snap.asks[i].Price.Float64()
+		volumeFloat, _ := snap.asks[i].Quantity.Float64()
 		asks = append(asks, &models.PriceLevelSchema{
 			Price:    priceFloat,
 			Quantity: volumeFloat,
 		})
-		level = OB.asks.LessThan(level.Price())
 	}
 
-	level = OB.bids.MaxPriceQueue()
-	for level != nil {
-		priceFloat, _ := level.Price().Float64()
-		volumeFloat, _ := level.Volume().Float64()
+	for _, level := range snap.bids {
+		priceFloat, _ := level.Price.Float64()
+		volumeFloat, _ := level.Quantity.Float64()
 		bids = append(bids, &models.PriceLevelSchema{
 			Price:    priceFloat,
 			Quantity: volumeFloat,
 		})
-		level = OB.bids.LessThan(level.Price())
 	}
 	return &models.DepthSchema{
 		TimeStamp: time.Now(),
@@ -340,28 +882,87 @@ func DepthMarshalJSON() (*models.DepthSchema, error) {
 
 }
 
-// UnmarshalJSON implements json.Unmarshaler interface
-func UnmarshalJSON(data []byte) error {
+/*
+UnmarshalJSON implements json.Unmarshaler interface.
+
+The order count, depth and volumes of the snapshot are recomputed from its orders. A snapshot
+that fails its checksum or those checks is still loaded, with the recomputed values, and a
+*SnapshotError listing the problems is returned, so the caller can decide whether to run the
+book as it is, in cancel-only mode or refuse to start.
+*/
+func (ob *OrderBook) UnmarshalJSON(data []byte) (err error) {
+	ob.submit(func(uint64) {
+		err = ob.unmarshalJSON(data)
+	})
+	return
+}
+
+func (ob *OrderBook) unmarshalJSON(data []byte) error {
+	book, sequence, problems, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
 	obj := struct {
-		Asks *OrderSide `json:"asks"`
-		Bids *OrderSide `json:"bids"`
+		Asks       *OrderSide      `json:"asks"`
+		Bids       *OrderSide      `json:"bids"`
+		Stops      *StopBook       `json:"stops"`
+		LastPrice  decimal.Decimal `json:"lastPrice"`
+		CancelOnly bool            `json:"cancelOnly"`
 	}{}
 
-	if err := json.Unmarshal(data, &obj); err != nil {
+	if err := json.Unmarshal(book, &obj); err != nil {
 		return err
 	}
 
-	OB.asks = obj.Asks
-	OB.bids = obj.Bids
-	OB.orders = map[string]*list.Element{}
-
-	for _, order := range OB.asks.Orders() {
-		OB.orders[order.Value.(*Order).ID()] = order
+	ob.asks = obj.Asks
+	if ob.asks == nil {
+		ob.asks = NewOrderSide()
 	}
-
-	for _, order := range OB.bids.Orders() {
-		OB.orders[order.Value.(*Order).ID()] = order
+	ob.bids = obj.Bids
+	if ob.bids == nil {
+		ob.bids = NewOrderSide()
+	}
+	ob.orders = map[string]*list.Element{}
+	ob.stops = obj.Stops
+	if ob.stops == nil {
+		ob.stops = NewStopBook()
+	}
+	ob.lastPrice = obj.LastPrice
+	// a book stays cancel-only across restarts until it is lifted
+	ob.SetCancelOnly(obj.CancelOnly)
+	// the journal continues from the command the snapshot was taken at
+	ob.sequence = sequence
+	ob.changes = journalChanges{}
+
+	for _, order := range append(ob.asks.Orders(), ob.bids.Orders()...) {
+		id := order.Value.(*Order).ID()
+		if _, ok := ob.orders[id]; ok {
+			problems = append(problems, fmt.Sprintf("order %s rests on the book twice", id))
+		}
+		ob.orders[id] = order
 	}
 
+	problems = append(problems, ob.verify()...)
+	ob.migrateOwners()
+	if len(problems) > 0 {
+		return &SnapshotError{Problems: problems}
+	}
 	return nil
 }
+
+// migrateOwners assigns an owner to the orders of snapshots written before orders carried one.
+// The next snapshot upload stores the owners, after which the legacy IDs are never parsed again.
+func (ob *OrderBook) migrateOwners() {
+	migrated := 0
+	for _, orders := range []map[string]*list.Element{ob.orders, ob.stops.orders} {
+		for orderID, e := range orders {
+			if order := e.Value.(*Order); order.owner == "" {
+				order.owner = legacyOrderOwner(orderID)
+				migrated++
+			}
+		}
+	}
+	if migrated > 0 {
+		log.Printf("%s: assigned owners to %d orders from a legacy snapshot\n", ob.market.Symbol, migrated)
+	}
+}
@@ -1,127 +1,369 @@
 package orderbook
 
 import (
+	"container/list"
 	"context"
-	"errors"
 	"log"
+	"time"
 
 	"exchange-engine/db"
 	"exchange-engine/global"
-	"exchange-engine/s3"
+	"exchange-engine/models"
 
 	"github.com/shopspring/decimal"
 )
 
+/*
+SanitizeUsersOrders cancels resting orders of the user, in any market, until their balance covers what the rest hold again.
+
+Orders hold their funds from the moment they are placed, so this is only needed after funds left
+the account without the engine releasing the holds on them first.
+*/
 func SanitizeUsersOrders(publicKey string) {
 	orders, err := db.GetUserOrders(context.TODO(), publicKey)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	var orderList []*Order
-	for _, order := range orders {
-		orderFromState := GetOrder(order.OrderID)
-		log.Println(orderFromState, order.OrderID)
-		if orderFromState != nil {
-			orderList = append(orderList, orderFromState)
-		}
+	for _, ob := range Books {
+		ob.submit(func(uint64) {
+			var orderList []*Order
+			for _, order := range orders {
+				orderFromState := ob.getOrder(order.OrderID)
+				log.Println(orderFromState, order.OrderID)
+				if orderFromState != nil {
+					orderList = append(orderList, orderFromState)
+				}
+			}
+			ob.sanitize(orderList)
+		})
 	}
-	Sanitize(orderList)
-	return
 }
 
-func Sanitize(orders []*Order) {
+func (ob *OrderBook) Sanitize(orders []*Order) {
+	ob.submit(func(uint64) {
+		ob.sanitize(orders)
+	})
+}
+
+func (ob *OrderBook) sanitize(orders []*Order) {
 	for _, order := range orders {
 		log.Printf("Validating: %s\n", order.ID())
-		err := validateBalance(order, false)
+		err := ob.validateBalance(order)
 		if err != nil {
 			log.Printf("Validation failed for: %s\n", order.ID())
-			CancelOrder(order.ID(), err.Error())
+			ob.cancelOrder(order.ID(), err.Error())
 		}
 	}
-	go s3.UploadToS3(GetOrderbookBytes())
 }
 
-// internal user balance
-func validateBalance(order *Order, checkInTransaction bool) error {
-	balance, err := db.GetUserBalance(context.TODO(), order.User())
+// validateBalance returns db.ErrInsufficientFunds if the user's balance no longer covers what their orders on the side of `order` hold.
+// The balance is read again for every order, since cancelling one releases its hold.
+func (ob *OrderBook) validateBalance(order *Order) error {
+	balance, err := db.GetUserBalance(context.TODO(), order.Owner())
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	if balance.InTransaction && checkInTransaction {
-		return errors.New("User in transaction while executing.")
-	} else {
-		totalPrice, _ := (order.Price().Mul(order.Quantity())).Float64()
-		totalQuantity, _ := (order.Quantity()).Float64()
-		if order.Side() == Buy {
-			if totalPrice/global.Exchange.ETHUSD <= global.FromWei(balance.Ether) {
-				return nil
-			} else {
-				return errors.New("Insufficient funds.")
-			}
-		} else {
-			if totalQuantity <= global.FromNanos(balance.Bitclout) {
-				return nil
-			} else {
-				return errors.New("Insufficient funds.")
+	if !db.CoversHolds(balance, ob.market, order.Side().String()) {
+		return db.ErrInsufficientFunds
+	}
+	return nil
+}
+
+// ExpireOrders cancels every good-til-date order past its expire time in all markets
+func ExpireOrders() {
+	now := time.Now()
+	for _, ob := range Books {
+		ob.ExpireOrders(now)
+	}
+}
+
+// ExpireOrders cancels every good-til-date order that expired at or before `now`
+func (ob *OrderBook) ExpireOrders(now time.Time) {
+	ob.submit(func(uint64) {
+		for orderID, e := range ob.orders {
+			if e.Value.(*Order).Expired(now) {
+				log.Printf("Expiring: %s\n", orderID)
+				if err := ob.cancelOrder(orderID, ErrOrderExpired.Error()); err != nil {
+					log.Println(err.Error())
+				}
 			}
 		}
+	})
+}
+
+// CancelOrder removes order with given ID from whichever order book it rests on
+func CancelOrder(orderID string, errorString string) error {
+	ob := FindOrderBook(orderID)
+	if ob == nil {
+		ob = Books[global.DefaultMarket]
 	}
+	return ob.CancelOrder(orderID, errorString)
 }
 
 // CancelOrder removes order with given ID from the order book
-func CancelOrder(orderID string, errorString string) error {
-	e, ok := OB.orders[orderID]
-	err := db.CancelCompleteOrder(context.TODO(), orderID, errorString)
+func (ob *OrderBook) CancelOrder(orderID string, errorString string) (err error) {
+	ob.submit(func(uint64) {
+		err = ob.cancelOrder(orderID, errorString)
+	})
+	return
+}
+
+func (ob *OrderBook) cancelOrder(orderID string, errorString string) error {
+	if ob.stops.Remove(orderID) != nil {
+		ob.touch(orderID)
+		if err := ob.store.CancelStopOrder(context.TODO(), orderID, errorString); err != nil {
+			log.Println(err.Error())
+		}
+		return nil
+	}
+	e, ok := ob.orders[orderID]
+	err := ob.store.CancelCompleteOrder(context.TODO(), orderID, errorString)
 	if err != nil {
 		log.Println(err.Error())
 	}
 	if !ok {
 		return ErrOrderNotExists
 	}
-	delete(OB.orders, orderID)
-	go s3.UploadToS3(GetOrderbookBytes())
+	delete(ob.orders, orderID)
 	if e.Value.(*Order).Side() == Buy {
-		OB.bids.Remove(e)
-		return nil
+		ob.bids.Remove(e)
+	} else {
+		ob.asks.Remove(e)
 	}
-	OB.asks.Remove(e)
+	ob.touch(orderID)
 	return nil
 }
 
-func CompleteOrder(orderID string) *Order {
-	e, ok := OB.orders[orderID]
-	if !ok {
-		return nil
+/*
+executeStop sends a triggered stop order to the book and completes it like the market or limit order it becomes,
+returning the trades it produced.
+
+The order must already be removed from the stop book. Its funds were held when it was placed,
+so it is never checked again. A stop-market order only trades up to its StopProtectionPrice, the price
+its hold was made for, and is cancelled if it finds no liquidity within it.
+*/
+func (ob *OrderBook) executeStop(order *Order) (trades []Trade) {
+	log.Printf("Triggering stop: %s at %v\n", order.ID(), ob.lastPrice)
+	if err := ob.store.TriggerStopOrder(context.TODO(), order.ID(), ob.lastPrice); err != nil {
+		log.Println(err.Error())
 	}
-	err := db.CompleteLimitOrderDirect(context.TODO(), orderID)
+	if order.Price().IsZero() {
+		limitPrice := StopProtectionPrice(ob.market, order.Side(), order.StopPrice())
+		trades, _, _, err := ob.processMarketOrder(order.Side(), order.ID(), order.Owner(), order.Quantity(), limitPrice, order.SelfTradePrevention())
+		filled := TakerQuantity(trades, order.ID())
+		if err == nil && filled.IsZero() {
+			err = ErrInsufficientQuantity
+		}
+		if err != nil {
+			ob.store.CancelCompleteOrder(context.TODO(), order.ID(), err.Error())
+			return trades
+		}
+		// the fills were settled as they happened, the unfilled rest of a market order never rests and gives back its hold
+		if err := ob.store.CompleteOrder(context.TODO(), order.ID()); err != nil {
+			log.Println(err.Error())
+		}
+		return trades
+	}
+
+	trades, quantityLeft, _, err := ob.processLimitOrder(order.Side(), order.ID(), order.Owner(), order.Quantity(), order.Price(), LimitOptions{SelfTradePrevention: order.SelfTradePrevention()})
 	if err != nil {
-		go db.CancelCompleteOrder(context.TODO(), orderID, err.Error())
+		ob.store.CancelCompleteOrder(context.TODO(), order.ID(), err.Error())
+		return
 	}
-	delete(OB.orders, orderID)
-	go s3.UploadToS3(GetOrderbookBytes())
-	if e.Value.(*Order).Side() == Buy {
-		return OB.bids.Remove(e)
+	// the fills were settled as they happened and an unfilled rest now rests on the book
+	if quantityLeft.IsZero() {
+		if err := ob.store.CompleteOrder(context.TODO(), order.ID()); err != nil {
+			log.Println(err.Error())
+		}
 	}
-	return OB.asks.Remove(e)
+	return
 }
 
-func PartialOrder(orderID string, quantityDelta decimal.Decimal) *Order {
-	headOrder, ok := OB.orders[orderID]
+/*
+preventSelfTrade resolves a match between the taker order `takerID` and a resting order `e` of the same user
+according to `stp`, without trading. The outcome is recorded on both orders.
+
+Return:
+	quantityLeft - The taker quantity left to match
+	cancelled    - Whether the rest of the taker order is cancelled
+*/
+func (ob *OrderBook) preventSelfTrade(e *list.Element, takerID string, stp SelfTradePrevention, quantityLeft decimal.Decimal) (decimal.Decimal, bool) {
+	maker := e.Value.(*Order)
+	var (
+		cancelMaker, cancelTaker       bool
+		makerDecrement, takerDecrement decimal.Decimal
+	)
+	switch stp {
+	case CancelOldest:
+		cancelMaker = true
+	case CancelBoth:
+		cancelMaker, cancelTaker = true, true
+	case DecrementAndCancel:
+		switch quantityLeft.Cmp(maker.Quantity()) {
+		case -1:
+			makerDecrement, cancelTaker = quantityLeft, true
+		case 1:
+			takerDecrement, cancelMaker = maker.Quantity(), true
+		default:
+			cancelMaker, cancelTaker = true, true
+		}
+	default:
+		cancelTaker = true
+	}
+	log.Printf("Self-trade prevented (%s): %s against %s\n", stp, takerID, maker.ID())
+
+	now := time.Now().UTC()
+	makerDecrementNanos := global.ToBaseUnits(makerDecrement, ob.market.Base)
+	takerDecrementNanos := global.ToBaseUnits(takerDecrement, ob.market.Base)
+	if err := ob.store.RecordSelfTrade(context.TODO(), maker.ID(), models.SelfTrade{Time: now, CounterOrderID: takerID, Mode: stp.String(), Decrement: makerDecrementNanos, Cancelled: cancelMaker}); err != nil {
+		log.Println(err.Error())
+	}
+	if err := ob.store.RecordSelfTrade(context.TODO(), takerID, models.SelfTrade{Time: now, CounterOrderID: maker.ID(), Mode: stp.String(), Decrement: takerDecrementNanos, Cancelled: cancelTaker}); err != nil {
+		log.Println(err.Error())
+	}
+
+	if makerDecrement.Sign() > 0 {
+		ob.restingSide(maker.Side()).Update(e, maker.withQuantity(maker.Quantity().Sub(makerDecrement)))
+		ob.touch(maker.ID())
+	}
+	if cancelMaker {
+		if err := ob.cancelOrder(maker.ID(), ErrSelfTrade.Error()); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if cancelTaker {
+		if err := ob.store.CancelCompleteOrder(context.TODO(), takerID, ErrSelfTrade.Error()); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return quantityLeft.Sub(takerDecrement), cancelTaker
+}
+
+/*
+settleTrade stores `trade` and settles it for both of its orders in one transaction, see db.SettleFill.
+
+If it cannot be settled nothing of it is written. Unless the maker order is at fault, see makerFault,
+the taker order is cancelled with the error rather than trading on against the next maker.
+*/
+func (ob *OrderBook) settleTrade(trade Trade) error {
+	document := &models.TradeSchema{
+		TradeID:      trade.ID,
+		Sequence:     trade.Sequence,
+		Market:       trade.Market,
+		Side:         trade.Side.String(),
+		Price:        trade.Price,
+		Quantity:     global.ToBaseUnits(trade.Quantity, ob.market.Base),
+		MakerOrderID: trade.MakerOrderID,
+		MakerUser:    trade.makerOwner,
+		TakerOrderID: trade.TakerOrderID,
+		TakerUser:    trade.takerOwner,
+		QuoteUSD:     ob.market.QuoteUSD(),
+		Timestamp:    trade.Timestamp,
+	}
+	err := ob.store.SettleFill(context.TODO(), document)
+	if err != nil && !makerFault(err) {
+		log.Printf("Settling %s failed: %v\n", trade, err)
+		if cancelErr := ob.store.CancelCompleteOrder(context.TODO(), trade.TakerOrderID, err.Error()); cancelErr != nil {
+			log.Println(cancelErr.Error())
+		}
+	}
+	return err
+}
+
+// makerFault reports whether a fill could not be settled because of its maker order, which is then cancelled
+// instead of blocking its price level, see db.FillError
+func makerFault(err error) bool {
+	fillErr, ok := err.(*db.FillError)
+	return ok && fillErr.Maker
+}
+
+// AmendOrder changes the price and/or quantity of a resting order in whichever order book it rests on
+func AmendOrder(orderID string, quantity, price decimal.Decimal) (*Order, error) {
+	ob := FindOrderBook(orderID)
+	if ob == nil {
+		return nil, ErrOrderNotExists
+	}
+	return ob.AmendOrder(orderID, quantity, price)
+}
+
+/*
+AmendOrder changes the price and/or quantity of a resting order without cancelling it.
+
+Arguments:
+	orderID  - The ID of the resting order
+	quantity - The new remaining quantity, including any iceberg reserve. Zero keeps the current quantity.
+	price    - The new limit price. Zero keeps the current price.
+Return:
+	order - The order as it now rests on the book. A quantity decrease keeps its place in the queue,
+	        a price change or quantity increase moves it to the back of the new level.
+	err   - ErrAmendWouldCross if the new price would take liquidity, ErrAmendNoChange if nothing changes
+*/
+func (ob *OrderBook) AmendOrder(orderID string, quantity, price decimal.Decimal) (order *Order, err error) {
+	ob.submit(func(uint64) {
+		order, err = ob.amendOrder(orderID, quantity, price)
+	})
+	return
+}
+
+func (ob *OrderBook) amendOrder(orderID string, quantity, price decimal.Decimal) (*Order, error) {
+	e, ok := ob.orders[orderID]
 	if !ok {
-		return nil
+		return nil, ErrOrderNotExists
 	}
-	// Fulfills an order for `quantityDelta`
-	quantityDeltaFloat, _ := quantityDelta.Float64()
-	err := db.PartialLimitOrderDirect(context.TODO(), orderID, quantityDeltaFloat)
-	if err != nil {
-		db.CancelCompleteOrder(context.TODO(), orderID, err.Error())
-		CancelOrder(orderID, err.Error())
+	if ob.CancelOnly() {
+		return nil, ErrCancelOnly
+	}
+	order := e.Value.(*Order)
+	if quantity.IsZero() {
+		quantity = order.TotalQuantity()
+	}
+	if price.IsZero() {
+		price = order.Price()
+	}
+	if quantity.Sign() < 0 {
+		return nil, ErrInvalidQuantity
+	}
+	if price.Sign() < 0 {
+		return nil, ErrInvalidPrice
+	}
+	if quantity.Equal(order.TotalQuantity()) && price.Equal(order.Price()) {
+		return nil, ErrAmendNoChange
+	}
+	if err := ob.ValidateLimitOrder(quantity, price); err != nil {
+		return nil, err
+	}
+	if !price.Equal(order.Price()) {
+		if err := ob.validateBand(price); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := ob.postOnlyPrice(order.Side(), price, false); err != nil {
+		return nil, ErrAmendWouldCross
+	}
+
+	amended, keepPriority := order.amended(quantity, price, time.Now().UTC())
+	if err := ob.store.AmendOrder(context.TODO(), orderID, global.ToBaseUnits(quantity, ob.market.Base), price, keepPriority); err != nil {
+		log.Println(err.Error())
+		return nil, err
 	}
-	// Updates the headOrder to set the REMAINING QUANTITY to add to the OrderBook
-	order := headOrder.Value.(*Order)
-	partialOrder := NewOrder(orderID, order.Side(), order.Quantity().Sub(quantityDelta), order.Price(), order.Time())
 
-	return partialOrder
+	side := ob.restingSide(order.Side())
+	if keepPriority {
+		side.Update(e, amended)
+		ob.touch(orderID)
+	} else {
+		side.Remove(e)
+		ob.orders[orderID] = side.Append(amended)
+		ob.touchAppend(orderID)
+	}
+	return amended, nil
+}
+
+// repriceOrder persists the price a post-only order was moved to before it can be matched at it
+func (ob *OrderBook) repriceOrder(orderID string, requested, price decimal.Decimal) {
+	if err := ob.store.RepriceOrder(context.TODO(), orderID, requested, price); err != nil {
+		log.Println(err.Error())
+	}
 }
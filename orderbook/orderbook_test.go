@@ -1,8 +1,12 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
+
+	"exchange-engine/global"
 
 	"github.com/shopspring/decimal"
 )
@@ -35,13 +39,14 @@ const TEST string = "test"
 func TestPlaceLimitBuyOrders(t *testing.T) {
 	// Create a blank orderbook (clearing the orderbook)
 	Setup(true)
+	ob := Books[global.DefaultMarket]
 	quantity := decimal.New(2, 0)
 	for i := 50; i < 100; i = i + 10 {
-		quantityLeft, fullPrice, err := ProcessLimitOrder(Buy, fmt.Sprintf("buy-%d", i), quantity, decimal.New(int64(i), 0))
+		trades, quantityLeft, fullPrice, err := ob.ProcessLimitOrder(Buy, fmt.Sprintf("buy-%d", i), "buyer", quantity, decimal.New(int64(i), 0), LimitOptions{})
 		if err != nil {
 			t.Fatalf("Could not create or process order %d\n"+err.Error(), i)
 		}
-		if fullPrice.Cmp(decimal.New(0, 0)) != 0 || quantityLeft.Cmp(quantity) != 0 {
+		if len(trades) != 0 || fullPrice.Cmp(decimal.New(0, 0)) != 0 || quantityLeft.Cmp(quantity) != 0 {
 			t.Fatal("OrderBook fulfilled Buy orders with Buy orders (Unexpected behaviour)")
 		}
 	}
@@ -50,15 +55,376 @@ func TestPlaceLimitBuyOrders(t *testing.T) {
 func TestPlaceLimitSellOrders(t *testing.T) {
 	// Create a blank orderbook (clearing the orderbook)
 	Setup(true)
+	ob := Books[global.DefaultMarket]
 	quantity := decimal.New(2, 0)
 
 	for i := 50; i < 100; i = i + 10 {
-		quantityLeft, fullPrice, err := ProcessLimitOrder(Sell, fmt.Sprintf("sell-%d", i), quantity, decimal.New(int64(i), 0))
+		trades, quantityLeft, fullPrice, err := ob.ProcessLimitOrder(Sell, fmt.Sprintf("sell-%d", i), "seller", quantity, decimal.New(int64(i), 0), LimitOptions{})
 		if err != nil {
 			t.Fatalf("Could not create or process order %d\n"+err.Error(), i)
 		}
-		if fullPrice.Cmp(decimal.New(0, 0)) != 0 || quantityLeft.Cmp(quantity) != 0 {
+		if len(trades) != 0 || fullPrice.Cmp(decimal.New(0, 0)) != 0 || quantityLeft.Cmp(quantity) != 0 {
 			t.Fatal("OrderBook fulfilled Sell orders with Sell orders (Unexpected behaviour)")
 		}
 	}
 }
+
+func TestPostOnlyOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	quantity := decimal.New(2, 0)
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-50", "seller", quantity, decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-40", "buyer", quantity, decimal.New(40, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err := ob.ProcessLimitOrder(Buy, "buy-post", "buyer", quantity, decimal.New(50, 0), LimitOptions{PostOnly: true})
+	if err != ErrPostOnlyWouldCross {
+		t.Fatalf("Expected ErrPostOnlyWouldCross, got %v", err)
+	}
+	if ob.GetOrder("buy-post") != nil || ob.GetOrder("sell-50") == nil {
+		t.Fatal("Rejected post-only order modified the book")
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-post", "buyer", quantity, decimal.New(45, 0), LimitOptions{PostOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-post-ioc", "buyer", quantity, decimal.New(45, 0), LimitOptions{PostOnly: true, TimeInForce: ImmediateOrCancel}); err != ErrPostOnlyTimeInForce {
+		t.Fatalf("Expected ErrPostOnlyTimeInForce, got %v", err)
+	}
+
+	// Repricing moves crossing orders one tick behind the best opposite level
+	tests := []struct {
+		side     Side
+		price    int64
+		expected string
+	}{
+		{Buy, 45, "45"},
+		{Buy, 50, "49.99"},
+		{Buy, 70, "49.99"},
+		{Sell, 46, "46"},
+		{Sell, 45, "45.01"},
+		{Sell, 10, "45.01"},
+	}
+	for _, test := range tests {
+		price, err := ob.postOnlyPrice(test.side, decimal.New(test.price, 0), true)
+		if err != nil || price.String() != test.expected {
+			t.Fatalf("Post-only %s at %d repriced to %s %v, expected %s", test.side, test.price, price, err, test.expected)
+		}
+	}
+}
+
+func TestIcebergOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-iceberg", "seller", decimal.New(10, 0), decimal.New(50, 0), LimitOptions{DisplayQuantity: decimal.New(3, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-large-display", "seller", decimal.New(1, 0), decimal.New(50, 0), LimitOptions{DisplayQuantity: decimal.New(2, 0)}); err != ErrInvalidDisplayQuantity {
+		t.Fatalf("Expected ErrInvalidDisplayQuantity, got %v", err)
+	}
+
+	// Only the visible slice is shown in the depth
+	if snap := ob.snapshot(); len(snap.asks) != 1 || !snap.asks[0].Quantity.Equal(decimal.New(3, 0)) {
+		t.Fatalf("Iceberg depth is %v, expected 3 visible", snap.asks)
+	}
+	order := ob.GetOrder("sell-iceberg")
+	if order == nil || !order.HiddenQuantity().Equal(decimal.New(7, 0)) || !order.TotalQuantity().Equal(decimal.New(10, 0)) {
+		t.Fatalf("Iceberg order did not rest with its reserve: %v", order)
+	}
+
+	// Each refresh shows at most the display quantity and takes a new timestamp
+	later := order.Time().Add(time.Second)
+	for _, expected := range []struct{ shown, hidden int64 }{{3, 4}, {3, 1}, {1, 0}} {
+		order = order.refreshed(later)
+		if !order.Quantity().Equal(decimal.New(expected.shown, 0)) || !order.HiddenQuantity().Equal(decimal.New(expected.hidden, 0)) || !order.Time().Equal(later) {
+			t.Fatalf("Refreshed slice is %s shown, %s hidden, expected %d/%d", order.Quantity(), order.HiddenQuantity(), expected.shown, expected.hidden)
+		}
+	}
+
+	// The reserve must survive a snapshot round trip
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook(ob.Market())
+	t.Cleanup(restored.Close)
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if order := restored.GetOrder("sell-iceberg"); order == nil || !order.DisplayQuantity().Equal(decimal.New(3, 0)) || !order.HiddenQuantity().Equal(decimal.New(7, 0)) {
+		t.Fatalf("Iceberg order was not restored from the snapshot: %v", order)
+	}
+}
+
+func TestIcebergRefreshAfterFill(t *testing.T) {
+	ob, _ := newTestBook(t)
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-iceberg", "seller", decimal.New(10, 0), decimal.New(50, 0), LimitOptions{DisplayQuantity: decimal.New(3, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-behind", "other", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// filling the visible slice shows the next one from the reserve
+	trades, _, _, err := ob.ProcessMarketOrder(Buy, "buy-slice", "buyer", decimal.New(3, 0), CancelNewest)
+	if err != nil || len(trades) != 1 || trades[0].MakerOrderID != "sell-iceberg" {
+		t.Fatalf("Unexpected fills of the first slice: %v %v", trades, err)
+	}
+	order := ob.GetOrder("sell-iceberg")
+	if order == nil || !order.Quantity().Equal(decimal.New(3, 0)) || !order.HiddenQuantity().Equal(decimal.New(4, 0)) {
+		t.Fatalf("Iceberg was not refreshed: %v", order)
+	}
+	if snap := ob.snapshot(); len(snap.asks) != 1 || !snap.asks[0].Quantity.Equal(decimal.New(5, 0)) {
+		t.Fatalf("Depth after the refresh is %v, expected 5 visible", snap.asks)
+	}
+
+	// the refreshed slice queues behind the order that rested after the iceberg
+	trades, _, _, err = ob.ProcessMarketOrder(Buy, "buy-behind", "buyer", decimal.New(3, 0), CancelNewest)
+	if err != nil || len(trades) != 2 || trades[0].MakerOrderID != "sell-behind" || trades[1].MakerOrderID != "sell-iceberg" || !trades[1].Quantity.Equal(decimal.New(1, 0)) {
+		t.Fatalf("Refreshed slice kept its time priority: %v %v", trades, err)
+	}
+
+	// a sweep takes every slice until the reserve is gone
+	trades, quantityLeft, _, err := ob.ProcessMarketOrder(Buy, "buy-sweep", "buyer", decimal.New(10, 0), CancelNewest)
+	if err != nil || !quantityLeft.Equal(decimal.New(4, 0)) {
+		t.Fatalf("Sweep left %s (%v), expected 4", quantityLeft, err)
+	}
+	for i, expected := range []int64{2, 3, 1} {
+		if i >= len(trades) || trades[i].MakerOrderID != "sell-iceberg" || !trades[i].Quantity.Equal(decimal.New(expected, 0)) {
+			t.Fatalf("Sweep fills are %v, expected slices of 2, 3 and 1", trades)
+		}
+	}
+	if len(trades) != 3 || ob.GetOrder("sell-iceberg") != nil {
+		t.Fatalf("Iceberg is still on the book after its reserve was filled: %v", trades)
+	}
+}
+
+func TestAmendOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-50", "seller", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-40", "buyer", decimal.New(2, 0), decimal.New(40, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ob.AmendOrder("buy-missing", decimal.New(1, 0), decimal.Zero); err != ErrOrderNotExists {
+		t.Fatalf("Expected ErrOrderNotExists, got %v", err)
+	}
+	if _, err := ob.AmendOrder("buy-40", decimal.New(2, 0), decimal.New(40, 0)); err != ErrAmendNoChange {
+		t.Fatalf("Expected ErrAmendNoChange, got %v", err)
+	}
+	if _, err := ob.AmendOrder("buy-40", decimal.Zero, decimal.New(50, 0)); err != ErrAmendWouldCross {
+		t.Fatalf("Expected ErrAmendWouldCross, got %v", err)
+	}
+	if order := ob.GetOrder("buy-40"); order == nil || !order.Price().Equal(decimal.New(40, 0)) {
+		t.Fatal("Rejected amendment modified the book")
+	}
+
+	// Decreases keep priority, price changes and increases do not
+	placed := time.Now()
+	later := placed.Add(time.Second)
+	order := NewOrder("buy-amend", "buyer", Buy, decimal.New(5, 0), decimal.New(40, 0), placed)
+	tests := []struct {
+		quantity, price int64
+		keepPriority    bool
+	}{
+		{3, 40, true},
+		{6, 40, false},
+		{3, 41, false},
+	}
+	for _, test := range tests {
+		amended, keepPriority := order.amended(decimal.New(test.quantity, 0), decimal.New(test.price, 0), later)
+		if keepPriority != test.keepPriority || amended.Time().Equal(placed) != test.keepPriority {
+			t.Fatalf("Amending to %d @ %d kept priority %v, expected %v", test.quantity, test.price, keepPriority, test.keepPriority)
+		}
+		if !amended.Quantity().Equal(decimal.New(test.quantity, 0)) || !amended.Price().Equal(decimal.New(test.price, 0)) {
+			t.Fatalf("Amended order is %s @ %s, expected %d @ %d", amended.Quantity(), amended.Price(), test.quantity, test.price)
+		}
+	}
+
+	// Iceberg decreases come out of the hidden reserve first
+	iceberg := order.withQuantity(decimal.New(2, 0))
+	iceberg.display = decimal.New(2, 0)
+	iceberg.hidden = decimal.New(6, 0)
+	amended, keepPriority := iceberg.amended(decimal.New(5, 0), iceberg.Price(), later)
+	if !keepPriority || !amended.Quantity().Equal(decimal.New(2, 0)) || !amended.HiddenQuantity().Equal(decimal.New(3, 0)) {
+		t.Fatalf("Amended iceberg is %s shown, %s hidden", amended.Quantity(), amended.HiddenQuantity())
+	}
+}
+
+func TestAmendOrdersThroughStore(t *testing.T) {
+	ob, store := newTestBook(t)
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-45", "asker", decimal.New(2, 0), decimal.New(45, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, orderID := range []string{"buy-first", "buy-second"} {
+		if _, _, _, err := ob.ProcessLimitOrder(Buy, orderID, "buyer", decimal.New(2, 0), decimal.New(40, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a failed write leaves the book as it was
+	store.amendErr = errors.New("write failed")
+	if _, err := ob.AmendOrder("buy-first", decimal.Zero, decimal.New(39, 0)); err != store.amendErr {
+		t.Fatalf("Expected the store error, got %v", err)
+	}
+	if order := ob.GetOrder("buy-first"); order == nil || !order.Price().Equal(decimal.New(40, 0)) || len(store.amended) != 0 {
+		t.Fatalf("Failed amendment modified the book: %v %v", order, store.amended)
+	}
+	store.amendErr = nil
+	if _, err := ob.AmendOrder("buy-first", decimal.Zero, decimal.New(45, 0)); err != ErrAmendWouldCross || len(store.amended) != 0 {
+		t.Fatalf("Expected ErrAmendWouldCross without a write, got %v %v", err, store.amended)
+	}
+
+	// a decrease keeps the order at the front of its level
+	if _, err := ob.AmendOrder("buy-first", decimal.New(15, -1), decimal.Zero); err != nil {
+		t.Fatal(err)
+	}
+	amendment := store.amended["buy-first"]
+	if !amendment.keptPriority || !amendment.quantity.Equal(global.ToBaseUnits(decimal.New(15, -1), ob.market.Base)) || !amendment.price.Equal(decimal.New(40, 0)) {
+		t.Fatalf("Decrease was recorded as %+v", amendment)
+	}
+	trades, _, _, err := ob.ProcessMarketOrder(Sell, "sell-front", "seller", decimal.New(5, -1), CancelNewest)
+	if err != nil || len(trades) != 1 || trades[0].MakerOrderID != "buy-first" {
+		t.Fatalf("Decreased order lost its place: %v %v", trades, err)
+	}
+
+	// an increase moves it behind the rest of the level
+	if _, err := ob.AmendOrder("buy-first", decimal.New(3, 0), decimal.Zero); err != nil {
+		t.Fatal(err)
+	}
+	if store.amended["buy-first"].keptPriority {
+		t.Fatal("Increase was recorded as keeping priority")
+	}
+	trades, _, _, err = ob.ProcessMarketOrder(Sell, "sell-back", "seller", decimal.New(1, 0), CancelNewest)
+	if err != nil || len(trades) != 1 || trades[0].MakerOrderID != "buy-second" {
+		t.Fatalf("Increased order kept its place: %v %v", trades, err)
+	}
+}
+
+func TestQuoteMarketOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	if _, _, _, err := ob.ProcessQuoteMarketOrder(Buy, "market-buy-quote", "buyer", decimal.Zero, decimal.New(2, 0), decimal.New(55, 0), CancelNewest); err != ErrInvalidQuantity {
+		t.Fatalf("Expected ErrInvalidQuantity, got %v", err)
+	}
+	if _, _, _, err := ob.ProcessQuoteMarketOrder(Buy, "market-buy-quote", "buyer", decimal.New(100, 0), decimal.New(2, 0), decimal.Zero, CancelNewest); err != ErrInvalidPrice {
+		t.Fatalf("Expected ErrInvalidPrice, got %v", err)
+	}
+	trades, budgetLeft, quantity, err := ob.ProcessQuoteMarketOrder(Buy, "market-buy-quote", "buyer", decimal.New(100, 0), decimal.New(2, 0), decimal.New(55, 0), CancelNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 || !quantity.IsZero() || !budgetLeft.Equal(decimal.New(100, 0)) {
+		t.Fatalf("Quote order traded against an empty book: %v %s %s", trades, budgetLeft, quantity)
+	}
+}
+
+func TestQuoteMarketOrderBounds(t *testing.T) {
+	placeAsks := func() (*OrderBook, *fakeOrderStore) {
+		ob, store := newTestBook(t)
+		for _, price := range []int64{50, 51, 60} {
+			if _, _, _, err := ob.ProcessLimitOrder(Sell, fmt.Sprintf("sell-%d", price), "seller", decimal.New(2, 0), decimal.New(price, 0), LimitOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ob, store
+	}
+
+	// the budget would buy more than the order's quantity, the order stops at it
+	ob, store := placeAsks()
+	trades, budgetLeft, quantity, err := ob.ProcessQuoteMarketOrder(Buy, "market-buy-quote", "buyer", decimal.New(200, 0), decimal.New(3, 0), decimal.New(55, 0), CancelNewest)
+	if err != nil || !quantity.Equal(decimal.New(3, 0)) || !budgetLeft.Equal(decimal.New(49, 0)) || len(trades) != 2 {
+		t.Fatalf("Quote order traded %s for %s left in %v (%v), expected 3 for 49 left", quantity, budgetLeft, trades, err)
+	}
+	settled := decimal.Zero
+	for _, trade := range store.trades {
+		settled = settled.Add(trade.Quantity)
+	}
+	if !settled.Equal(decimal.New(3, 9)) {
+		t.Fatalf("Settled %s nanos, expected the order's 3", settled)
+	}
+
+	// the budget would reach beyond the protection price, the order stops before it
+	ob, _ = placeAsks()
+	trades, budgetLeft, quantity, err = ob.ProcessQuoteMarketOrder(Buy, "market-buy-quote", "buyer", decimal.New(1000, 0), decimal.New(10, 0), decimal.New(55, 0), CancelNewest)
+	if err != nil || !quantity.Equal(decimal.New(4, 0)) || !budgetLeft.Equal(decimal.New(798, 0)) {
+		t.Fatalf("Quote order traded %s for %s left in %v (%v), expected 4 for 798 left", quantity, budgetLeft, trades, err)
+	}
+	if order := ob.GetOrder("sell-60"); order == nil || !order.Quantity().Equal(decimal.New(2, 0)) {
+		t.Fatalf("Quote order traded beyond its protection price: %v", order)
+	}
+}
+
+func TestProtectedMarketOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	limit, err := ProtectionPrice(Buy, decimal.New(2, 0), decimal.New(100, 0), decimal.NewFromFloat(0.1))
+	if err != nil || !limit.Equal(decimal.New(55, 0)) {
+		t.Fatalf("Expected a buy protection price of 55, got %s (%v)", limit, err)
+	}
+	if sellLimit, err := ProtectionPrice(Sell, decimal.New(2, 0), decimal.New(100, 0), decimal.NewFromFloat(0.1)); err != nil || !sellLimit.Equal(decimal.New(45, 0)) {
+		t.Fatalf("Expected a sell protection price of 45, got %s (%v)", sellLimit, err)
+	}
+	if _, err := ProtectionPrice(Sell, decimal.New(2, 0), decimal.New(100, 0), decimal.New(1, 0)); err != ErrInvalidPrice {
+		t.Fatalf("Expected ErrInvalidPrice, got %v", err)
+	}
+
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-60", "seller", decimal.New(2, 0), decimal.New(60, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessProtectedMarketOrder(Buy, "market-buy-protected", "buyer", decimal.New(2, 0), decimal.Zero, CancelNewest); err != ErrInvalidPrice {
+		t.Fatalf("Expected ErrInvalidPrice, got %v", err)
+	}
+	trades, quantityLeft, fullPrice, err := ob.ProcessProtectedMarketOrder(Buy, "market-buy-protected", "buyer", decimal.New(2, 0), limit, CancelNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 || !quantityLeft.Equal(decimal.New(2, 0)) || !fullPrice.IsZero() {
+		t.Fatalf("Protected order traded beyond its limit: %v %s %s", trades, quantityLeft, fullPrice)
+	}
+	if order := ob.GetOrder("sell-60"); order == nil || !order.Quantity().Equal(decimal.New(2, 0)) {
+		t.Fatalf("Resting order changed: %v", order)
+	}
+}
+
+func TestLegacySnapshotOwners(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "5f1c0e2a9b3d4c0012345678", "BC1YLowner", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook(ob.Market())
+	defer restored.Close()
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if order := restored.GetOrder("5f1c0e2a9b3d4c0012345678"); order == nil || order.Owner() != "BC1YLowner" {
+		t.Fatalf("Owner did not survive a snapshot round trip: %v", order)
+	}
+
+	// Snapshots written before orders carried an owner take it from the legacy ID
+	legacy := `{"asks":{"numOrders":1,"depth":1,"prices":{"50":{"volume":"2","price":"50","orders":[{"side":"sell","id":"limit-sell-BC1YLabc-2-1625000000000","timestamp":"2021-06-29T20:53:20Z","quantity":"2","price":"50"}]}}},` +
+		`"bids":{"numOrders":0,"depth":0,"prices":{}},` +
+		`"stops":{"buys":{"numOrders":1,"depth":1,"prices":{"60":{"volume":"1","price":"60","orders":[{"side":"buy","id":"stop-buy-BC1YLdef-1-1625000000000","timestamp":"2021-06-29T20:53:20Z","quantity":"1","price":"0","stopPrice":"60"}]}}},"sells":{"numOrders":0,"depth":0,"prices":{}}}}`
+	if err := restored.UnmarshalJSON([]byte(legacy)); err != nil {
+		t.Fatal(err)
+	}
+	if order := restored.GetOrder("limit-sell-BC1YLabc-2-1625000000000"); order == nil || order.Owner() != "BC1YLabc" {
+		t.Fatalf("Legacy limit order was not assigned its owner: %v", order)
+	}
+	if order := restored.GetOrder("stop-buy-BC1YLdef-1-1625000000000"); order == nil || order.Owner() != "BC1YLdef" {
+		t.Fatalf("Legacy stop order was not assigned its owner: %v", order)
+	}
+	// IDs without a public key only match themselves
+	if owner := legacyOrderOwner("buy-40"); owner != "buy-40" {
+		t.Fatalf("legacyOrderOwner returned %q, expected buy-40", owner)
+	}
+}
@@ -19,6 +19,8 @@ type OrderSide struct {
 	volume    decimal.Decimal
 	numOrders int
 	depth     int
+
+	byStopPrice bool // levels are keyed by the stop price instead of the limit price
 }
 
 func rbtComparator(a, b interface{}) int {
@@ -36,6 +38,21 @@ func NewOrderSide() *OrderSide {
 	}
 }
 
+// newStopSide creates an OrderSide whose levels are keyed by stop price
+func newStopSide() *OrderSide {
+	os := NewOrderSide()
+	os.byStopPrice = true
+	return os
+}
+
+// levelPrice returns the price of the level `o` belongs to
+func (os *OrderSide) levelPrice(o *Order) decimal.Decimal {
+	if os.byStopPrice {
+		return o.StopPrice()
+	}
+	return o.Price()
+}
+
 // Len returns amount of orders
 func (os *OrderSide) Len() int {
 	return os.numOrders
@@ -53,12 +70,12 @@ func (os *OrderSide) Volume() decimal.Decimal {
 
 // Append appends order to definite price level
 func (os *OrderSide) Append(o *Order) *list.Element {
-	price := o.Price()
+	price := os.levelPrice(o)
 	strPrice := price.String()
 
 	priceQueue, ok := os.prices[strPrice]
 	if !ok {
-		priceQueue = NewOrderQueue(o.Price())
+		priceQueue = NewOrderQueue(price)
 		os.prices[strPrice] = priceQueue
 		os.priceTree.Put(price, priceQueue)
 		os.depth++
@@ -70,7 +87,7 @@ func (os *OrderSide) Append(o *Order) *list.Element {
 
 // Remove removes order from definite price level
 func (os *OrderSide) Remove(e *list.Element) *Order {
-	price := e.Value.(*Order).Price()
+	price := os.levelPrice(e.Value.(*Order))
 	strPrice := price.String()
 
 	priceQueue := os.prices[strPrice]
@@ -87,6 +104,12 @@ func (os *OrderSide) Remove(e *list.Element) *Order {
 	return o
 }
 
+// Update replaces the order held by `e` at the same price level without changing its place in the queue
+func (os *OrderSide) Update(e *list.Element, o *Order) *list.Element {
+	os.volume = os.volume.Sub(e.Value.(*Order).Quantity()).Add(o.Quantity())
+	return os.prices[os.levelPrice(o).String()].Update(e, o)
+}
+
 // MaxPriceQueue returns maximal level of price
 func (os *OrderSide) MaxPriceQueue() *OrderQueue {
 	if os.depth > 0 {
@@ -182,10 +205,12 @@ func (os *OrderSide) MarshalJSON() ([]byte, error) {
 		&struct {
 			NumOrders int                    `json:"numOrders"`
 			Depth     int                    `json:"depth"`
+			Volume    decimal.Decimal        `json:"volume"`
 			Prices    map[string]*OrderQueue `json:"prices"`
 		}{
 			NumOrders: os.numOrders,
 			Depth:     os.depth,
+			Volume:    os.volume,
 			Prices:    os.prices,
 		},
 	)
@@ -196,6 +221,7 @@ func (os *OrderSide) UnmarshalJSON(data []byte) error {
 	obj := struct {
 		NumOrders int                    `json:"numOrders"`
 		Depth     int                    `json:"depth"`
+		Volume    *decimal.Decimal       `json:"volume"`
 		Prices    map[string]*OrderQueue `json:"prices"`
 	}{}
 
@@ -206,12 +232,25 @@ func (os *OrderSide) UnmarshalJSON(data []byte) error {
 	os.numOrders = obj.NumOrders
 	os.depth = obj.Depth
 	os.prices = obj.Prices
+	if os.prices == nil {
+		os.prices = map[string]*OrderQueue{}
+	}
 	os.priceTree = &rbtx.RedBlackTreeExtended{
 		Tree: rbt.NewWith(rbtComparator),
 	}
 
+	os.volume = decimal.Zero
 	for price, queue := range os.prices {
-		os.priceTree.Put(decimal.RequireFromString(price), queue)
+		price, err := decimal.NewFromString(price)
+		if err != nil {
+			return err
+		}
+		os.priceTree.Put(price, queue)
+		os.volume = os.volume.Add(queue.Volume())
+	}
+	// snapshots written before the side volume was stored keep the sum of their levels
+	if obj.Volume != nil {
+		os.volume = *obj.Volume
 	}
 
 	return nil
@@ -0,0 +1,342 @@
+package orderbook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"exchange-engine/db"
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+// ReconcilePolicy decides what reconciliation does about the discrepancies it finds
+type ReconcilePolicy string
+
+// Reconciliation policies
+const (
+	ReconcileReport   ReconcilePolicy = "report"   // only report discrepancies
+	ReconcileReinsert ReconcilePolicy = "reinsert" // put open orders missing from the book back, cancel those that cannot rest
+	ReconcileCancel   ReconcilePolicy = "cancel"   // cancel open orders missing from the book
+	ReconcileHalt     ReconcilePolicy = "halt"     // change nothing and only accept cancellations until an operator steps in
+)
+
+// ParseReconcilePolicy converts a policy name to a ReconcilePolicy
+func ParseReconcilePolicy(s string) (ReconcilePolicy, error) {
+	switch policy := ReconcilePolicy(strings.ToLower(s)); policy {
+	case ReconcileReport, ReconcileReinsert, ReconcileCancel, ReconcileHalt:
+		return policy, nil
+	}
+	return ReconcileReport, ErrInvalidReconcilePolicy
+}
+
+// ReconcileGrace is how old an open order has to be before reconciliation on demand considers it,
+// so orders a handler has created but not yet sent to the book are left alone
+const ReconcileGrace = time.Minute
+
+// Discrepancy kinds
+const (
+	discrepancyMissing  = "missing"  // open in the database but not on the book
+	discrepancyComplete = "complete" // on the book but complete in the database
+	discrepancyUnknown  = "unknown"  // on the book but not in the database
+	discrepancyQuantity = "quantity" // remaining quantity differs between the book and the database
+)
+
+// Discrepancy is an order the book and the database disagree about
+type Discrepancy struct {
+	OrderID string `json:"orderID"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail,omitempty"`
+	Action  string `json:"action"` // what the policy did about it
+}
+
+// Reconciliation is the outcome of reconciling one book with the database
+type Reconciliation struct {
+	Market        string          `json:"market"`
+	Policy        ReconcilePolicy `json:"policy"`
+	BookOrders    int             `json:"bookOrders"`
+	OpenOrders    int             `json:"openOrders"`
+	Discrepancies []Discrepancy   `json:"discrepancies"`
+}
+
+// Reconcile reconciles every book with the database, see OrderBook.Reconcile
+func Reconcile(policy ReconcilePolicy) ([]*Reconciliation, error) {
+	var reports []*Reconciliation
+	for _, ob := range Books {
+		report, err := ob.Reconcile(policy, ReconcileGrace)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+/*
+Reconcile compares the book with the open orders of its market in the database and applies `policy`
+to the discrepancies.
+
+Orders on the book that the database has completed, or does not know, are taken off the book by
+every policy but report and halt. Quantity differences are only reported.
+The book is locked for the whole pass, so no order moves between reading the database and acting on it.
+
+Arguments:
+	policy - What to do about the discrepancies
+	grace - Open orders created less than `grace` ago are skipped, they may still be on their way to the book
+*/
+func (ob *OrderBook) Reconcile(policy ReconcilePolicy, grace time.Duration) (report *Reconciliation, err error) {
+	ob.submit(func(uint64) {
+		ctx := context.TODO()
+		var open []*models.OrderSchema
+		open, err = db.GetOpenOrders(ctx, ob.market)
+		if err != nil {
+			return
+		}
+		var known map[string]*models.OrderSchema
+		known, err = db.GetOrdersByID(ctx, ob.orderIDs())
+		if err != nil {
+			return
+		}
+		report = ob.reconcile(open, known, policy, time.Now().Add(-grace))
+	})
+	return
+}
+
+/*
+RepairSettled brings the book up to date with the fills the database settled after the last journaled command.
+
+A command settles its fills in the database before its changes are journaled, so a crash between the two
+restarts the book from a journal that is missing them: makers that were filled still rest with their old
+quantity and a taker that was left resting is not on the book. The database is right about those orders,
+so resting orders it completed are removed, resting orders it filled further are reduced to what is left,
+and open orders that traded but are missing from the book are put back, or cancelled if they cannot rest.
+
+Return:
+	repaired - What was repaired, as discrepancies
+*/
+func (ob *OrderBook) RepairSettled() (repaired []Discrepancy, err error) {
+	ob.submit(func(uint64) {
+		ctx := context.TODO()
+		var open []*models.OrderSchema
+		open, err = db.GetOpenOrders(ctx, ob.market)
+		if err != nil {
+			return
+		}
+		var known map[string]*models.OrderSchema
+		known, err = db.GetOrdersByID(ctx, ob.orderIDs())
+		if err != nil {
+			return
+		}
+		repaired = ob.repairSettled(open, known)
+	})
+	return
+}
+
+// repairSettled applies the fills in `open` and `known` the book is missing, see RepairSettled
+func (ob *OrderBook) repairSettled(open []*models.OrderSchema, known map[string]*models.OrderSchema) []Discrepancy {
+	repaired := []Discrepancy{}
+	add := func(orderID, kind, detail, action string) {
+		repaired = append(repaired, Discrepancy{OrderID: orderID, Kind: kind, Detail: detail, Action: action})
+		log.Printf("repair %s: order %s %s %s, %s\n", ob.market.Symbol, orderID, kind, detail, action)
+	}
+
+	for id, e := range ob.orders {
+		doc, ok := known[id]
+		if !ok {
+			continue
+		}
+		order := e.Value.(*Order)
+		if doc.Complete {
+			ob.removeAnywhere(id)
+			ob.touch(id)
+			add(id, discrepancyComplete, doc.Error, "removed")
+			continue
+		}
+		// fills only ever lower the remaining quantity, anything else is for reconciliation to report
+		if remaining := remainingQuantity(doc, ob.market); remaining.Sign() > 0 && remaining.LessThan(order.TotalQuantity()) {
+			amended, _ := order.amended(remaining, order.Price(), order.Time())
+			ob.restingSide(order.Side()).Update(e, amended)
+			ob.touch(id)
+			add(id, discrepancyQuantity, fmt.Sprintf("book %s, database %s", order.TotalQuantity(), remaining), "reduced")
+		}
+	}
+
+	for _, doc := range open {
+		if doc.OrderQuantityProcessed.Sign() <= 0 || ob.getOrder(doc.OrderID) != nil {
+			continue
+		}
+		detail := fmt.Sprintf("%s %s %s", doc.OrderType, doc.OrderSide, remainingQuantity(doc, ob.market))
+		if err := ob.reinsert(doc); err != nil {
+			ob.cancelMissing(doc, err)
+			add(doc.OrderID, discrepancyMissing, detail, "cancelled: "+err.Error())
+		} else {
+			add(doc.OrderID, discrepancyMissing, detail, "reinserted")
+		}
+	}
+	return repaired
+}
+
+// orderIDs returns the IDs of every resting and stop order
+func (ob *OrderBook) orderIDs() []string {
+	ids := make([]string, 0, len(ob.orders)+ob.stops.Len())
+	for id := range ob.orders {
+		ids = append(ids, id)
+	}
+	for id := range ob.stops.orders {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+/*
+reconcile diffs the book against the database and applies `policy`.
+
+Arguments:
+	open - The orders of the market the database has not completed
+	known - The database orders of every order on the book, keyed by ID
+	createdBefore - Open orders created after it are skipped
+*/
+func (ob *OrderBook) reconcile(open []*models.OrderSchema, known map[string]*models.OrderSchema, policy ReconcilePolicy, createdBefore time.Time) *Reconciliation {
+	report := &Reconciliation{
+		Market:        ob.market.Symbol,
+		Policy:        policy,
+		BookOrders:    len(ob.orders) + ob.stops.Len(),
+		OpenOrders:    len(open),
+		Discrepancies: []Discrepancy{},
+	}
+	add := func(orderID, kind, detail, action string) {
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{OrderID: orderID, Kind: kind, Detail: detail, Action: action})
+		log.Printf("reconcile %s: order %s %s %s, %s\n", ob.market.Symbol, orderID, kind, detail, action)
+	}
+
+	for _, id := range ob.orderIDs() {
+		doc, ok := known[id]
+		var kind, detail string
+		switch {
+		case !ok:
+			kind = discrepancyUnknown
+		case doc.Complete:
+			kind, detail = discrepancyComplete, doc.Error
+		default:
+			if remaining := remainingQuantity(doc, ob.market); !remaining.Equal(ob.getOrder(id).TotalQuantity()) {
+				add(id, discrepancyQuantity, fmt.Sprintf("book %s, database %s", ob.getOrder(id).TotalQuantity(), remaining), "none")
+			}
+			continue
+		}
+		if policy == ReconcileReinsert || policy == ReconcileCancel {
+			ob.removeAnywhere(id)
+			ob.touch(id)
+			add(id, kind, detail, "removed")
+		} else {
+			add(id, kind, detail, "none")
+		}
+	}
+
+	for _, doc := range open {
+		if ob.getOrder(doc.OrderID) != nil || doc.Created.After(createdBefore) {
+			continue
+		}
+		detail := fmt.Sprintf("%s %s %s", doc.OrderType, doc.OrderSide, remainingQuantity(doc, ob.market))
+		switch policy {
+		case ReconcileReinsert:
+			if err := ob.reinsert(doc); err != nil {
+				ob.cancelMissing(doc, err)
+				add(doc.OrderID, discrepancyMissing, detail, "cancelled: "+err.Error())
+			} else {
+				add(doc.OrderID, discrepancyMissing, detail, "reinserted")
+			}
+		case ReconcileCancel:
+			ob.cancelMissing(doc, ErrReconciled)
+			add(doc.OrderID, discrepancyMissing, detail, "cancelled")
+		default:
+			add(doc.OrderID, discrepancyMissing, detail, "none")
+		}
+	}
+
+	if policy == ReconcileHalt && len(report.Discrepancies) > 0 {
+		ob.SetCancelOnly(true)
+	}
+	return report
+}
+
+// remainingQuantity returns the quantity of a database order on `market` that is left to trade, in whole units of the base asset
+func remainingQuantity(doc *models.OrderSchema, market *global.Market) decimal.Decimal {
+	return global.FromBaseUnits(doc.OrderQuantity.Sub(doc.OrderQuantityProcessed), market.Base)
+}
+
+// reinsert puts an open database order back on the book, as long as it can rest there without trading
+func (ob *OrderBook) reinsert(doc *models.OrderSchema) error {
+	side := Sell
+	if doc.OrderSide == "buy" {
+		side = Buy
+	}
+	quantity := remainingQuantity(doc, ob.market)
+	if quantity.Sign() <= 0 {
+		return ErrInvalidQuantity
+	}
+	stp, err := ParseSelfTradePrevention(doc.SelfTradePrevention)
+	if err != nil {
+		return err
+	}
+	price := doc.OrderPrice
+	order := NewOrder(doc.OrderID, doc.Username, side, quantity, price, doc.Created)
+	order.stp = stp
+
+	if doc.StopState == models.StopPending {
+		order.stopPrice = doc.StopPrice
+		if order.stopPrice.Sign() <= 0 {
+			return ErrInvalidStopPrice
+		}
+		if Triggers(side, order.stopPrice, ob.lastPrice) {
+			return ErrStopWouldTrigger
+		}
+		ob.stops.Append(order)
+		ob.touchAppend(order.ID())
+		return nil
+	}
+
+	// market orders and triggered stop-market orders never rest
+	if price.Sign() <= 0 {
+		return ErrInvalidPrice
+	}
+	if order.tif, err = ParseTimeInForce(doc.TimeInForce); err != nil {
+		return err
+	}
+	if order.tif != GoodTilCancelled && order.tif != GoodTilDate {
+		return ErrUnfilledCancelled
+	}
+	order.expires = doc.ExpireTime
+	if order.Expired(time.Now()) {
+		return ErrOrderExpired
+	}
+	if _, err := ob.postOnlyPrice(side, price, false); err != nil {
+		return err
+	}
+	if display := global.FromBaseUnits(doc.DisplayQuantity, ob.market.Base); display.Sign() > 0 && display.LessThan(quantity) {
+		order.display = display
+		order.hidden = quantity.Sub(display)
+		order.quantity = display
+	}
+	ob.orders[order.ID()] = ob.restingSide(side).Append(order)
+	ob.touchAppend(order.ID())
+	return nil
+}
+
+// cancelMissing completes an open database order that is not on the book
+func (ob *OrderBook) cancelMissing(doc *models.OrderSchema, reason error) {
+	errorString := fmt.Sprintf("%s: %s", ErrReconciled.Error(), reason.Error())
+	if reason == ErrReconciled {
+		errorString = reason.Error()
+	}
+	cancel := db.CancelCompleteOrder
+	if doc.StopState == models.StopPending {
+		cancel = db.CancelStopOrder
+	}
+	if err := cancel(context.TODO(), doc.OrderID, errorString); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,143 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseReconcilePolicy(t *testing.T) {
+	for s, expected := range map[string]ReconcilePolicy{"report": ReconcileReport, "REINSERT": ReconcileReinsert, "cancel": ReconcileCancel, "halt": ReconcileHalt} {
+		if policy, err := ParseReconcilePolicy(s); err != nil || policy != expected {
+			t.Fatalf("ParseReconcilePolicy(%q) returned %v %v, expected %v", s, policy, err, expected)
+		}
+	}
+	if _, err := ParseReconcilePolicy("ignore"); err != ErrInvalidReconcilePolicy {
+		t.Fatal("ParseReconcilePolicy accepted an unknown policy")
+	}
+}
+
+// reconcileFixture returns a book with three resting orders and the database view of them:
+// sell-a agrees, sell-b was completed in the database and sell-c has a different remaining quantity.
+// buy-a and stop-a are open in the database but missing from the book.
+func reconcileFixture(t *testing.T) (*OrderBook, []*models.OrderSchema, map[string]*models.OrderSchema) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	for _, id := range []string{"sell-a", "sell-b", "sell-c"} {
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, id, "seller", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created := time.Now().Add(-time.Hour)
+	// quantities are stored in nanos
+	nanos := func(bitclout float64) decimal.Decimal { return decimal.NewFromFloat(bitclout).Shift(9) }
+	open := []*models.OrderSchema{
+		{OrderID: "sell-a", Username: "seller", OrderSide: "sell", OrderType: "limit", OrderQuantity: nanos(2), OrderPrice: decimal.New(50, 0), Created: created},
+		{OrderID: "sell-c", Username: "seller", OrderSide: "sell", OrderType: "limit", OrderQuantity: nanos(2), OrderQuantityProcessed: nanos(0.5), OrderPrice: decimal.New(50, 0), Created: created},
+		{OrderID: "buy-a", Username: "buyer", OrderSide: "buy", OrderType: "limit", OrderQuantity: nanos(3), OrderQuantityProcessed: nanos(1), OrderPrice: decimal.New(45, 0), DisplayQuantity: nanos(1), Created: created},
+		{OrderID: "stop-a", Username: "buyer", OrderSide: "buy", OrderType: "stop", OrderQuantity: nanos(1), StopPrice: decimal.New(60, 0), StopState: models.StopPending, Created: created},
+		// created after the cut-off, it may still be on its way to the book
+		{OrderID: "buy-b", Username: "buyer", OrderSide: "buy", OrderType: "limit", OrderQuantity: nanos(1), OrderPrice: decimal.New(40, 0), Created: time.Now()},
+	}
+	known := map[string]*models.OrderSchema{
+		"sell-a": open[0],
+		"sell-b": {OrderID: "sell-b", Complete: true, Error: "Order Cancelled by User"},
+		"sell-c": open[1],
+	}
+	return ob, open, known
+}
+
+func TestReconcile(t *testing.T) {
+	kinds := func(report *Reconciliation) map[string]string {
+		found := map[string]string{}
+		for _, d := range report.Discrepancies {
+			found[d.OrderID] = d.Kind + " " + d.Action
+		}
+		return found
+	}
+
+	ob, open, known := reconcileFixture(t)
+	var report *Reconciliation
+	ob.submit(func(uint64) { report = ob.reconcile(open, known, ReconcileReport, time.Now().Add(-time.Minute)) })
+	expected := map[string]string{"sell-b": "complete none", "sell-c": "quantity none", "buy-a": "missing none", "stop-a": "missing none"}
+	if found := kinds(report); len(found) != len(expected) || report.BookOrders != 3 || report.OpenOrders != 5 {
+		t.Fatalf("Unexpected report: %+v", report)
+	} else {
+		for id, kind := range expected {
+			if found[id] != kind {
+				t.Fatalf("Order %s reported as %q, expected %q", id, found[id], kind)
+			}
+		}
+	}
+	if ob.GetOrder("sell-b") == nil || ob.GetOrder("buy-a") != nil || ob.CancelOnly() {
+		t.Fatal("Report policy changed the book")
+	}
+
+	ob, open, known = reconcileFixture(t)
+	ob.submit(func(uint64) { report = ob.reconcile(open, known, ReconcileReinsert, time.Now().Add(-time.Minute)) })
+	if found := kinds(report); found["sell-b"] != "complete removed" || found["buy-a"] != "missing reinserted" || found["stop-a"] != "missing reinserted" {
+		t.Fatalf("Unexpected reinsert report: %v", found)
+	}
+	if ob.GetOrder("sell-b") != nil {
+		t.Fatal("Order completed in the database is still on the book")
+	}
+	order := ob.GetOrder("buy-a")
+	if order == nil || order.Owner() != "buyer" || !order.TotalQuantity().Equal(decimal.New(2, 0)) || !order.DisplayQuantity().Equal(decimal.New(1, 0)) || !order.Price().Equal(decimal.New(45, 0)) {
+		t.Fatalf("Unexpected reinserted order: %v", order)
+	}
+	if stop := ob.GetOrder("stop-a"); stop == nil || !stop.IsStop() || !stop.StopPrice().Equal(decimal.New(60, 0)) {
+		t.Fatalf("Unexpected reinserted stop order: %v", stop)
+	}
+	if ob.GetOrder("buy-b") != nil {
+		t.Fatal("Order created after the cut-off was reinserted")
+	}
+
+	ob, open, known = reconcileFixture(t)
+	ob.submit(func(uint64) { report = ob.reconcile(open, known, ReconcileHalt, time.Now().Add(-time.Minute)) })
+	if !ob.CancelOnly() || ob.GetOrder("sell-b") == nil || ob.GetOrder("buy-a") != nil {
+		t.Fatal("Halt policy changed the book or kept accepting orders")
+	}
+}
+
+func TestRepairSettled(t *testing.T) {
+	ob, open, known := reconcileFixture(t)
+	var repaired []Discrepancy
+	ob.submit(func(uint64) { repaired = ob.repairSettled(open, known) })
+	found := map[string]string{}
+	for _, d := range repaired {
+		found[d.OrderID] = d.Kind + " " + d.Action
+	}
+	// stop-a and buy-b never traded, whatever kept them off the book is for reconciliation to report
+	expected := map[string]string{"sell-b": "complete removed", "sell-c": "quantity reduced", "buy-a": "missing reinserted"}
+	if len(found) != len(expected) {
+		t.Fatalf("Unexpected repairs: %v", found)
+	}
+	for id, kind := range expected {
+		if found[id] != kind {
+			t.Fatalf("Order %s repaired as %q, expected %q", id, found[id], kind)
+		}
+	}
+	if ob.GetOrder("sell-b") != nil || ob.GetOrder("stop-a") != nil || ob.GetOrder("buy-b") != nil {
+		t.Fatal("Repair changed orders that did not trade")
+	}
+	if order := ob.GetOrder("sell-c"); order == nil || !order.TotalQuantity().Equal(decimal.New(15, -1)) {
+		t.Fatalf("Unexpected repaired order: %v", order)
+	}
+	if order := ob.GetOrder("buy-a"); order == nil || !order.TotalQuantity().Equal(decimal.New(2, 0)) {
+		t.Fatalf("Unexpected reinserted taker: %v", order)
+	}
+
+	// a repaired book has nothing left for reconciliation to change
+	known["buy-a"] = open[2]
+	var report *Reconciliation
+	ob.submit(func(uint64) { report = ob.reconcile(open, known, ReconcileReport, time.Now().Add(-time.Minute)) })
+	for _, d := range report.Discrepancies {
+		if d.OrderID != "stop-a" {
+			t.Fatalf("Repaired book still has discrepancy %+v", d)
+		}
+	}
+}
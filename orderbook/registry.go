@@ -0,0 +1,129 @@
+package orderbook
+
+import (
+	"log"
+
+	"exchange-engine/config"
+	"exchange-engine/global"
+)
+
+// Books holds one OrderBook per market symbol
+var Books = map[string]*OrderBook{}
+
+/*
+Initializes an orderbook for every registered market
+
+Arguments:
+	blank - Whether the orderbooks are empty. If false, each orderbook is retrieved from the snapshot store.
+*/
+func Setup(blank bool) {
+	log.Println("orderbook setup")
+	store, err := newSnapshotStore()
+	if err != nil {
+		log.Fatalf("Error selecting snapshot store %q: %v\n", config.ExchangeConfig.SnapshotStore, err)
+	}
+	Snapshots = store
+	for _, ob := range Books {
+		ob.Close()
+	}
+	Books = map[string]*OrderBook{}
+	for _, symbol := range global.MarketSymbols() {
+		ob := NewOrderBook(global.Markets[symbol])
+		if !blank {
+			recoverOrderbook, err := Snapshots.Current(ob.SnapshotName())
+			if err != nil {
+				log.Fatalf("Error fetching orderbook %s: %v\n", symbol, err)
+			}
+			if recoverOrderbook != nil {
+				log.Printf("unmarshalling fetched orderbook %s\n", symbol)
+				err := ob.UnmarshalJSON(recoverOrderbook)
+				snapshotErr, ok := err.(*SnapshotError)
+				if ok && config.ExchangeConfig.SnapshotMismatch == "report" {
+					log.Printf("orderbook %s loaded with its recomputed values: %v\n", symbol, snapshotErr)
+				} else if ok && config.ExchangeConfig.SnapshotMismatch == "cancel-only" {
+					log.Printf("orderbook %s only accepts cancellations: %v\n", symbol, snapshotErr)
+					ob.SetCancelOnly(true)
+				} else if err != nil {
+					log.Fatalf("Error loading fetched orderbook %s: %v\n", symbol, err)
+				}
+			}
+			saved := ob.Sequence()
+			recoverJournal(ob)
+			reconcileOnStartup(ob)
+			ob.startSnapshots(Snapshots, saved)
+		}
+		Books[symbol] = ob
+		log.Printf("orderbook %s setup complete\n%v", symbol, ob.String())
+	}
+}
+
+// recoverJournal replays the changes the snapshot of `ob` is missing and journals every further command
+func recoverJournal(ob *OrderBook) {
+	snapshotSequence := ob.Sequence()
+	journal, err := OpenJournal(ob.journalPath())
+	if err != nil {
+		log.Fatalf("Error opening journal of orderbook %s: %v\n", ob.Market().Symbol, err)
+	}
+	replayed, err := ob.ReplayJournal(journal)
+	if err != nil {
+		log.Fatalf("Error replaying journal of orderbook %s: %v\n", ob.Market().Symbol, err)
+	}
+	log.Printf("replayed %d journal entries of orderbook %s after sequence %d\n", replayed, ob.Market().Symbol, snapshotSequence)
+	if err := journal.Compact(snapshotSequence); err != nil {
+		log.Printf("Error compacting journal of orderbook %s: %v\n", ob.Market().Symbol, err)
+	}
+}
+
+/*
+reconcileOnStartup checks the restored book against the open orders in the database before it takes any order.
+
+The fills a crash kept out of the journal are repaired first under every policy but halt, see OrderBook.RepairSettled.
+*/
+func reconcileOnStartup(ob *OrderBook) {
+	policy, err := ParseReconcilePolicy(config.ExchangeConfig.ReconcilePolicy)
+	if err != nil {
+		log.Fatalf("Error reconciling orderbook %s: %v %q\n", ob.Market().Symbol, err, config.ExchangeConfig.ReconcilePolicy)
+	}
+	if policy != ReconcileHalt {
+		repaired, err := ob.RepairSettled()
+		if err != nil {
+			log.Fatalf("Error repairing orderbook %s: %v\n", ob.Market().Symbol, err)
+		}
+		log.Printf("repaired %d orders of orderbook %s settled after its journal\n", len(repaired), ob.Market().Symbol)
+	}
+	report, err := ob.Reconcile(policy, 0)
+	if err != nil {
+		log.Fatalf("Error reconciling orderbook %s: %v\n", ob.Market().Symbol, err)
+	}
+	log.Printf("reconciled orderbook %s with %d open orders: %d discrepancies, policy %s\n", ob.Market().Symbol, report.OpenOrders, len(report.Discrepancies), policy)
+	if ob.CancelOnly() {
+		log.Printf("orderbook %s only accepts cancellations\n", ob.Market().Symbol)
+	}
+}
+
+/*
+GetOrderBook returns the book trading `symbol`.
+
+An empty symbol resolves to global.DefaultMarket.
+*/
+func GetOrderBook(symbol string) (*OrderBook, error) {
+	market, err := global.GetMarket(symbol)
+	if err != nil {
+		return nil, ErrMarketNotExists
+	}
+	ob, ok := Books[market.Symbol]
+	if !ok {
+		return nil, ErrMarketNotExists
+	}
+	return ob, nil
+}
+
+// FindOrderBook returns the book the order with the given ID rests on, nil if it rests on none
+func FindOrderBook(orderID string) *OrderBook {
+	for _, symbol := range global.MarketSymbols() {
+		if ob, ok := Books[symbol]; ok && ob.GetOrder(orderID) != nil {
+			return ob
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package orderbook
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// tickSize returns the smallest price increment of the book's market, zero if prices are unrestricted
+func (ob *OrderBook) tickSize() decimal.Decimal {
+	return decimal.NewFromFloat(ob.market.TickSize)
+}
+
+// lotSize returns the smallest quantity increment of the book's market, zero if quantities are unrestricted
+func (ob *OrderBook) lotSize() decimal.Decimal {
+	return decimal.NewFromFloat(ob.market.LotSize)
+}
+
+// roundLot rounds `quantity` down to a whole number of lots
+func (ob *OrderBook) roundLot(quantity decimal.Decimal) decimal.Decimal {
+	return roundDown(quantity, ob.lotSize())
+}
+
+// ValidatePrice checks that `price` is a positive multiple of the market's tick size
+func (ob *OrderBook) ValidatePrice(price decimal.Decimal) error {
+	if price.Sign() <= 0 {
+		return ErrInvalidPrice
+	}
+	if tick := ob.tickSize(); tick.IsPositive() && !price.Mod(tick).IsZero() {
+		return ErrInvalidTickSize
+	}
+	return nil
+}
+
+// ValidateQuantity checks that `quantity` is a multiple of the market's lot size within its quantity limits
+func (ob *OrderBook) ValidateQuantity(quantity decimal.Decimal) error {
+	if quantity.Sign() <= 0 {
+		return ErrInvalidQuantity
+	}
+	if lot := ob.lotSize(); lot.IsPositive() && !quantity.Mod(lot).IsZero() {
+		return ErrInvalidLotSize
+	}
+	if quantity.LessThan(decimal.NewFromFloat(ob.market.MinQuantity)) {
+		return ErrQuantityOutOfRange
+	}
+	if max := decimal.NewFromFloat(ob.market.MaxQuantity); max.IsPositive() && quantity.GreaterThan(max) {
+		return ErrQuantityOutOfRange
+	}
+	return nil
+}
+
+// ValidateNotional checks that an order worth `notional` (USD) reaches the market's minimum
+func (ob *OrderBook) ValidateNotional(notional decimal.Decimal) error {
+	if notional.LessThan(decimal.NewFromFloat(ob.market.MinNotional)) {
+		return ErrMinNotional
+	}
+	return nil
+}
+
+// ValidateLimitOrder checks a limit order of `quantity` at `price` against every instrument rule of the market
+func (ob *OrderBook) ValidateLimitOrder(quantity, price decimal.Decimal) error {
+	if err := ob.ValidatePrice(price); err != nil {
+		return err
+	}
+	if err := ob.ValidateQuantity(quantity); err != nil {
+		return err
+	}
+	return ob.ValidateNotional(quantity.Mul(price))
+}
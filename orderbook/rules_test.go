@@ -0,0 +1,43 @@
+package orderbook
+
+import (
+	"testing"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestInstrumentRules(t *testing.T) {
+	ob := NewOrderBook(&global.Market{
+		Symbol:      "TEST",
+		TickSize:    0.05,
+		LotSize:     0.1,
+		MinQuantity: 0.5,
+		MaxQuantity: 100,
+		MinNotional: 10,
+	})
+	defer ob.Close()
+	tests := []struct {
+		quantity, price string
+		err             error
+	}{
+		{"1", "20", nil},
+		{"1", "20.05", nil},
+		{"1", "20.01", ErrInvalidTickSize},
+		{"1", "0", ErrInvalidPrice},
+		{"1.05", "20", ErrInvalidLotSize},
+		{"0.3", "50", ErrQuantityOutOfRange},
+		{"100.1", "20", ErrQuantityOutOfRange},
+		{"0.5", "10", ErrMinNotional},
+	}
+	for _, test := range tests {
+		err := ob.ValidateLimitOrder(decimal.RequireFromString(test.quantity), decimal.RequireFromString(test.price))
+		if err != test.err {
+			t.Fatalf("%s @ %s: expected %v, got %v", test.quantity, test.price, test.err, err)
+		}
+	}
+	if lots := ob.roundLot(decimal.RequireFromString("1.2345")); !lots.Equal(decimal.RequireFromString("1.2")) {
+		t.Fatalf("Expected 1.2345 to round down to 1.2, got %s", lots)
+	}
+}
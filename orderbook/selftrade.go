@@ -0,0 +1,64 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// SelfTradePrevention decides what happens when an incoming order would match a resting order of the same user
+type SelfTradePrevention int
+
+// CancelNewest cancels the rest of the incoming order, CancelOldest the resting order and CancelBoth both of them.
+// DecrementAndCancel reduces the larger order by the smaller one's quantity and cancels the smaller one.
+const (
+	CancelNewest SelfTradePrevention = iota
+	CancelOldest
+	CancelBoth
+	DecrementAndCancel
+)
+
+// ParseSelfTradePrevention converts CN, CO, CB or DC to a SelfTradePrevention. An empty string is CancelNewest.
+func ParseSelfTradePrevention(s string) (SelfTradePrevention, error) {
+	switch strings.ToUpper(s) {
+	case "", "CN":
+		return CancelNewest, nil
+	case "CO":
+		return CancelOldest, nil
+	case "CB":
+		return CancelBoth, nil
+	case "DC":
+		return DecrementAndCancel, nil
+	}
+	return CancelNewest, ErrInvalidSelfTradePrevention
+}
+
+// String implements fmt.Stringer interface
+func (stp SelfTradePrevention) String() string {
+	switch stp {
+	case CancelOldest:
+		return "CO"
+	case CancelBoth:
+		return "CB"
+	case DecrementAndCancel:
+		return "DC"
+	}
+	return "CN"
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (stp SelfTradePrevention) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + stp.String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (stp *SelfTradePrevention) UnmarshalJSON(data []byte) error {
+	var err error
+	if *stp, err = ParseSelfTradePrevention(strings.Trim(string(data), `"`)); err != nil {
+		return &json.UnsupportedValueError{
+			Value: reflect.New(reflect.TypeOf(data)),
+			Str:   string(data),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseSelfTradePrevention(t *testing.T) {
+	for s, expected := range map[string]SelfTradePrevention{"": CancelNewest, "cn": CancelNewest, "CO": CancelOldest, "CB": CancelBoth, "DC": DecrementAndCancel} {
+		stp, err := ParseSelfTradePrevention(s)
+		if err != nil || stp != expected {
+			t.Fatalf("ParseSelfTradePrevention(%q) returned %v %v, expected %v", s, stp, err, expected)
+		}
+	}
+	if _, err := ParseSelfTradePrevention("NONE"); err != ErrInvalidSelfTradePrevention {
+		t.Fatal("ParseSelfTradePrevention accepted an unknown mode")
+	}
+
+	data, err := json.Marshal(DecrementAndCancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stp SelfTradePrevention
+	if err := json.Unmarshal(data, &stp); err != nil || stp != DecrementAndCancel {
+		t.Fatalf("Self-trade prevention did not survive a JSON round trip: %s %v", data, err)
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		stp                  SelfTradePrevention
+		quantity             int64
+		makerLeft            int64 // zero if the resting order of the taker's owner is cancelled
+		makerDecrement       int64
+		takerCancelled       bool
+		takerDecrement       int64
+		filled, takerResting int64
+	}{
+		{stp: CancelNewest, quantity: 3, makerLeft: 5, takerCancelled: true},
+		{stp: CancelOldest, quantity: 3, filled: 3},
+		{stp: CancelOldest, quantity: 7, filled: 4, takerResting: 3},
+		{stp: CancelBoth, quantity: 3, takerCancelled: true},
+		{stp: DecrementAndCancel, quantity: 3, makerLeft: 2, makerDecrement: 3, takerCancelled: true},
+		{stp: DecrementAndCancel, quantity: 7, takerDecrement: 5, filled: 2},
+		{stp: DecrementAndCancel, quantity: 5, takerCancelled: true},
+	}
+	for _, test := range tests {
+		ob, store := newTestBook(t)
+		// the owner's order rests ahead of the order of another seller at the same price
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-own", "owner", decimal.New(5, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-other", "other", decimal.New(4, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		trades, _, _, err := ob.ProcessLimitOrder(Buy, "buy-own", "owner", decimal.New(test.quantity, 0), decimal.New(50, 0), LimitOptions{SelfTradePrevention: test.stp})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filled := TakerQuantity(trades, "buy-own"); !filled.Equal(decimal.New(test.filled, 0)) {
+			t.Fatalf("%s %d: filled %s, expected %d", test.stp, test.quantity, filled, test.filled)
+		}
+		for _, trade := range trades {
+			if trade.MakerOrderID != "sell-other" {
+				t.Fatalf("%s %d: traded with the owner's own order: %s", test.stp, test.quantity, trade)
+			}
+		}
+		if len(store.trades) != len(trades) {
+			t.Fatalf("%s %d: %d trades settled, expected %d", test.stp, test.quantity, len(store.trades), len(trades))
+		}
+
+		maker := ob.GetOrder("sell-own")
+		if test.makerLeft == 0 {
+			if maker != nil || store.cancelled["sell-own"] != ErrSelfTrade.Error() {
+				t.Fatalf("%s %d: resting order was not cancelled: %v", test.stp, test.quantity, maker)
+			}
+		} else if maker == nil || !maker.Quantity().Equal(decimal.New(test.makerLeft, 0)) {
+			t.Fatalf("%s %d: resting order is %v, expected %d left", test.stp, test.quantity, maker, test.makerLeft)
+		}
+		if _, ok := store.cancelled["buy-own"]; ok != test.takerCancelled {
+			t.Fatalf("%s %d: taker cancelled %v, expected %v", test.stp, test.quantity, ok, test.takerCancelled)
+		}
+		taker := ob.GetOrder("buy-own")
+		if test.takerResting == 0 && taker != nil || test.takerResting > 0 && (taker == nil || !taker.Quantity().Equal(decimal.New(test.takerResting, 0))) {
+			t.Fatalf("%s %d: taker rests as %v, expected %d", test.stp, test.quantity, taker, test.takerResting)
+		}
+
+		// the outcome is recorded on both orders, decrements in nanos
+		makerRecords, takerRecords := store.selfTrades["sell-own"], store.selfTrades["buy-own"]
+		if len(makerRecords) != 1 || len(takerRecords) != 1 {
+			t.Fatalf("%s %d: recorded %v and %v", test.stp, test.quantity, makerRecords, takerRecords)
+		}
+		if makerRecords[0].Mode != test.stp.String() || makerRecords[0].CounterOrderID != "buy-own" || takerRecords[0].CounterOrderID != "sell-own" {
+			t.Fatalf("%s %d: unexpected records %v and %v", test.stp, test.quantity, makerRecords, takerRecords)
+		}
+		if !makerRecords[0].Decrement.Equal(decimal.New(test.makerDecrement, 9)) || !takerRecords[0].Decrement.Equal(decimal.New(test.takerDecrement, 9)) {
+			t.Fatalf("%s %d: recorded decrements %s and %s", test.stp, test.quantity, makerRecords[0].Decrement, takerRecords[0].Decrement)
+		}
+		if makerRecords[0].Cancelled != (test.makerLeft == 0) || takerRecords[0].Cancelled != test.takerCancelled {
+			t.Fatalf("%s %d: recorded cancellations %v and %v", test.stp, test.quantity, makerRecords[0].Cancelled, takerRecords[0].Cancelled)
+		}
+	}
+}
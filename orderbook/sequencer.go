@@ -0,0 +1,118 @@
+package orderbook
+
+// command is a unit of work executed on the sequencer goroutine
+type command struct {
+	apply   func(seq uint64)
+	mutates bool
+	done    chan uint64
+}
+
+// depthSnapshot is an immutable copy of the price levels published after every command.
+// Readers use it instead of walking the live trees so they never race with matching.
+type depthSnapshot struct {
+	sequence uint64
+	asks     []PriceLevel // best (lowest) price first
+	bids     []PriceLevel // best (highest) price first
+}
+
+// start launches the matching loop. Every mutation of the OrderBook must go through it.
+func (ob *OrderBook) start() {
+	ob.commands = make(chan *command)
+	ob.quit = make(chan struct{})
+	ob.publish()
+	go ob.run()
+}
+
+// Close stops the matching loop. Any further submission blocks forever.
+func (ob *OrderBook) Close() {
+	if ob.quit != nil {
+		close(ob.quit)
+	}
+}
+
+func (ob *OrderBook) run() {
+	for {
+		select {
+		case cmd := <-ob.commands:
+			seq := ob.sequence
+			if cmd.mutates {
+				ob.sequence++
+				seq = ob.sequence
+			}
+			cmd.apply(seq)
+			if cmd.mutates {
+				// the fills of the command are already settled, a crash before the entry is synced is repaired on startup
+				ob.commitJournal(ob.sequence)
+				ob.publish()
+				if ob.snapshots != nil {
+					ob.snapshots.changed(ob.sequence)
+				}
+			}
+			cmd.done <- seq
+		case <-ob.quit:
+			if ob.journal != nil {
+				ob.journal.Close()
+			}
+			return
+		}
+	}
+}
+
+/*
+submit executes fn on the matching loop and blocks until it has been applied.
+
+Arguments:
+	fn - The mutation to apply. It receives the sequence number assigned to the command and
+	     must only call unexported OrderBook methods, never another exported function, or it will deadlock.
+Return:
+	seq - The sequence number assigned to the command
+*/
+func (ob *OrderBook) submit(fn func(seq uint64)) uint64 {
+	cmd := &command{apply: fn, mutates: true, done: make(chan uint64, 1)}
+	ob.commands <- cmd
+	return <-cmd.done
+}
+
+// query executes a read-only fn on the matching loop without assigning it a sequence number
+func (ob *OrderBook) query(fn func()) {
+	cmd := &command{apply: func(uint64) { fn() }, done: make(chan uint64, 1)}
+	ob.commands <- cmd
+	<-cmd.done
+}
+
+// tryQuery is query for goroutines that outlive the book, it returns false instead of blocking once the book is closed
+func (ob *OrderBook) tryQuery(fn func()) bool {
+	cmd := &command{apply: func(uint64) { fn() }, done: make(chan uint64, 1)}
+	select {
+	case ob.commands <- cmd:
+	case <-ob.quit:
+		return false
+	}
+	<-cmd.done
+	return true
+}
+
+// publish stores a copy of the current price levels for lock-free readers
+func (ob *OrderBook) publish() {
+	snap := &depthSnapshot{sequence: ob.sequence}
+	for level := ob.asks.MinPriceQueue(); level != nil; level = ob.asks.GreaterThan(level.Price()) {
+		snap.asks = append(snap.asks, PriceLevel{Price: level.Price(), Quantity: level.Volume()})
+	}
+	for level := ob.bids.MaxPriceQueue(); level != nil; level = ob.bids.LessThan(level.Price()) {
+		snap.bids = append(snap.bids, PriceLevel{Price: level.Price(), Quantity: level.Volume()})
+	}
+	ob.depth.Store(snap)
+}
+
+// snapshot returns the last published price levels
+func (ob *OrderBook) snapshot() *depthSnapshot {
+	if snap, ok := ob.depth.Load().(*depthSnapshot); ok {
+		return snap
+	}
+	return &depthSnapshot{}
+}
+
+// Sequence returns the sequence number of the last applied command
+func (ob *OrderBook) Sequence() uint64 {
+	return ob.snapshot().sequence
+}
@@ -0,0 +1,61 @@
+package orderbook
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestConcurrentLimitOrdersAreSequenced(t *testing.T) {
+	// Create a blank orderbook (clearing the orderbook)
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	quantity := decimal.New(1, 0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, _, err := ob.ProcessLimitOrder(Buy, fmt.Sprintf("buy-%d", i), "buyer", quantity, decimal.New(int64(10+i%5), 0), LimitOptions{}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, _, err := ob.ProcessLimitOrder(Sell, fmt.Sprintf("sell-%d", i), "seller", quantity, decimal.New(int64(100+i%5), 0), LimitOptions{}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ob.Sequence() != 100 {
+		t.Fatalf("Sequence is %d, expected 100", ob.Sequence())
+	}
+	snap := ob.snapshot()
+	if len(snap.asks) != 5 || len(snap.bids) != 5 {
+		t.Fatalf("Depth is %d/%d, expected 5/5", len(snap.asks), len(snap.bids))
+	}
+	for i, level := range snap.asks {
+		if !level.Price.Equal(decimal.New(int64(100+i), 0)) || !level.Quantity.Equal(decimal.New(10, 0)) {
+			t.Fatalf("Unexpected ask level %d: %v", i, level)
+		}
+	}
+	for i, level := range snap.bids {
+		if !level.Price.Equal(decimal.New(int64(14-i), 0)) || !level.Quantity.Equal(decimal.New(10, 0)) {
+			t.Fatalf("Unexpected bid level %d: %v", i, level)
+		}
+	}
+
+	price, err := ob.CalculateMarketPrice(Buy, decimal.New(15, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !price.Equal(decimal.New(100*10+101*5, 0)) {
+		t.Fatalf("Market price is %s, expected %d", price, 100*10+101*5)
+	}
+}
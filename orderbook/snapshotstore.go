@@ -0,0 +1,159 @@
+package orderbook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"exchange-engine/config"
+	"exchange-engine/s3"
+)
+
+/*
+SnapshotStore keeps the snapshots of every book.
+
+Each Save writes a new timestamped version (the millisecond it was taken) and replaces the current
+snapshot a book is restored from on startup.
+*/
+type SnapshotStore interface {
+	// Save stores `data` as a new version of `name` and makes it the current snapshot
+	Save(name string, data []byte) (version string, err error)
+	// Current returns the current snapshot of `name`, nil if it has none
+	Current(name string) ([]byte, error)
+	// Load returns the timestamped snapshot `version` of `name`
+	Load(name, version string) ([]byte, error)
+	// List returns the timestamped versions of `name`, oldest first
+	List(name string) ([]string, error)
+	// Prune deletes all but the newest `keep` timestamped versions of `name`
+	Prune(name string, keep int) (pruned int, err error)
+}
+
+// Snapshots is the store the books are backed up to, selected by Setup
+var Snapshots SnapshotStore
+
+// newSnapshotStore returns the store selected by config.ExchangeConfig.SnapshotStore
+func newSnapshotStore() (SnapshotStore, error) {
+	switch config.ExchangeConfig.SnapshotStore {
+	case "", "s3":
+		return s3.NewStore(), nil
+	case "local":
+		return NewLocalSnapshotStore(config.ExchangeConfig.SnapshotDir), nil
+	}
+	return nil, ErrInvalidSnapshotStore
+}
+
+// LocalSnapshotStore keeps snapshots as files in a directory, for running without S3
+type LocalSnapshotStore struct {
+	dir string
+}
+
+// NewLocalSnapshotStore returns a store keeping its snapshots in `dir`, which is created on the first Save
+func NewLocalSnapshotStore(dir string) *LocalSnapshotStore {
+	return &LocalSnapshotStore{dir: dir}
+}
+
+func (s *LocalSnapshotStore) currentPath(name string) string {
+	return filepath.Join(s.dir, name+"-current.json")
+}
+
+func (s *LocalSnapshotStore) versionPath(name, version string) string {
+	return filepath.Join(s.dir, name+"-"+version+".json")
+}
+
+// Save writes a timestamped copy of `data` and replaces the current snapshot of `name`
+func (s *LocalSnapshotStore) Save(name string, data []byte) (string, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", err
+	}
+	version := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	for _, path := range []string{s.versionPath(name, version), s.currentPath(name)} {
+		if err := writeFileAtomic(path, data); err != nil {
+			return "", err
+		}
+	}
+	return version, nil
+}
+
+// writeFileAtomic writes `data` next to `path` and renames it into place, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Current reads the current snapshot of `name`, nil if there is none
+func (s *LocalSnapshotStore) Current(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.currentPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Load reads the timestamped snapshot `version` of `name`
+func (s *LocalSnapshotStore) Load(name, version string) ([]byte, error) {
+	if _, err := strconv.ParseUint(version, 10, 64); err != nil {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(s.versionPath(name, version))
+}
+
+// List returns the timestamped versions of `name`, oldest first
+func (s *LocalSnapshotStore) List(name string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var millis []uint64
+	for _, file := range files {
+		version := strings.TrimSuffix(strings.TrimPrefix(file.Name(), name+"-"), ".json")
+		if len(version)+len(name)+len(".json")+1 != len(file.Name()) {
+			continue
+		}
+		if m, err := strconv.ParseUint(version, 10, 64); err == nil {
+			millis = append(millis, m)
+		}
+	}
+	sort.Slice(millis, func(i, j int) bool { return millis[i] < millis[j] })
+	versions := make([]string, len(millis))
+	for i, m := range millis {
+		versions[i] = strconv.FormatUint(m, 10)
+	}
+	return versions, nil
+}
+
+// Prune deletes all but the newest `keep` timestamped versions of `name`
+func (s *LocalSnapshotStore) Prune(name string, keep int) (int, error) {
+	versions, err := s.List(name)
+	if err != nil || len(versions) <= keep {
+		return 0, err
+	}
+	stale := versions[:len(versions)-keep]
+	for i, version := range stale {
+		if err := os.Remove(s.versionPath(name, version)); err != nil && !os.IsNotExist(err) {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,65 @@
+package orderbook
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalSnapshotStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalSnapshotStore(dir)
+
+	if data, err := store.Current("orderbook"); data != nil || err != nil {
+		t.Fatalf("Empty store returned a current snapshot: %s %v", data, err)
+	}
+	if versions, err := store.List("orderbook"); len(versions) != 0 || err != nil {
+		t.Fatalf("Empty store listed versions: %v %v", versions, err)
+	}
+
+	// versions of another book and stray files are never listed
+	for _, file := range []string{"orderbook-eth-usdc-1000.json", "orderbook-notes.json", "orderbook-2000.json.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, version := range []string{"3000", "1000", "20000"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "orderbook-"+version+".json"), []byte(version), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version, err := store.Save("orderbook", []byte("latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := store.List("orderbook")
+	if err != nil || !reflect.DeepEqual(versions, []string{"1000", "3000", "20000", version}) {
+		t.Fatalf("Unexpected versions: %v %v", versions, err)
+	}
+	if data, err := store.Current("orderbook"); string(data) != "latest" || err != nil {
+		t.Fatalf("Unexpected current snapshot: %s %v", data, err)
+	}
+	if data, err := store.Load("orderbook", "3000"); string(data) != "3000" || err != nil {
+		t.Fatalf("Unexpected snapshot version: %s %v", data, err)
+	}
+	if _, err := store.Load("orderbook", "../orderbook-current"); err == nil {
+		t.Fatal("Loaded a snapshot that is not a version")
+	}
+
+	pruned, err := store.Prune("orderbook", 2)
+	if pruned != 2 || err != nil {
+		t.Fatalf("Unexpected prune: %d %v", pruned, err)
+	}
+	versions, _ = store.List("orderbook")
+	if !reflect.DeepEqual(versions, []string{"20000", version}) {
+		t.Fatalf("Prune kept the wrong versions: %v", versions)
+	}
+	if data, err := store.Current("orderbook"); string(data) != "latest" || err != nil {
+		t.Fatal("Prune removed the current snapshot")
+	}
+	if versions, _ := store.List("orderbook-eth-usdc"); !reflect.DeepEqual(versions, []string{"1000"}) {
+		t.Fatalf("Prune touched another book: %v", versions)
+	}
+}
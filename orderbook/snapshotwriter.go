@@ -0,0 +1,217 @@
+package orderbook
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"exchange-engine/config"
+)
+
+// maxSnapshotBackoff caps the delay between retries of a failing snapshot upload
+const maxSnapshotBackoff = 5 * time.Minute
+
+/*
+snapshotWriter saves the snapshots of one book in the background.
+
+Commands only tell the writer the book changed. The writer coalesces the changes into a single
+upload once `interval` has passed since the first unsaved change, or as soon as `commands`
+commands are unsaved. A book is uploaded by one goroutine, one snapshot at a time, and only
+ever moves forward in sequence, so the current snapshot never goes back to an older state.
+
+A failed upload is retried with exponential backoff. Nothing is lost in the meantime:
+the journal keeps every change after the last saved snapshot, and is compacted once a newer
+one is saved.
+*/
+type snapshotWriter struct {
+	ob        *OrderBook
+	store     SnapshotStore
+	interval  time.Duration
+	commands  uint64
+	retention int
+
+	latest uint64 // sequence of the last command that changed the book, accessed atomically
+	saved  uint64 // sequence of the last saved snapshot, only touched by run
+
+	wake  chan struct{}
+	flush chan chan error
+}
+
+func newSnapshotWriter(ob *OrderBook, store SnapshotStore, interval time.Duration, commands, retention int) *snapshotWriter {
+	if commands < 1 {
+		commands = 1
+	}
+	return &snapshotWriter{
+		ob:        ob,
+		store:     store,
+		interval:  interval,
+		commands:  uint64(commands),
+		retention: retention,
+		wake:      make(chan struct{}, 1),
+		flush:     make(chan chan error),
+	}
+}
+
+/*
+startSnapshots backs the book up to `store` from now on.
+
+Arguments:
+	store - Where the snapshots are saved
+	saved - The sequence of the snapshot the store already holds. If the book is ahead of it,
+	        for instance after replaying the journal, a snapshot is saved right away.
+*/
+func (ob *OrderBook) startSnapshots(store SnapshotStore, saved uint64) {
+	w := newSnapshotWriter(ob, store, config.ExchangeConfig.SnapshotInterval, config.ExchangeConfig.SnapshotCommands, config.ExchangeConfig.SnapshotRetention)
+	w.saved = saved
+	ob.query(func() {
+		ob.snapshots = w
+		w.latest = ob.sequence
+	})
+	if w.pending() > 0 {
+		w.changed(atomic.LoadUint64(&w.latest))
+	}
+	go w.run()
+}
+
+// changed records that the command `seq` changed the book, it never blocks the matching loop
+func (w *snapshotWriter) changed(seq uint64) {
+	atomic.StoreUint64(&w.latest, seq)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pending returns how many commands are not in a saved snapshot yet
+func (w *snapshotWriter) pending() uint64 {
+	latest := atomic.LoadUint64(&w.latest)
+	if latest <= w.saved {
+		return 0
+	}
+	return latest - w.saved
+}
+
+func (w *snapshotWriter) run() {
+	var timer *time.Timer
+	var due <-chan time.Time
+	schedule := func(delay time.Duration) {
+		if due == nil {
+			timer = time.NewTimer(delay)
+			due = timer.C
+		}
+	}
+	unschedule := func() {
+		if due != nil {
+			timer.Stop()
+			due = nil
+		}
+	}
+
+	failures := 0
+	save := func() error {
+		err := w.write()
+		if err != nil {
+			failures++
+			backoff := w.interval << uint(failures)
+			if backoff > maxSnapshotBackoff || backoff <= 0 {
+				backoff = maxSnapshotBackoff
+			}
+			log.Printf("Error saving snapshot of orderbook %s, retrying in %v: %v\n", w.ob.Market().Symbol, backoff, err)
+			unschedule()
+			schedule(backoff)
+			return err
+		}
+		failures = 0
+		if w.pending() > 0 {
+			schedule(w.interval)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-w.wake:
+			if failures == 0 && w.pending() >= w.commands {
+				unschedule()
+				save()
+			} else if w.pending() > 0 {
+				schedule(w.interval)
+			}
+		case <-due:
+			due = nil
+			save()
+		case reply := <-w.flush:
+			unschedule()
+			reply <- save()
+		case <-w.ob.quit:
+			unschedule()
+			return
+		}
+	}
+}
+
+// write saves the current state of the book unless the last saved snapshot is already as recent
+func (w *snapshotWriter) write() error {
+	var (
+		data    []byte
+		seq     uint64
+		journal *Journal
+		err     error
+	)
+	if !w.ob.tryQuery(func() {
+		seq = w.ob.sequence
+		journal = w.ob.journal
+		if seq > w.saved {
+			data, err = w.ob.marshalJSON()
+		}
+	}) {
+		return nil
+	}
+	if err != nil || seq <= w.saved {
+		return err
+	}
+
+	name := w.ob.SnapshotName()
+	if _, err := w.store.Save(name, data); err != nil {
+		return err
+	}
+	w.saved = seq
+	if journal != nil {
+		if err := journal.Compact(seq); err != nil {
+			log.Printf("Error compacting journal of orderbook %s: %v\n", w.ob.Market().Symbol, err)
+		}
+	}
+	if w.retention > 0 {
+		pruned, err := w.store.Prune(name, w.retention)
+		if err != nil {
+			log.Println("Error pruning snapshots of", name, err)
+		} else if pruned > 0 {
+			log.Printf("pruned %d snapshots of %s\n", pruned, name)
+		}
+	}
+	return nil
+}
+
+// FlushSnapshot saves the book right away if it changed since its last snapshot
+func (ob *OrderBook) FlushSnapshot() error {
+	var w *snapshotWriter
+	if !ob.tryQuery(func() { w = ob.snapshots }) || w == nil {
+		return nil
+	}
+	reply := make(chan error, 1)
+	select {
+	case w.flush <- reply:
+	case <-ob.quit:
+		return nil
+	}
+	return <-reply
+}
+
+// FlushSnapshots saves every book that changed since its last snapshot
+func FlushSnapshots() {
+	for _, ob := range Books {
+		if err := ob.FlushSnapshot(); err != nil {
+			log.Printf("Error flushing snapshot of orderbook %s: %v\n", ob.Market().Symbol, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package orderbook
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"exchange-engine/config"
+	"exchange-engine/global"
+)
+
+// flakySnapshotStore fails the first `failures` saves
+type flakySnapshotStore struct {
+	*LocalSnapshotStore
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func (s *flakySnapshotStore) Save(name string, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return "", errors.New("upload failed")
+	}
+	return s.LocalSnapshotStore.Save(name, data)
+}
+
+func withSnapshotConfig(t *testing.T, interval time.Duration, commands int) {
+	previous := *config.ExchangeConfig
+	config.ExchangeConfig.SnapshotInterval = interval
+	config.ExchangeConfig.SnapshotCommands = commands
+	t.Cleanup(func() { *config.ExchangeConfig = previous })
+}
+
+func waitForVersions(t *testing.T, store SnapshotStore, name string, count int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		versions, err := store.List(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) >= count || time.Now().After(deadline) {
+			return versions
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSnapshotWriterCoalesces(t *testing.T) {
+	withSnapshotConfig(t, time.Hour, 3)
+	store := NewLocalSnapshotStore(t.TempDir())
+	ob := NewOrderBook(global.Markets[global.DefaultMarket])
+	defer ob.Close()
+	ob.startSnapshots(store, 0)
+	name := ob.SnapshotName()
+
+	ob.submit(func(uint64) {})
+	ob.submit(func(uint64) {})
+	if err := ob.FlushSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := store.List(name); len(versions) != 1 {
+		t.Fatalf("Flush saved %d snapshots, expected 1", len(versions))
+	}
+	// nothing changed since the flush
+	if err := ob.FlushSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := store.List(name); len(versions) != 1 {
+		t.Fatalf("Flush of an unchanged book saved a snapshot, %d saved", len(versions))
+	}
+
+	// the third unsaved command saves the book without waiting for the interval
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		ob.submit(func(uint64) {})
+	}
+	if versions := waitForVersions(t, store, name, 2); len(versions) != 2 {
+		t.Fatalf("Commands saved %d snapshots, expected 2", len(versions))
+	}
+	data, err := store.Current(name)
+	if err != nil || !strings.Contains(string(data), `"sequence":5`) {
+		t.Fatalf("Current snapshot is not the latest: %s %v", data, err)
+	}
+}
+
+func TestSnapshotWriterRetries(t *testing.T) {
+	withSnapshotConfig(t, time.Millisecond, 1)
+	store := &flakySnapshotStore{LocalSnapshotStore: NewLocalSnapshotStore(t.TempDir()), failures: 2}
+	ob := NewOrderBook(global.Markets[global.DefaultMarket])
+	defer ob.Close()
+	ob.startSnapshots(store, 0)
+
+	ob.submit(func(uint64) {})
+	if versions := waitForVersions(t, store, ob.SnapshotName(), 1); len(versions) != 1 {
+		t.Fatal("Failed snapshot was never retried")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.attempts != 3 {
+		t.Fatalf("Snapshot saved after %d attempts, expected 3", store.attempts)
+	}
+}
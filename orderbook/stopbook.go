@@ -0,0 +1,131 @@
+package orderbook
+
+import (
+	"container/list"
+	"encoding/json"
+
+	"github.com/shopspring/decimal"
+)
+
+// StopBook holds stop and stop-limit orders until the last traded price reaches their stop price
+type StopBook struct {
+	orders map[string]*list.Element // orderID -> *Order (*list.Element.Value.(*Order))
+
+	buys  *OrderSide // trigger when the last price rises to or above the stop price
+	sells *OrderSide // trigger when the last price falls to or below the stop price
+}
+
+// NewStopBook creates an empty StopBook
+func NewStopBook() *StopBook {
+	return &StopBook{
+		orders: map[string]*list.Element{},
+		buys:   newStopSide(),
+		sells:  newStopSide(),
+	}
+}
+
+// Len returns amount of pending stop orders
+func (sb *StopBook) Len() int {
+	return len(sb.orders)
+}
+
+// Append adds a stop order to the level of its stop price
+func (sb *StopBook) Append(o *Order) {
+	if o.Side() == Buy {
+		sb.orders[o.ID()] = sb.buys.Append(o)
+	} else {
+		sb.orders[o.ID()] = sb.sells.Append(o)
+	}
+}
+
+// Get returns the pending stop order with the given ID, nil if there is none
+func (sb *StopBook) Get(orderID string) *Order {
+	e, ok := sb.orders[orderID]
+	if !ok {
+		return nil
+	}
+	return e.Value.(*Order)
+}
+
+// Remove removes the stop order with the given ID, nil if there is none
+func (sb *StopBook) Remove(orderID string) *Order {
+	e, ok := sb.orders[orderID]
+	if !ok {
+		return nil
+	}
+	delete(sb.orders, orderID)
+	if e.Value.(*Order).Side() == Buy {
+		return sb.buys.Remove(e)
+	}
+	return sb.sells.Remove(e)
+}
+
+// Triggers returns whether a stop order on `side` at `stopPrice` fires at `lastPrice`.
+// A zero lastPrice means nothing has traded yet and never triggers.
+func Triggers(side Side, stopPrice, lastPrice decimal.Decimal) bool {
+	if lastPrice.Sign() <= 0 {
+		return false
+	}
+	if side == Buy {
+		return lastPrice.GreaterThanOrEqual(stopPrice)
+	}
+	return lastPrice.LessThanOrEqual(stopPrice)
+}
+
+// Next returns the oldest stop order at the stop price closest to `lastPrice` that it triggers, nil if none
+func (sb *StopBook) Next(lastPrice decimal.Decimal) *Order {
+	if level := sb.buys.MinPriceQueue(); level != nil && Triggers(Buy, level.Price(), lastPrice) {
+		return level.Head().Value.(*Order)
+	}
+	if level := sb.sells.MaxPriceQueue(); level != nil && Triggers(Sell, level.Price(), lastPrice) {
+		return level.Head().Value.(*Order)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (sb *StopBook) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		&struct {
+			Buys  *OrderSide `json:"buys"`
+			Sells *OrderSide `json:"sells"`
+		}{
+			Buys:  sb.buys,
+			Sells: sb.sells,
+		},
+	)
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (sb *StopBook) UnmarshalJSON(data []byte) error {
+	obj := struct {
+		Buys  *OrderSide `json:"buys"`
+		Sells *OrderSide `json:"sells"`
+	}{}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+
+	if obj.Buys == nil {
+		obj.Buys = newStopSide()
+	}
+	if obj.Sells == nil {
+		obj.Sells = newStopSide()
+	}
+	sb.buys = obj.Buys
+	sb.sells = obj.Sells
+	sb.buys.byStopPrice = true
+	sb.sells.byStopPrice = true
+	sb.orders = map[string]*list.Element{}
+
+	for _, order := range sb.buys.Orders() {
+		sb.orders[order.Value.(*Order).ID()] = order
+	}
+
+	for _, order := range sb.sells.Orders() {
+		sb.orders[order.Value.(*Order).ID()] = order
+	}
+
+	return nil
+}
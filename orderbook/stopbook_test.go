@@ -0,0 +1,171 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestStopBookNext(t *testing.T) {
+	sb := NewStopBook()
+	for _, o := range []*Order{
+		NewOrder("buy-stop-60", "buyer", Buy, decimal.New(1, 0), decimal.Zero, time.Now()),
+		NewOrder("buy-stop-55", "buyer", Buy, decimal.New(1, 0), decimal.Zero, time.Now()),
+		NewOrder("sell-stop-40", "seller", Sell, decimal.New(1, 0), decimal.New(39, 0), time.Now()),
+	} {
+		stopPrice, _ := decimal.NewFromString(o.ID()[len(o.ID())-2:])
+		o.stopPrice = stopPrice
+		sb.Append(o)
+	}
+
+	if order := sb.Next(decimal.Zero); order != nil {
+		t.Fatalf("Stop %s triggered before anything traded", order.ID())
+	}
+	if order := sb.Next(decimal.New(50, 0)); order != nil {
+		t.Fatalf("Stop %s triggered at 50", order.ID())
+	}
+	if order := sb.Next(decimal.New(57, 0)); order == nil || order.ID() != "buy-stop-55" {
+		t.Fatalf("Expected buy-stop-55 to trigger at 57, got %v", order)
+	}
+	if order := sb.Next(decimal.New(40, 0)); order == nil || order.ID() != "sell-stop-40" {
+		t.Fatalf("Expected sell-stop-40 to trigger at 40, got %v", order)
+	}
+	if sb.Remove("buy-stop-55") == nil || sb.Len() != 2 {
+		t.Fatal("Stop order was not removed")
+	}
+}
+
+func TestStopOrdersRestInStopBook(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	quantity := decimal.New(2, 0)
+	if err := ob.ProcessStopOrder(Buy, "buy-stop", "buyer", quantity, decimal.New(60, 0), decimal.Zero, CancelNewest); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.ProcessStopOrder(Sell, "sell-stop-limit", "seller", quantity, decimal.New(40, 0), decimal.New(39, 0), DecrementAndCancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.ProcessStopOrder(Sell, "sell-stop-limit", "seller", quantity, decimal.New(40, 0), decimal.New(39, 0), DecrementAndCancel); err != ErrOrderExists {
+		t.Fatalf("Expected ErrOrderExists, got %v", err)
+	}
+	if err := ob.ProcessStopOrder(Sell, "sell-stop-zero", "seller", quantity, decimal.Zero, decimal.Zero, CancelNewest); err != ErrInvalidStopPrice {
+		t.Fatalf("Expected ErrInvalidStopPrice, got %v", err)
+	}
+	if snap := ob.snapshot(); len(snap.asks) != 0 || len(snap.bids) != 0 {
+		t.Fatal("Pending stop orders appeared in the depth")
+	}
+
+	// Pending stop orders and the last price must survive a snapshot round trip
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook(ob.Market())
+	t.Cleanup(restored.Close)
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	order := restored.GetOrder("sell-stop-limit")
+	if order == nil || !order.StopPrice().Equal(decimal.New(40, 0)) || !order.Price().Equal(decimal.New(39, 0)) || order.SelfTradePrevention() != DecrementAndCancel {
+		t.Fatalf("Stop-limit order was not restored from the snapshot: %v", order)
+	}
+	if order := restored.GetOrder("buy-stop"); order == nil || !order.IsStop() {
+		t.Fatalf("Stop order was not restored from the snapshot: %v", order)
+	}
+
+	// Snapshots written before stop orders existed still load
+	if err := restored.UnmarshalJSON([]byte(`{"asks":{"numOrders":0,"depth":0,"prices":{}},"bids":{"numOrders":0,"depth":0,"prices":{}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if restored.GetOrder("buy-stop") != nil {
+		t.Fatal("Stop book was not reset by an older snapshot")
+	}
+}
+
+func TestStopOrdersExecuteOnTrigger(t *testing.T) {
+	// placeAndTrigger rests `asks`, places the stop and trades 1 at 55 to trigger it
+	placeAndTrigger := func(asks map[string]int64, stopPrice, price int64) (*OrderBook, *fakeOrderStore, []Trade) {
+		ob, store := newTestBook(t)
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-55", "seller", decimal.New(1, 0), decimal.New(55, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for id, askPrice := range asks {
+			if _, _, _, err := ob.ProcessLimitOrder(Sell, id, "seller", decimal.New(1, 0), decimal.New(askPrice, 0), LimitOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ob.ProcessStopOrder(Buy, "buy-stop", "stopper", decimal.New(2, 0), decimal.New(stopPrice, 0), decimal.New(price, 0), CancelNewest); err != nil {
+			t.Fatal(err)
+		}
+		trades, _, _, err := ob.ProcessLimitOrder(Buy, "buy-55", "buyer", decimal.New(1, 0), decimal.New(55, 0), LimitOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ob.stops.Len() != 0 || !store.triggered["buy-stop"].Equal(decimal.New(55, 0)) {
+			t.Fatalf("Stop did not trigger at 55: %v", store.triggered)
+		}
+		return ob, store, trades
+	}
+
+	// a stop-market order sweeps the book and completes
+	ob, store, trades := placeAndTrigger(map[string]int64{"sell-57": 57, "sell-58": 58}, 55, 0)
+	if filled := TakerQuantity(trades, "buy-stop"); len(trades) != 3 || !filled.Equal(decimal.New(2, 0)) {
+		t.Fatalf("Stop-market order filled %s in %v, expected 2", filled, trades)
+	}
+	if !store.completed["buy-stop"] || ob.GetOrder("buy-stop") != nil || !ob.LastPrice().Equal(decimal.New(58, 0)) {
+		t.Fatalf("Stop-market order was not completed: %v", store.completed)
+	}
+
+	// a stop-limit order fills up to its price and rests with the rest
+	ob, store, trades = placeAndTrigger(map[string]int64{"sell-56": 56, "sell-58": 58}, 55, 56)
+	if filled := TakerQuantity(trades, "buy-stop"); !filled.Equal(decimal.New(1, 0)) {
+		t.Fatalf("Stop-limit order filled %s in %v, expected 1", filled, trades)
+	}
+	order := ob.GetOrder("buy-stop")
+	if order == nil || order.IsStop() || !order.Price().Equal(decimal.New(56, 0)) || !order.Quantity().Equal(decimal.New(1, 0)) || store.completed["buy-stop"] {
+		t.Fatalf("Stop-limit order does not rest as a limit order: %v", order)
+	}
+
+	// a stop-market order that finds nothing to trade is cancelled
+	_, store, trades = placeAndTrigger(nil, 55, 0)
+	if len(trades) != 1 || store.cancelled["buy-stop"] != ErrInsufficientQuantity.Error() {
+		t.Fatalf("Stop-market order without liquidity was not cancelled: %v %v", trades, store.cancelled)
+	}
+}
+
+func TestStopMarketProtection(t *testing.T) {
+	market := global.Markets[global.DefaultMarket]
+	if price := StopProtectionPrice(market, Buy, decimal.New(55, 0)); !price.Equal(decimal.New(66, 0)) {
+		t.Fatalf("Expected a buy protection price of 66, got %s", price)
+	}
+	if price := StopProtectionPrice(market, Sell, decimal.New(55, 0)); !price.Equal(decimal.New(44, 0)) {
+		t.Fatalf("Expected a sell protection price of 44, got %s", price)
+	}
+
+	// a triggered stop-market buy stops at the price its hold was made for and completes with what it filled
+	ob, store := newTestBook(t)
+	for _, ask := range []struct {
+		id    string
+		price int64
+	}{{"sell-55", 55}, {"sell-60", 60}, {"sell-70", 70}} {
+		if _, _, _, err := ob.ProcessLimitOrder(Sell, ask.id, "seller", decimal.New(1, 0), decimal.New(ask.price, 0), LimitOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ob.ProcessStopOrder(Buy, "buy-stop", "stopper", decimal.New(2, 0), decimal.New(55, 0), decimal.Zero, CancelNewest); err != nil {
+		t.Fatal(err)
+	}
+	trades, _, _, err := ob.ProcessLimitOrder(Buy, "buy-55", "buyer", decimal.New(1, 0), decimal.New(55, 0), LimitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filled := TakerQuantity(trades, "buy-stop"); !filled.Equal(decimal.New(1, 0)) || !store.completed["buy-stop"] {
+		t.Fatalf("Stop-market order filled %s in %v, expected 1 and completed", filled, trades)
+	}
+	if order := ob.GetOrder("sell-70"); order == nil {
+		t.Fatal("Stop-market order traded beyond its protection price")
+	}
+}
@@ -0,0 +1,69 @@
+package orderbook
+
+import (
+	"context"
+
+	"exchange-engine/db"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+OrderStore records what the matching loop does to the order documents: the fills it settles, the self-trades
+it prevents and the orders it amends, triggers, completes and cancels. Every book writes to the database, tests
+give a book a fake so orders can cross without one.
+*/
+type OrderStore interface {
+	// SettleFill stores a trade and settles it for both of its orders, see db.SettleFill
+	SettleFill(ctx context.Context, trade *models.TradeSchema) error
+	// RecordSelfTrade records a match prevented by self-trade prevention on one of its orders
+	RecordSelfTrade(ctx context.Context, orderID string, selfTrade models.SelfTrade) error
+	// TriggerStopOrder records that a stop order triggered at `price`
+	TriggerStopOrder(ctx context.Context, orderID string, price decimal.Decimal) error
+	// AmendOrder changes the remaining quantity (nanos) and price of a resting order and its hold, see db.AmendOrder
+	AmendOrder(ctx context.Context, orderID string, quantity, price decimal.Decimal, keptPriority bool) error
+	// RepriceOrder records the price a post-only order was moved to
+	RepriceOrder(ctx context.Context, orderID string, requested, price decimal.Decimal) error
+	// CompleteOrder completes an order that will not trade any more
+	CompleteOrder(ctx context.Context, orderID string) error
+	// CancelCompleteOrder cancels an order with `errorString`, releasing what it still holds
+	CancelCompleteOrder(ctx context.Context, orderID, errorString string) error
+	// CancelStopOrder cancels a stop order that never triggered
+	CancelStopOrder(ctx context.Context, orderID, errorString string) error
+}
+
+// dbOrderStore is the OrderStore of every book, writing to the orders and trades collections
+type dbOrderStore struct{}
+
+func (dbOrderStore) SettleFill(ctx context.Context, trade *models.TradeSchema) error {
+	return db.SettleFill(ctx, trade)
+}
+
+func (dbOrderStore) RecordSelfTrade(ctx context.Context, orderID string, selfTrade models.SelfTrade) error {
+	return db.RecordSelfTrade(ctx, orderID, selfTrade)
+}
+
+func (dbOrderStore) TriggerStopOrder(ctx context.Context, orderID string, price decimal.Decimal) error {
+	return db.TriggerStopOrder(ctx, orderID, price)
+}
+
+func (dbOrderStore) AmendOrder(ctx context.Context, orderID string, quantity, price decimal.Decimal, keptPriority bool) error {
+	return db.AmendOrder(ctx, orderID, quantity, price, keptPriority)
+}
+
+func (dbOrderStore) RepriceOrder(ctx context.Context, orderID string, requested, price decimal.Decimal) error {
+	return db.RepriceOrder(ctx, orderID, requested, price)
+}
+
+func (dbOrderStore) CompleteOrder(ctx context.Context, orderID string) error {
+	return db.CompleteOrder(ctx, orderID)
+}
+
+func (dbOrderStore) CancelCompleteOrder(ctx context.Context, orderID, errorString string) error {
+	return db.CancelCompleteOrder(ctx, orderID, errorString)
+}
+
+func (dbOrderStore) CancelStopOrder(ctx context.Context, orderID, errorString string) error {
+	return db.CancelStopOrder(ctx, orderID, errorString)
+}
@@ -0,0 +1,99 @@
+package orderbook
+
+import (
+	"context"
+	"testing"
+
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+// fakeOrderStore keeps what a book records in memory, so tests can cross orders without a database
+type fakeOrderStore struct {
+	trades     []*models.TradeSchema
+	selfTrades map[string][]models.SelfTrade
+	triggered  map[string]decimal.Decimal
+	repriced   map[string]decimal.Decimal
+	completed  map[string]bool
+	cancelled  map[string]string
+	amended    map[string]fakeAmendment
+
+	settleErr func(trade *models.TradeSchema) error // fails the settlement of a trade when it returns an error
+	amendErr  error                                 // fails every amendment when set
+}
+
+// fakeAmendment is what a book asked a fakeOrderStore to amend an order to
+type fakeAmendment struct {
+	quantity, price decimal.Decimal
+	keptPriority    bool
+}
+
+func newFakeOrderStore() *fakeOrderStore {
+	return &fakeOrderStore{
+		selfTrades: map[string][]models.SelfTrade{},
+		triggered:  map[string]decimal.Decimal{},
+		repriced:   map[string]decimal.Decimal{},
+		completed:  map[string]bool{},
+		cancelled:  map[string]string{},
+		amended:    map[string]fakeAmendment{},
+	}
+}
+
+// newTestBook returns a book of the default market recording to a fakeOrderStore, closed when the test ends
+func newTestBook(t *testing.T) (*OrderBook, *fakeOrderStore) {
+	ob := NewOrderBook(global.Markets[global.DefaultMarket])
+	t.Cleanup(ob.Close)
+	store := newFakeOrderStore()
+	ob.store = store
+	return ob, store
+}
+
+func (s *fakeOrderStore) SettleFill(ctx context.Context, trade *models.TradeSchema) error {
+	if s.settleErr != nil {
+		if err := s.settleErr(trade); err != nil {
+			return err
+		}
+	}
+	s.trades = append(s.trades, trade)
+	return nil
+}
+
+func (s *fakeOrderStore) RecordSelfTrade(ctx context.Context, orderID string, selfTrade models.SelfTrade) error {
+	s.selfTrades[orderID] = append(s.selfTrades[orderID], selfTrade)
+	return nil
+}
+
+func (s *fakeOrderStore) TriggerStopOrder(ctx context.Context, orderID string, price decimal.Decimal) error {
+	s.triggered[orderID] = price
+	return nil
+}
+
+func (s *fakeOrderStore) AmendOrder(ctx context.Context, orderID string, quantity, price decimal.Decimal, keptPriority bool) error {
+	if s.amendErr != nil {
+		return s.amendErr
+	}
+	s.amended[orderID] = fakeAmendment{quantity: quantity, price: price, keptPriority: keptPriority}
+	return nil
+}
+
+func (s *fakeOrderStore) RepriceOrder(ctx context.Context, orderID string, requested, price decimal.Decimal) error {
+	s.repriced[orderID] = price
+	return nil
+}
+
+func (s *fakeOrderStore) CompleteOrder(ctx context.Context, orderID string) error {
+	s.completed[orderID] = true
+	return nil
+}
+
+func (s *fakeOrderStore) CancelCompleteOrder(ctx context.Context, orderID, errorString string) error {
+	s.cancelled[orderID] = errorString
+	return nil
+}
+
+func (s *fakeOrderStore) CancelStopOrder(ctx context.Context, orderID, errorString string) error {
+	s.cancelled[orderID] = errorString
+	return nil
+}
@@ -0,0 +1,69 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// TimeInForce of a limit order
+type TimeInForce int
+
+// GoodTilCancelled rests until filled or cancelled, ImmediateOrCancel never rests,
+// FillOrKill fills in full or not at all and GoodTilDate rests until its expiry
+const (
+	GoodTilCancelled TimeInForce = iota
+	ImmediateOrCancel
+	FillOrKill
+	GoodTilDate
+)
+
+// ParseTimeInForce converts GTC, IOC, FOK or GTD to a TimeInForce. An empty string is GoodTilCancelled.
+func ParseTimeInForce(s string) (TimeInForce, error) {
+	switch strings.ToUpper(s) {
+	case "", "GTC":
+		return GoodTilCancelled, nil
+	case "IOC":
+		return ImmediateOrCancel, nil
+	case "FOK":
+		return FillOrKill, nil
+	case "GTD":
+		return GoodTilDate, nil
+	}
+	return GoodTilCancelled, ErrInvalidTimeInForce
+}
+
+// String implements fmt.Stringer interface
+func (tif TimeInForce) String() string {
+	switch tif {
+	case ImmediateOrCancel:
+		return "IOC"
+	case FillOrKill:
+		return "FOK"
+	case GoodTilDate:
+		return "GTD"
+	}
+	return "GTC"
+}
+
+// Rests returns whether an unfilled remainder is placed on the book
+func (tif TimeInForce) Rests() bool {
+	return tif == GoodTilCancelled || tif == GoodTilDate
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (tif TimeInForce) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + tif.String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (tif *TimeInForce) UnmarshalJSON(data []byte) error {
+	var err error
+	if *tif, err = ParseTimeInForce(strings.Trim(string(data), `"`)); err != nil {
+		return &json.UnsupportedValueError{
+			Value: reflect.New(reflect.TypeOf(data)),
+			Str:   string(data),
+		}
+	}
+	return nil
+}
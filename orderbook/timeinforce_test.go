@@ -0,0 +1,86 @@
+package orderbook
+
+import (
+	"testing"
+	"time"
+
+	"exchange-engine/global"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseTimeInForce(t *testing.T) {
+	for s, expected := range map[string]TimeInForce{"": GoodTilCancelled, "gtc": GoodTilCancelled, "IOC": ImmediateOrCancel, "FOK": FillOrKill, "GTD": GoodTilDate} {
+		tif, err := ParseTimeInForce(s)
+		if err != nil || tif != expected {
+			t.Fatalf("ParseTimeInForce(%q) returned %v %v, expected %v", s, tif, err, expected)
+		}
+	}
+	if _, err := ParseTimeInForce("DAY"); err != ErrInvalidTimeInForce {
+		t.Fatalf("ParseTimeInForce accepted an unknown time in force")
+	}
+}
+
+func TestImmediateOrCancelDoesNotRest(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	quantity := decimal.New(2, 0)
+	trades, quantityLeft, fullPrice, err := ob.ProcessLimitOrder(Buy, "buy-ioc", "buyer", quantity, decimal.New(50, 0), LimitOptions{TimeInForce: ImmediateOrCancel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 || !quantityLeft.Equal(quantity) || !fullPrice.IsZero() {
+		t.Fatalf("Unexpected fill: %s left for %s", quantityLeft, fullPrice)
+	}
+	if ob.GetOrder("buy-ioc") != nil {
+		t.Fatal("Immediate-or-cancel order rested on the book")
+	}
+}
+
+func TestFillOrKillRejectedWithoutLiquidity(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-50", "seller", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err := ob.ProcessLimitOrder(Buy, "buy-fok", "buyer", decimal.New(2, 0), decimal.New(40, 0), LimitOptions{TimeInForce: FillOrKill})
+	if err != ErrCannotFillOrKill {
+		t.Fatalf("Expected ErrCannotFillOrKill, got %v", err)
+	}
+	if ob.GetOrder("buy-fok") != nil || ob.GetOrder("sell-50") == nil {
+		t.Fatal("Rejected fill-or-kill order modified the book")
+	}
+}
+
+func TestGoodTilDateOrders(t *testing.T) {
+	Setup(true)
+	ob := Books[global.DefaultMarket]
+	quantity := decimal.New(2, 0)
+	_, _, _, err := ob.ProcessLimitOrder(Buy, "buy-past", "buyer", quantity, decimal.New(50, 0), LimitOptions{TimeInForce: GoodTilDate, ExpireTime: time.Now().Add(-time.Minute)})
+	if err != ErrInvalidExpireTime {
+		t.Fatalf("Expected ErrInvalidExpireTime, got %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if _, _, _, err := ob.ProcessLimitOrder(Buy, "buy-gtd", "buyer", quantity, decimal.New(50, 0), LimitOptions{TimeInForce: GoodTilDate, ExpireTime: expires}); err != nil {
+		t.Fatal(err)
+	}
+	if order := ob.GetOrder("buy-gtd"); order == nil || order.Expired(time.Now()) || !order.Expired(expires) {
+		t.Fatalf("Good-til-date order did not rest with its expire time: %v", order)
+	}
+
+	// The expire time must survive a snapshot round trip
+	data, err := ob.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook(ob.Market())
+	t.Cleanup(restored.Close)
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	order := restored.GetOrder("buy-gtd")
+	if order == nil || order.TimeInForce() != GoodTilDate || !order.ExpireTime().Equal(expires) {
+		t.Fatalf("Good-til-date order was not restored from the snapshot: %v", order)
+	}
+}
@@ -0,0 +1,64 @@
+package orderbook
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Trade is a single match between a resting maker order and an incoming taker order
+type Trade struct {
+	ID           string          `json:"id"`
+	Sequence     uint64          `json:"sequence"` // command of the order book that produced the trade
+	Market       string          `json:"market"`
+	MakerOrderID string          `json:"makerOrderID"`
+	TakerOrderID string          `json:"takerOrderID"`
+	Price        decimal.Decimal `json:"price"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	Side         Side            `json:"side"` // side of the taker (aggressor)
+	Timestamp    time.Time       `json:"timestamp"`
+
+	// owners are recorded with the trade but never published with it
+	makerOwner string
+	takerOwner string
+}
+
+// newTrade records `quantity` of `maker` being filled by the taker order `takerID` of `takerOwner` at the maker's price
+func (ob *OrderBook) newTrade(maker *Order, takerID, takerOwner string, quantity decimal.Decimal) Trade {
+	side := Buy
+	if maker.Side() == Buy {
+		side = Sell
+	}
+	return Trade{
+		ID:           primitive.NewObjectID().Hex(),
+		Sequence:     ob.sequence,
+		Market:       ob.market.Symbol,
+		MakerOrderID: maker.ID(),
+		TakerOrderID: takerID,
+		Price:        maker.Price(),
+		Quantity:     quantity,
+		Side:         side,
+		Timestamp:    time.Now().UTC(),
+
+		makerOwner: maker.Owner(),
+		takerOwner: takerOwner,
+	}
+}
+
+// String implements fmt.Stringer interface
+func (t Trade) String() string {
+	return fmt.Sprintf("%s #%d %s: %s %s @ %s (maker %s, taker %s)", t.Market, t.Sequence, t.ID, t.Side, t.Quantity, t.Price, t.MakerOrderID, t.TakerOrderID)
+}
+
+// TakerQuantity returns how much `orderID` filled as the taker of `trades`
+func TakerQuantity(trades []Trade, orderID string) decimal.Decimal {
+	quantity := decimal.Zero
+	for _, trade := range trades {
+		if trade.TakerOrderID == orderID {
+			quantity = quantity.Add(trade.Quantity)
+		}
+	}
+	return quantity
+}
@@ -0,0 +1,133 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"exchange-engine/db"
+	"exchange-engine/global"
+	"exchange-engine/models"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestNewTrade(t *testing.T) {
+	ob := NewOrderBook(global.Markets[global.DefaultMarket])
+	defer ob.Close()
+	maker := NewOrder("sell-maker", "seller", Sell, decimal.New(5, 0), decimal.New(50, 0), time.Now())
+	var trade Trade
+	seq := ob.submit(func(uint64) {
+		trade = ob.newTrade(maker, "buy-taker", "buyer", decimal.New(2, 0))
+	})
+	if trade.Side != Buy || trade.MakerOrderID != "sell-maker" || trade.TakerOrderID != "buy-taker" {
+		t.Fatalf("Unexpected trade parties: %s", trade)
+	}
+	if !trade.Price.Equal(maker.Price()) || !trade.Quantity.Equal(decimal.New(2, 0)) || trade.Sequence != seq || trade.ID == "" {
+		t.Fatalf("Unexpected trade: %s", trade)
+	}
+	if trade.makerOwner != "seller" || trade.takerOwner != "buyer" {
+		t.Fatalf("Unexpected trade owners: %s and %s", trade.makerOwner, trade.takerOwner)
+	}
+	// owners are never published with a trade
+	if data, err := json.Marshal(trade); err != nil || strings.Contains(string(data), "seller") || strings.Contains(string(data), "buyer") {
+		t.Fatalf("Trade leaked its owners: %s %v", data, err)
+	}
+}
+
+func TestMatchProducesTrades(t *testing.T) {
+	ob, store := newTestBook(t)
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-50", "seller", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-51", "seller", decimal.New(2, 0), decimal.New(51, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	trades, quantityLeft, fullPrice, err := ob.ProcessLimitOrder(Buy, "buy-51", "buyer", decimal.New(3, 0), decimal.New(51, 0), LimitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || !quantityLeft.IsZero() || !fullPrice.Equal(decimal.New(151, 0)) {
+		t.Fatalf("Unexpected fills: %v %s left for %s", trades, quantityLeft, fullPrice)
+	}
+	// makers fill best price first, each at its own price
+	expected := []struct {
+		maker           string
+		quantity, price int64
+	}{{"sell-50", 2, 50}, {"sell-51", 1, 51}}
+	for i, trade := range trades {
+		if trade.MakerOrderID != expected[i].maker || trade.TakerOrderID != "buy-51" || trade.Side != Buy ||
+			!trade.Quantity.Equal(decimal.New(expected[i].quantity, 0)) || !trade.Price.Equal(decimal.New(expected[i].price, 0)) {
+			t.Fatalf("Trade %d is %s, expected %d of %s at %d", i, trade, expected[i].quantity, expected[i].maker, expected[i].price)
+		}
+	}
+	if trades[0].ID == trades[1].ID || trades[0].Sequence != trades[1].Sequence {
+		t.Fatalf("Fills of one order share its sequence under their own IDs: %s %s", trades[0], trades[1])
+	}
+
+	// every fill is settled with its owners and its quantity in nanos
+	if len(store.trades) != 2 {
+		t.Fatalf("%d trades settled, expected 2", len(store.trades))
+	}
+	settled := store.trades[1]
+	if settled.TradeID != trades[1].ID || settled.MakerUser != "seller" || settled.TakerUser != "buyer" || settled.Side != "buy" ||
+		settled.Market != global.DefaultMarket || !settled.Quantity.Equal(decimal.New(1, 9)) || !settled.Price.Equal(decimal.New(51, 0)) {
+		t.Fatalf("Unexpected settled trade: %+v", settled)
+	}
+
+	if ob.GetOrder("sell-50") != nil || ob.GetOrder("buy-51") != nil {
+		t.Fatal("Filled orders are still on the book")
+	}
+	if order := ob.GetOrder("sell-51"); order == nil || !order.Quantity().Equal(decimal.New(1, 0)) {
+		t.Fatalf("Partially filled maker is %v, expected 1 left", order)
+	}
+	if price := ob.LastPrice(); !price.Equal(decimal.New(51, 0)) {
+		t.Fatalf("Last price is %s, expected 51", price)
+	}
+}
+
+func TestSettlementFailures(t *testing.T) {
+	ob, store := newTestBook(t)
+	broken := errors.New("broken order")
+	store.settleErr = func(trade *models.TradeSchema) error {
+		switch {
+		case trade.MakerOrderID == "sell-broken":
+			return &db.FillError{OrderID: trade.MakerOrderID, Maker: true, Err: broken}
+		case trade.TakerOrderID == "buy-broken":
+			return &db.FillError{OrderID: trade.TakerOrderID, Err: broken}
+		}
+		return nil
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-broken", "seller", decimal.New(1, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ob.ProcessLimitOrder(Sell, "sell-50", "other", decimal.New(4, 0), decimal.New(50, 0), LimitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a maker that cannot be settled is cancelled and the taker trades on against the next one
+	trades, quantityLeft, _, err := ob.ProcessLimitOrder(Buy, "buy-50", "buyer", decimal.New(2, 0), decimal.New(50, 0), LimitOptions{})
+	if err != nil || !quantityLeft.IsZero() || len(trades) != 1 || trades[0].MakerOrderID != "sell-50" {
+		t.Fatalf("Taker did not trade past the broken maker: %v %s %v", trades, quantityLeft, err)
+	}
+	if ob.GetOrder("sell-broken") != nil || store.cancelled["sell-broken"] == "" {
+		t.Fatal("Broken maker was not cancelled")
+	}
+	if _, ok := store.cancelled["buy-50"]; ok {
+		t.Fatal("Taker was cancelled for its maker's fault")
+	}
+
+	// a taker that cannot be settled is cancelled, reported to the caller and leaves the maker in place
+	trades, _, _, err = ob.ProcessLimitOrder(Buy, "buy-broken", "buyer", decimal.New(1, 0), decimal.New(50, 0), LimitOptions{})
+	if fillErr, ok := err.(*db.FillError); !ok || fillErr.OrderID != "buy-broken" || len(trades) != 0 {
+		t.Fatalf("Expected the taker's FillError, got %v %v", trades, err)
+	}
+	if store.cancelled["buy-broken"] == "" || ob.GetOrder("buy-broken") != nil {
+		t.Fatal("Broken taker was not cancelled")
+	}
+	if order := ob.GetOrder("sell-50"); order == nil || !order.Quantity().Equal(decimal.New(2, 0)) {
+		t.Fatalf("Maker changed by a fill that was not settled: %v", order)
+	}
+}
@@ -18,7 +18,21 @@ func FireEyeStatusHandler(c *gin.Context) {
 	return
 }
 
+// getOrderBook resolves the `market` query parameter, defaulting to global.DefaultMarket
+func getOrderBook(c *gin.Context) (*orderbook.OrderBook, bool) {
+	book, err := orderbook.GetOrderBook(c.DefaultQuery("market", global.DefaultMarket))
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return book, true
+}
+
 func GetMarketPriceHandler(c *gin.Context) {
+	book, ok := getOrderBook(c)
+	if !ok {
+		return
+	}
 	quantityParam := c.Param("quantity")
 	sideParam := c.Param("side")
 	quantity, err := decimal.NewFromString(quantityParam)
@@ -37,7 +51,7 @@ func GetMarketPriceHandler(c *gin.Context) {
 		return
 	}
 
-	price, err := orderbook.CalculateMarketPrice(orderSide, quantity)
+	price, err := book.CalculateMarketPrice(orderSide, quantity)
 	if err != nil {
 		log.Println(err)
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -45,11 +59,15 @@ func GetMarketPriceHandler(c *gin.Context) {
 	}
 	quantityFloat, _ := quantity.Float64()
 	priceFloat, _ := price.Float64()
-	c.SecureJSON(http.StatusOK, gin.H{"quantity": quantityFloat, "price": priceFloat, "side": sideParam})
+	c.SecureJSON(http.StatusOK, gin.H{"quantity": quantityFloat, "price": priceFloat, "side": sideParam, "market": book.Market().Symbol})
 	return
 }
 
 func GetMarketQuantityHandler(c *gin.Context) {
+	book, ok := getOrderBook(c)
+	if !ok {
+		return
+	}
 	maxPriceParam := c.Param("maxPrice")
 	sideParam := c.Param("side")
 	maxPrice, err := decimal.NewFromString(maxPriceParam)
@@ -69,19 +87,23 @@ func GetMarketQuantityHandler(c *gin.Context) {
 	}
 	log.Println(orderSide, maxPrice)
 
-	quantity, err := orderbook.CalculateMarketQuantity(orderSide, maxPrice)
+	quantity, err := book.CalculateMarketQuantity(orderSide, maxPrice)
 	if err != nil {
 		log.Println(err)
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	quantityFloat, _ := quantity.Float64()
-	c.SecureJSON(http.StatusOK, gin.H{"quantity": quantityFloat, "side": sideParam})
+	c.SecureJSON(http.StatusOK, gin.H{"quantity": quantityFloat, "side": sideParam, "market": book.Market().Symbol})
 	return
 }
 
 func GetCurrentDepthHandler(c *gin.Context) {
-	depthMarshal, err := orderbook.DepthMarshalJSON()
+	book, ok := getOrderBook(c)
+	if !ok {
+		return
+	}
+	depthMarshal, err := book.DepthMarshalJSON()
 	if err != nil {
 		log.Println(err)
 		c.SecureJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -97,6 +119,12 @@ func GetCurrentDepthHandler(c *gin.Context) {
 	return
 }
 
+// GetMarketsHandler lists every market with the instrument rules its orders have to follow
+func GetMarketsHandler(c *gin.Context) {
+	c.SecureJSON(http.StatusOK, gin.H{"markets": global.AllMarkets()})
+	return
+}
+
 func GetETHUSDHandler(c *gin.Context) {
 	// log.Println(global.ETHUSD)
 	c.SecureJSON(http.StatusOK, gin.H{"result": global.Exchange.ETHUSD})
@@ -0,0 +1,160 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"exchange-engine/config"
+)
+
+// deleteBatch is the most keys a single DeleteObjects request accepts
+const deleteBatch = 1000
+
+// Store keeps order book snapshots in the bucket of the S3 session
+type Store struct{}
+
+// NewStore returns a snapshot store backed by the bucket set up by Setup
+func NewStore() *Store {
+	return &Store{}
+}
+
+// keySuffix ends the keys of every snapshot, keeping staging snapshots apart from production ones in the same bucket
+func keySuffix() string {
+	if config.IsTest {
+		return "-staging.json"
+	}
+	return ".json"
+}
+
+// currentKey returns the key of the snapshot of `name` that is restored on startup
+func currentKey(name string) string {
+	return fmt.Sprintf("%s-current%s", name, keySuffix())
+}
+
+// versionKey returns the key of the timestamped snapshot `version` of `name`
+func versionKey(name, version string) string {
+	return fmt.Sprintf("%s-%s%s", name, version, keySuffix())
+}
+
+// parseVersion returns the millisecond timestamp of `key` if it is a timestamped snapshot of `name` in this environment
+func parseVersion(name, key string) (int64, bool) {
+	if !strings.HasPrefix(key, name+"-") || !strings.HasSuffix(key, keySuffix()) {
+		return 0, false
+	}
+	millis, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(key, name+"-"), keySuffix()), 10, 64)
+	if err != nil || millis < 0 {
+		return 0, false
+	}
+	return millis, true
+}
+
+// Save uploads a timestamped copy of `data` and overwrites the current snapshot of `name`
+func (s *Store) Save(name string, data []byte) (string, error) {
+	log.Println("uploading... ", name, time.Now())
+	uploader := s3manager.NewUploader(Session.Session)
+	version := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	for _, key := range []string{versionKey(name, version), currentKey(name)} {
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(Session.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	log.Println("done uploading", time.Now())
+	return version, nil
+}
+
+// Current downloads the current snapshot of `name`, nil if there is none
+func (s *Store) Current(name string) ([]byte, error) {
+	log.Println("fetching orderbook: ", currentKey(name))
+	data, err := s.download(currentKey(name))
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Load downloads the timestamped snapshot `version` of `name`
+func (s *Store) Load(name, version string) ([]byte, error) {
+	return s.download(versionKey(name, version))
+}
+
+func (s *Store) download(key string) ([]byte, error) {
+	downloader := s3manager.NewDownloader(Session.Session)
+	buf := aws.NewWriteAtBuffer([]byte{})
+	_, err := downloader.Download(buf,
+		&s3.GetObjectInput{
+			Bucket: aws.String(Session.Bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// List returns the timestamped versions of `name`, oldest first
+func (s *Store) List(name string) ([]string, error) {
+	var millis []int64
+	err := s3.New(Session.Session).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(Session.Bucket),
+		Prefix: aws.String(name + "-"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if m, ok := parseVersion(name, aws.StringValue(object.Key)); ok {
+				millis = append(millis, m)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(millis, func(i, j int) bool { return millis[i] < millis[j] })
+	versions := make([]string, len(millis))
+	for i, m := range millis {
+		versions[i] = strconv.FormatInt(m, 10)
+	}
+	return versions, nil
+}
+
+// Prune deletes all but the newest `keep` timestamped versions of `name`
+func (s *Store) Prune(name string, keep int) (int, error) {
+	versions, err := s.List(name)
+	if err != nil || len(versions) <= keep {
+		return 0, err
+	}
+	stale := versions[:len(versions)-keep]
+	client := s3.New(Session.Session)
+	for start := 0; start < len(stale); start += deleteBatch {
+		end := start + deleteBatch
+		if end > len(stale) {
+			end = len(stale)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, version := range stale[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(versionKey(name, version))})
+		}
+		_, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(Session.Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(stale), nil
+}